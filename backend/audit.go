@@ -0,0 +1,454 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/audit"
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+const (
+	// maxAppendAttempts limits retries when other instances append concurrently
+	maxAppendAttempts = 5
+	// auditBatchSize the number of events read from the store at once
+	auditBatchSize = 1000
+	// maxAuditLimit the most events returned by one query
+	maxAuditLimit = 1000
+	// auditCheckpointInterval a checkpoint is kept every so many events
+	auditCheckpointInterval = 1000
+	// auditClockSkew the most events may be appended out of time order, by
+	// queueing or between instances
+	auditClockSkew = 5 * time.Minute
+)
+
+// errAuditClosed the audit log was closed
+var errAuditClosed = errors.New("audit log is closed")
+
+// auditLog appends events to the hash chain in the audit store in the
+// background. The requests recording events wait only when the store falls
+// behind by more than the queue size.
+type auditLog struct {
+	store  store.Audit
+	logger *slog.Logger
+	events chan types.AuditEvent
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	// head is only used by the appending goroutine
+	head *types.AuditEvent
+}
+
+// newAuditLog starts the audit log of s queueing up to size events, nil if
+// the store cannot store events
+func newAuditLog(s store.Store, size int, logger *slog.Logger) *auditLog {
+	auditStore, ok := s.(store.Audit)
+	if !ok {
+		return nil
+	}
+	a := &auditLog{
+		store:  auditStore,
+		logger: logger,
+		events: make(chan types.AuditEvent, size),
+		done:   make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *auditLog) run() {
+	defer close(a.done)
+	for event := range a.events {
+		if err := a.append(&event); err != nil {
+			a.logger.Error("failed to append audit event", "action", event.Action, "ref", event.Ref, "request_id", event.RequestID, "error", err)
+		}
+	}
+}
+
+// record queues the event to be appended
+func (a *auditLog) record(event types.AuditEvent) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return errAuditClosed
+	}
+	a.events <- event
+	return nil
+}
+
+// close appends the queued events and stops appending
+func (a *auditLog) close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.events)
+	a.mu.Unlock()
+	<-a.done
+}
+
+// hashAuditEvent hashes the event without its own hash
+func hashAuditEvent(event types.AuditEvent) (string, error) {
+	event.Hash = ""
+	data, err := json.Marshal(&event)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadHead finds the newest event after the last checkpoint
+func (a *auditLog) loadHead() error {
+	checkpoints, _, err := a.store.GetAuditCheckpoints()
+	if err != nil {
+		return err
+	}
+	// the chain starts with an empty event
+	head := &types.AuditEvent{}
+	if len(checkpoints) > 0 {
+		checkpoint := checkpoints[len(checkpoints)-1]
+		head = &types.AuditEvent{Sequence: checkpoint.Sequence, Hash: checkpoint.Hash}
+	}
+	a.head = head
+	return a.advanceHead()
+}
+
+// advanceHead moves the head to the newest event appended after it, e.g.
+// by another instance
+func (a *auditLog) advanceHead() error {
+	latest, err := a.store.LastAuditEvent(a.head.Sequence)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a.head = latest
+	return nil
+}
+
+// append chains the event to the newest event in the store, setting its
+// sequence and hashes
+func (a *auditLog) append(event *types.AuditEvent) error {
+	if a.head == nil {
+		if err := a.loadHead(); err != nil {
+			a.head = nil
+			return err
+		}
+	}
+	for attempt := 0; attempt < maxAppendAttempts; attempt++ {
+		event.Sequence = a.head.Sequence + 1
+		event.PrevHash = a.head.Hash
+		hash, err := hashAuditEvent(*event)
+		if err != nil {
+			return err
+		}
+		event.Hash = hash
+
+		err = a.store.AppendAuditEvent(*event)
+		if err == store.ErrConflict {
+			// another instance appended, continue from its newest event
+			if err := a.advanceHead(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		head := *event
+		a.head = &head
+		if event.Sequence%auditCheckpointInterval == 0 {
+			if err := a.checkpoint(*event); err != nil {
+				a.logger.Error("failed to store audit checkpoint", "sequence", event.Sequence, "error", err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("append audit event: %w", store.ErrConflict)
+}
+
+// checkpoint adds the event to the checkpoints, retrying when another
+// instance added one concurrently
+func (a *auditLog) checkpoint(event types.AuditEvent) error {
+	checkpoint := types.AuditCheckpoint{Sequence: event.Sequence, Time: event.Time, Hash: event.Hash}
+	for attempt := 0; attempt < maxAppendAttempts; attempt++ {
+		checkpoints, version, err := a.store.GetAuditCheckpoints()
+		if err != nil {
+			return err
+		}
+		// keep the checkpoints ordered by sequence
+		i := sort.Search(len(checkpoints), func(i int) bool {
+			return checkpoints[i].Sequence >= checkpoint.Sequence
+		})
+		if i < len(checkpoints) && checkpoints[i].Sequence == checkpoint.Sequence {
+			return nil
+		}
+		checkpoints = append(checkpoints[:i], append([]types.AuditCheckpoint{checkpoint}, checkpoints[i:]...)...)
+		if err := a.store.PutAuditCheckpoints(checkpoints, version); err != store.ErrConflict {
+			return err
+		}
+	}
+	return fmt.Errorf("store audit checkpoint: %w", store.ErrConflict)
+}
+
+// checkpointBefore returns the last checkpoint at least auditClockSkew
+// before t, nil when there is none
+func checkpointBefore(checkpoints []types.AuditCheckpoint, t time.Time) *types.AuditCheckpoint {
+	t = t.Add(-auditClockSkew)
+	var found *types.AuditCheckpoint
+	for i, checkpoint := range checkpoints {
+		if !checkpoint.Time.Before(t) {
+			break
+		}
+		found = &checkpoints[i]
+	}
+	return found
+}
+
+// auditResult classifies a response status
+func auditResult(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusTooManyRequests:
+		return audit.ResultDenied
+	case status >= http.StatusBadRequest:
+		return audit.ResultFailure
+	}
+	return audit.ResultSuccess
+}
+
+// audited records every request served by next as action in the audit
+// log and sends it to the audit sinks
+func (c *Backend) audited(action string, next http.HandlerFunc) http.HandlerFunc {
+	if c.audit == nil && len(c.auditSinks) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		event := types.AuditEvent{
+			Time:     time.Now().UTC(),
+			Action:   action,
+			SourceIP: auth.SourceAddress(r, c.options.ForwardedFor),
+			Status:   status,
+			Result:   auditResult(status),
+		}
+		if info := getRequestInfo(r); info != nil {
+			event.RequestID = info.id
+			event.Ref = info.ref
+			event.LockID = info.lockID
+			event.Version = info.version
+			if info.identity != nil {
+				event.Subject = info.identity.Subject
+				event.Identity = info.identity.Name
+			}
+		}
+		if c.audit != nil {
+			if err := c.audit.record(event); err != nil {
+				c.logger(r).Error("failed to record audit event", "action", action, "ref", event.Ref, "error", err)
+			}
+		}
+		for _, sink := range c.auditSinks {
+			if err := sink.Write(event); err != nil {
+				c.logger(r).Warn("failed to send audit event", "action", action, "ref", event.Ref, "error", err)
+			}
+		}
+	}
+}
+
+// Close appends the queued audit events, writes the buffered ones and
+// closes the audit sinks
+func (c *Backend) Close() error {
+	if c.audit != nil {
+		c.audit.close()
+	}
+	var errs []error
+	for _, sink := range c.auditSinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// auditQuery filters audit events
+type auditQuery struct {
+	ref     string
+	subject string
+	from    time.Time
+	to      time.Time
+	after   uint64
+	limit   int
+}
+
+func parseAuditQuery(r *http.Request) (*auditQuery, error) {
+	values := r.URL.Query()
+	query := auditQuery{
+		ref:     values.Get("ref"),
+		subject: values.Get("subject"),
+		limit:   100,
+	}
+	var err error
+	if from := values.Get("from"); from != "" {
+		if query.from, err = time.Parse(time.RFC3339, from); err != nil {
+			return nil, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if query.to, err = time.Parse(time.RFC3339, to); err != nil {
+			return nil, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if after := values.Get("after"); after != "" {
+		if query.after, err = strconv.ParseUint(after, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid after: %w", err)
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.limit, err = strconv.Atoi(limit); err != nil || query.limit < 1 {
+			return nil, fmt.Errorf("invalid limit: %s", limit)
+		}
+	}
+	if query.limit > maxAuditLimit {
+		query.limit = maxAuditLimit
+	}
+	return &query, nil
+}
+
+func (q *auditQuery) matches(event types.AuditEvent) bool {
+	if q.ref != "" && event.Ref != q.ref {
+		return false
+	}
+	if q.subject != "" && event.Subject != q.subject {
+		return false
+	}
+	if !q.from.IsZero() && event.Time.Before(q.from) {
+		return false
+	}
+	return true
+}
+
+// auditResponse the events matching a query. Next continues a query cut
+// off by its limit, BrokenAt is the first event not chained to its
+// predecessor.
+type auditResponse struct {
+	Events   []types.AuditEvent `json:"events"`
+	Next     uint64             `json:"next,omitempty"`
+	Verified bool               `json:"verified"`
+	BrokenAt uint64             `json:"broken_at,omitempty"`
+}
+
+// verifies event is intact and chained to previous
+func verifyAuditEvent(previous *types.AuditEvent, event types.AuditEvent) bool {
+	hash, err := hashAuditEvent(event)
+	if err != nil || hash != event.Hash {
+		return false
+	}
+	return event.Sequence == previous.Sequence+1 && event.PrevHash == previous.Hash
+}
+
+// HandleListAuditEvents lists the audit events matching the ref, subject,
+// from and to query parameters, verifying the hash chain of the events read
+func (c *Backend) HandleListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	if c.audit == nil {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "the audit log is not enabled")
+		return
+	}
+	if _, ok := c.admin(w, r); !ok {
+		return
+	}
+	query, err := parseAuditQuery(r)
+	if err != nil {
+		c.logger(r).Error("invalid audit query", "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "", err.Error())
+		return
+	}
+
+	response := auditResponse{Events: []types.AuditEvent{}, Verified: true}
+	// the chain starts with an empty event
+	previous := &types.AuditEvent{}
+	if query.after > 0 {
+		anchor, err := c.audit.store.ListAuditEvents(query.after-1, 1)
+		if err != nil {
+			c.logger(r).Error("failed to list audit events", "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to list audit events")
+			return
+		}
+		if len(anchor) == 1 && anchor[0].Sequence == query.after {
+			previous = &anchor[0]
+		} else {
+			response.Verified = false
+			response.BrokenAt = query.after
+		}
+	}
+
+	after := query.after
+	// start verifying at the last checkpoint before the time range
+	if after == 0 && !query.from.IsZero() {
+		checkpoints, _, err := c.audit.store.GetAuditCheckpoints()
+		if err != nil {
+			c.logger(r).Error("failed to get audit checkpoints", "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to list audit events")
+			return
+		}
+		if checkpoint := checkpointBefore(checkpoints, query.from); checkpoint != nil {
+			previous = &types.AuditEvent{Sequence: checkpoint.Sequence, Hash: checkpoint.Hash}
+			after = checkpoint.Sequence
+		}
+	}
+scan:
+	for {
+		events, err := c.audit.store.ListAuditEvents(after, auditBatchSize)
+		if err != nil {
+			c.logger(r).Error("failed to list audit events", "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to list audit events")
+			return
+		}
+		for i, event := range events {
+			if response.Verified && !verifyAuditEvent(previous, event) {
+				c.logger(r).Error("audit log hash chain is broken", "sequence", event.Sequence)
+				response.Verified = false
+				response.BrokenAt = event.Sequence
+			}
+			previous = &events[i]
+			if !query.to.IsZero() && event.Time.After(query.to) {
+				break scan
+			}
+			if !query.matches(event) {
+				continue
+			}
+			response.Events = append(response.Events, event)
+			if len(response.Events) == query.limit {
+				response.Next = event.Sequence
+				break scan
+			}
+		}
+		if len(events) < auditBatchSize {
+			break
+		}
+		after = events[len(events)-1].Sequence
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(response)
+}
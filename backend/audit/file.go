@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// File writes events as JSON lines to a file, rotated to path.1 up to
+// path.N once it exceeds its maximum size
+type File struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFile opens the JSON lines file at path for appending. A maxSize of 0
+// disables rotation.
+func NewFile(path string, maxSize int64, maxBackups int) (*File, error) {
+	f := &File{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate shifts the backups, dropping the oldest, and starts a new file
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.maxBackups < 1 {
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		return f.open()
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Write implements Sink
+func (f *File) Write(event types.AuditEvent) error {
+	line, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		// a previous rotation failed
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			f.file = nil
+			return fmt.Errorf("rotate %s: %w", f.path, err)
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// Close implements Sink
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
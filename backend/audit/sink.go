@@ -0,0 +1,114 @@
+// Package audit streams audit events to external sinks
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// results of audit events
+const (
+	ResultSuccess = "success"
+	ResultDenied  = "denied"
+	ResultFailure = "failure"
+)
+
+// ErrBufferFull the event was dropped as the sink does not keep up
+var ErrBufferFull = errors.New("audit sink buffer is full")
+
+// Sink receives audit events
+type Sink interface {
+	Write(event types.AuditEvent) error
+	Close() error
+}
+
+// Writer writes events as JSON lines, e.g. to stdout
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter creates a JSON lines sink writing to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write implements Sink
+func (s *Writer) Write(event types.AuditEvent) error {
+	line, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close implements Sink
+func (s *Writer) Close() error {
+	return nil
+}
+
+// Buffered writes events to a sink in the background. Events are dropped
+// instead of blocking the caller when the buffer is full.
+type Buffered struct {
+	sink    Sink
+	events  chan types.AuditEvent
+	done    chan struct{}
+	onError func(err error)
+	dropped atomic.Uint64
+}
+
+// NewBuffered starts writing events buffered up to size to sink, onError
+// receives the errors of the sink
+func NewBuffered(sink Sink, size int, onError func(err error)) *Buffered {
+	if onError == nil {
+		onError = func(err error) {}
+	}
+	b := &Buffered{
+		sink:    sink,
+		events:  make(chan types.AuditEvent, size),
+		done:    make(chan struct{}),
+		onError: onError,
+	}
+	go b.run()
+	return b
+}
+
+func (b *Buffered) run() {
+	defer close(b.done)
+	for event := range b.events {
+		if err := b.sink.Write(event); err != nil {
+			b.onError(err)
+		}
+	}
+}
+
+// Write implements Sink, it does not block
+func (b *Buffered) Write(event types.AuditEvent) error {
+	select {
+	case b.events <- event:
+		return nil
+	default:
+		b.dropped.Add(1)
+		return ErrBufferFull
+	}
+}
+
+// Close writes the buffered events and closes the sink
+func (b *Buffered) Close() error {
+	close(b.events)
+	<-b.done
+	return b.sink.Close()
+}
+
+// Dropped returns the number of events dropped as the buffer was full
+func (b *Buffered) Dropped() uint64 {
+	return b.dropped.Load()
+}
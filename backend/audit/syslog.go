@@ -0,0 +1,140 @@
+package audit
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+const (
+	// facilityLogAudit the RFC 5424 log audit facility
+	facilityLogAudit = 13
+
+	severityWarning = 4
+	severityNotice  = 5
+	severityInfo    = 6
+
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 5 * time.Second
+)
+
+// Syslog sends events as RFC 5424 messages over UDP, TCP or TLS. TCP and
+// TLS messages are framed by octet counting (RFC 6587, RFC 5425).
+type Syslog struct {
+	mu        sync.Mutex
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	hostname  string
+	appName   string
+	conn      net.Conn
+}
+
+// NewSyslog creates a syslog sink for the udp, tcp or tls network,
+// tlsConfig is used for tls. The connection is established on the first
+// event and re-established after failures.
+func NewSyslog(network, address string, tlsConfig *tls.Config) (*Syslog, error) {
+	switch network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("unknown syslog network: %s", network)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &Syslog{
+		network:   network,
+		address:   address,
+		tlsConfig: tlsConfig,
+		hostname:  hostname,
+		appName:   "terraform-backend-hsdp",
+	}, nil
+}
+
+func (s *Syslog) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if s.network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+	}
+	return dialer.Dial(s.network, s.address)
+}
+
+// severity of the event by its result
+func severity(event types.AuditEvent) int {
+	switch event.Result {
+	case ResultDenied:
+		return severityNotice
+	case ResultFailure:
+		return severityWarning
+	}
+	return severityInfo
+}
+
+// format renders the event as RFC 5424 message with the event as JSON
+// message and the action as MSGID
+func (s *Syslog) format(event types.AuditEvent) ([]byte, error) {
+	body, err := json.Marshal(&event)
+	if err != nil {
+		return nil, err
+	}
+	msgID := event.Action
+	if msgID == "" {
+		msgID = "-"
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s %d %s - ",
+		facilityLogAudit*8+severity(event),
+		event.Time.UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		s.appName,
+		os.Getpid(),
+		msgID,
+	)
+	return append([]byte(header), body...), nil
+}
+
+// Write implements Sink
+func (s *Syslog) Write(event types.AuditEvent) error {
+	message, err := s.format(event)
+	if err != nil {
+		return err
+	}
+	if s.network != "udp" {
+		message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return fmt.Errorf("syslog dial %s: %w", s.address, err)
+		}
+		s.conn = conn
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := s.conn.Write(message); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("syslog write %s: %w", s.address, err)
+	}
+	return nil
+}
+
+// Close implements Sink
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrNoCredentials the request carries no credentials the authenticator handles
+var ErrNoCredentials = errors.New("no credentials")
+
+// ErrForbidden the identity is authenticated but not allowed the operation
+var ErrForbidden = errors.New("forbidden")
+
+// ErrInvalidPath the requested state path could escape its namespace
+var ErrInvalidPath = errors.New("invalid state path")
+
+// ErrUnavailable the identity provider could not verify the credentials,
+// they are neither accepted nor rejected
+var ErrUnavailable = errors.New("identity provider unavailable")
+
+// Identity an authenticated principal
+type Identity struct {
+	Subject  string   `json:"subject"`
+	Name     string   `json:"name"`
+	Groups   []string `json:"groups,omitempty"`
+	Provider string   `json:"provider"`
+	// Scope restricts the identity, e.g. when authenticated with an API token
+	Scope *Scope `json:"scope,omitempty"`
+}
+
+// qualifiedSubject prefixes the name of an identity with its provider and
+// escapes it to a single path segment, so subjects of different providers
+// never collide and never resolve into another namespace such as teams
+func qualifiedSubject(provider, name string) string {
+	return provider + ":" + url.PathEscape(name)
+}
+
+// Authenticator authenticates requests. It returns ErrNoCredentials when
+// the request carries no credentials it handles so the next one can be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// RefResolver resolves the state ref for an identity and requested path
+type RefResolver func(identity *Identity, path string) (string, error)
+
+// NamespaceRef resolves refs in the namespace of the identity subject
+func NamespaceRef(identity *Identity, p string) (string, error) {
+	ref := path.Join(identity.Subject, p)
+	if ref != identity.Subject && !strings.HasPrefix(ref, identity.Subject+"/") {
+		return "", fmt.Errorf("%w: %s is outside the namespace of %s", ErrInvalidPath, p, identity.Name)
+	}
+	return ref, nil
+}
+
+// ValidatePath rejects requested state paths that are absolute or have
+// empty, . or .. segments, a trailing slash is allowed. The empty path is
+// the namespace root.
+func ValidatePath(p string) error {
+	if p == "" {
+		return nil
+	}
+	if strings.HasPrefix(p, "/") {
+		return fmt.Errorf("%w: %s is absolute", ErrInvalidPath, p)
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(p, "/"), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("%w: %s", ErrInvalidPath, p)
+		}
+	}
+	return nil
+}
+
+// ValidateOwner rejects owners that are not a single path segment
+func ValidateOwner(owner string) error {
+	if owner == "" || strings.Contains(owner, "/") || ValidatePath(owner) != nil {
+		return fmt.Errorf("%w: invalid owner %s", ErrInvalidPath, owner)
+	}
+	return nil
+}
+
+// Chain tries authenticators in order until one handles the credentials.
+// It fails with an error wrapping ErrNoCredentials when none does.
+type Chain []Authenticator
+
+// Authenticate implements Authenticator
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, authenticator := range c {
+		identity, err := authenticator.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+		return identity, err
+	}
+	return nil, fmt.Errorf("missing authentication: %w", ErrNoCredentials)
+}
+
+// AllowList only accepts identities with one of the listed subjects. Names
+// are not unique across providers, only HSDP logins are matched by name,
+// listed as hsdp:<login> or as a plain login as before subjects.
+type AllowList struct {
+	Authenticator Authenticator
+	Subjects      []string
+}
+
+// Authenticate implements Authenticator
+func (a *AllowList) Authenticate(r *http.Request) (*Identity, error) {
+	identity, err := a.Authenticator.Authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	login, isHSDP := hsdpLogin(identity)
+	for _, subject := range a.Subjects {
+		if identity.Subject == subject {
+			return identity, nil
+		}
+		if isHSDP && (subject == "hsdp:"+login || (subject == login && !strings.Contains(subject, ":"))) {
+			return identity, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s is not allowed to use this backend", ErrForbidden, identity.Name)
+}
+
+// hsdpLogin returns the HSDP login of identity, including the tokens of
+// HSDP users, whose subjects are UUIDs without a provider
+func hsdpLogin(identity *Identity) (string, bool) {
+	switch {
+	case identity.Provider == "hsdp":
+		return identity.Name, true
+	case identity.Provider == "token" && !strings.Contains(identity.Subject, ":"):
+		return identity.Name, true
+	}
+	return "", false
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// staticAuthenticator authenticates every request as its identity
+type staticAuthenticator struct {
+	identity *Identity
+}
+
+func (s staticAuthenticator) Authenticate(*http.Request) (*Identity, error) {
+	return s.identity, nil
+}
+
+// passwordAuthenticator accepts the basic auth password "secret"
+type passwordAuthenticator struct{}
+
+func (passwordAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	if password != "secret" {
+		return nil, errors.New("invalid credentials")
+	}
+	return &Identity{Subject: "test:" + username, Name: username}, nil
+}
+
+func TestAllowListSubjects(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	for _, tt := range []struct {
+		identity *Identity
+		allowed  bool
+	}{
+		{&Identity{Subject: "htpasswd:alice", Name: "alice", Provider: "htpasswd"}, true},
+		// the same name from another provider is another identity
+		{&Identity{Subject: "oidc:alice", Name: "alice", Provider: "oidc"}, false},
+		{&Identity{Subject: "cert:bob", Name: "htpasswd:alice", Provider: "mtls"}, false},
+	} {
+		allowList := &AllowList{
+			Authenticator: staticAuthenticator{tt.identity},
+			Subjects:      []string{"htpasswd:alice"},
+		}
+		_, err := allowList.Authenticate(r)
+		if tt.allowed && err != nil {
+			t.Errorf("%s: expected to be allowed, got %v", tt.identity.Subject, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: expected to be forbidden, got %v", tt.identity.Subject, err)
+		}
+	}
+}
+
+func TestAllowListHSDPLogins(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	hsdpUser := &Identity{Subject: "4e6a8f0c-1b2d-4c3e-9f5a-6b7c8d9e0f1a", Name: "alice", Provider: "hsdp"}
+	for _, tt := range []struct {
+		name     string
+		subjects []string
+		identity *Identity
+		allowed  bool
+	}{
+		// allow lists of usernames from before subjects keep working
+		{"legacy login", []string{"alice"}, hsdpUser, true},
+		{"qualified login", []string{"hsdp:alice"}, hsdpUser, true},
+		{"uuid", []string{hsdpUser.Subject}, hsdpUser, true},
+		{"token of the hsdp user", []string{"alice"}, &Identity{Subject: hsdpUser.Subject, Name: "alice", Provider: "token"}, true},
+		{"other login", []string{"bob"}, hsdpUser, false},
+		// logins only match HSDP identities
+		{"htpasswd name", []string{"alice"}, &Identity{Subject: "htpasswd:alice", Name: "alice", Provider: "htpasswd"}, false},
+		{"token of an htpasswd user", []string{"hsdp:alice"}, &Identity{Subject: "htpasswd:alice", Name: "alice", Provider: "token"}, false},
+	} {
+		allowList := &AllowList{
+			Authenticator: staticAuthenticator{tt.identity},
+			Subjects:      tt.subjects,
+		}
+		_, err := allowList.Authenticate(r)
+		if tt.allowed && err != nil {
+			t.Errorf("%s: expected to be allowed, got %v", tt.name, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: expected to be forbidden, got %v", tt.name, err)
+		}
+	}
+}
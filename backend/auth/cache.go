@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// NewCredentialCache creates a cache holding at most maxEntries verified
+// credentials for ttl and failed ones for negativeTTL
+func NewCredentialCache(ttl, negativeTTL time.Duration, maxEntries int) *CredentialCache {
+	salt := make([]byte, 32)
+	_, _ = rand.Read(salt)
+	return &CredentialCache{
+		salt:        salt,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		maxEntries:  maxEntries,
+		entries:     map[[sha256.Size]byte]*list.Element{},
+		order:       list.New(),
+	}
+}
+
+// CredentialCache remembers the outcome of credential verification and the
+// region usernames were last verified in. Entries are keyed on a salted
+// hash of the credentials and requested region, the least recently used
+// entry is evicted when the cache is full.
+type CredentialCache struct {
+	mu          sync.Mutex
+	salt        []byte
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	entries     map[[sha256.Size]byte]*list.Element
+	order       *list.List
+}
+
+type cacheEntry struct {
+	key      [sha256.Size]byte
+	identity *Identity
+	region   string
+	err      error
+	expires  time.Time
+}
+
+// key hashes the parts, the kind of entry first
+func (c *CredentialCache) key(parts ...string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, c.salt)
+	for _, part := range parts {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	var key [sha256.Size]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+func (c *CredentialCache) credentialsKey(username, password, region string) [sha256.Size]byte {
+	return c.key("credentials", username, password, region)
+}
+
+func (c *CredentialCache) regionKey(username string) [sha256.Size]byte {
+	return c.key("region", username)
+}
+
+// get returns the live entry of key, c.mu must be held
+func (c *CredentialCache) get(key [sha256.Size]byte) (*cacheEntry, bool) {
+	element, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry, true
+}
+
+// put adds or replaces an entry and evicts the least recently used ones,
+// c.mu must be held
+func (c *CredentialCache) put(entry *cacheEntry) {
+	if element, found := c.entries[entry.key]; found {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Get returns the cached outcome for the credentials in region, any region
+// when empty, found is false on a miss
+func (c *CredentialCache) Get(username, password, region string) (identity *Identity, found bool, err error) {
+	key := c.credentialsKey(username, password, region)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.get(key)
+	if !found {
+		return nil, false, nil
+	}
+	return entry.identity, true, entry.err
+}
+
+// Put caches a successful verification in region, which also answers
+// requests for any region, or the failure of a request for region, any
+// region when empty, when err is set
+func (c *CredentialCache) Put(username, password, region string, identity *Identity, err error) {
+	ttl := c.ttl
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 || c.maxEntries <= 0 {
+		return
+	}
+	expires := time.Now().Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		c.put(&cacheEntry{key: c.credentialsKey(username, password, region), err: err, expires: expires})
+		return
+	}
+	c.put(&cacheEntry{key: c.credentialsKey(username, password, ""), identity: identity, expires: expires})
+	if region != "" {
+		c.put(&cacheEntry{key: c.credentialsKey(username, password, region), identity: identity, expires: expires})
+		c.put(&cacheEntry{key: c.regionKey(username), region: region, expires: expires})
+	}
+}
+
+// Region returns the region the username was last verified in
+func (c *CredentialCache) Region(username string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.get(c.regionKey(username))
+	if !found {
+		return ""
+	}
+	return entry.region
+}
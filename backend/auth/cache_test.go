@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// expire makes every entry of the cache expired
+func expire(c *CredentialCache) {
+	for _, element := range c.entries {
+		element.Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+	}
+}
+
+func TestCredentialCacheTTL(t *testing.T) {
+	cache := NewCredentialCache(time.Minute, time.Minute, 10)
+	identity := &Identity{Subject: "uuid-1", Name: "alice", Provider: "hsdp"}
+	cache.Put("alice", "secret", "us-east", identity, nil)
+
+	for _, region := range []string{"us-east", ""} {
+		cached, found, err := cache.Get("alice", "secret", region)
+		if !found || err != nil || cached != identity {
+			t.Fatalf("region %q: expected the cached identity, got %v, %v, %v", region, cached, found, err)
+		}
+	}
+	if _, found, _ := cache.Get("alice", "secret", "eu-west"); found {
+		t.Fatal("expected a miss in another region")
+	}
+	if _, found, _ := cache.Get("alice", "wrong", ""); found {
+		t.Fatal("expected a miss for another password")
+	}
+	if region := cache.Region("alice"); region != "us-east" {
+		t.Fatalf("expected the last region, got %q", region)
+	}
+
+	expire(cache)
+	if _, found, _ := cache.Get("alice", "secret", ""); found {
+		t.Fatal("expected the expired entry to miss")
+	}
+	if region := cache.Region("alice"); region != "" {
+		t.Fatalf("expected the expired region to miss, got %q", region)
+	}
+	if len(cache.entries) != 1 || cache.order.Len() != 1 {
+		t.Fatalf("expected the expired entries read to be removed, %d left", len(cache.entries))
+	}
+
+	disabled := NewCredentialCache(0, time.Minute, 10)
+	disabled.Put("alice", "secret", "us-east", identity, nil)
+	if _, found, _ := disabled.Get("alice", "secret", ""); found {
+		t.Fatal("expected a zero TTL not to cache")
+	}
+}
+
+func TestCredentialCacheNegative(t *testing.T) {
+	cache := NewCredentialCache(time.Minute, time.Minute, 10)
+	rejected := errors.New("authorization failed")
+	cache.Put("alice", "wrong", "us-east", nil, rejected)
+
+	if _, found, err := cache.Get("alice", "wrong", "us-east"); !found || err != rejected {
+		t.Fatalf("expected the cached failure, got %v, %v", found, err)
+	}
+	// a failure in one region does not answer another
+	if _, found, _ := cache.Get("alice", "wrong", ""); found {
+		t.Fatal("expected a miss for any region")
+	}
+	if region := cache.Region("alice"); region != "" {
+		t.Fatalf("expected a failure not to record the region, got %q", region)
+	}
+
+	noNegative := NewCredentialCache(time.Minute, 0, 10)
+	noNegative.Put("alice", "wrong", "us-east", nil, rejected)
+	if _, found, _ := noNegative.Get("alice", "wrong", "us-east"); found {
+		t.Fatal("expected a zero negative TTL not to cache failures")
+	}
+}
+
+func TestCredentialCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewCredentialCache(time.Minute, time.Minute, 3)
+	rejected := errors.New("authorization failed")
+	for i := 0; i < 3; i++ {
+		cache.Put(fmt.Sprintf("user-%d", i), "wrong", "", nil, rejected)
+	}
+	// reading the oldest makes the second the least recently used
+	if _, found, _ := cache.Get("user-0", "wrong", ""); !found {
+		t.Fatal("expected user-0 to be cached")
+	}
+	cache.Put("user-3", "wrong", "", nil, rejected)
+
+	if len(cache.entries) != 3 || cache.order.Len() != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(cache.entries))
+	}
+	for user, want := range map[string]bool{"user-0": true, "user-1": false, "user-2": true, "user-3": true} {
+		if _, found, _ := cache.Get(user, "wrong", ""); found != want {
+			t.Errorf("%s: expected cached %v, got %v", user, want, found)
+		}
+	}
+}
+
+func TestCredentialCacheKeys(t *testing.T) {
+	first := NewCredentialCache(time.Minute, time.Minute, 10)
+	second := NewCredentialCache(time.Minute, time.Minute, 10)
+
+	key := first.credentialsKey("alice", "secret", "us-east")
+	if key != first.credentialsKey("alice", "secret", "us-east") {
+		t.Fatal("expected the same key for the same credentials")
+	}
+	// instances use their own salt, keys cannot be precomputed
+	if key == second.credentialsKey("alice", "secret", "us-east") {
+		t.Fatal("expected another salt to give another key")
+	}
+	if bytes.Contains(key[:], []byte("secret")) {
+		t.Fatal("expected the key not to contain the password")
+	}
+	// parts are separated, shifting characters between them changes the key
+	if first.credentialsKey("alic", "esecret", "us-east") == key {
+		t.Fatal("expected the parts to be separated")
+	}
+	if first.regionKey("alice") == first.credentialsKey("alice", "", "") {
+		t.Fatal("expected the kinds of entries to be separated")
+	}
+}
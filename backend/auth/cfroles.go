@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dip-software/go-dip-api/config"
+	"github.com/dip-software/go-dip-api/console"
+	"golang.org/x/sync/singleflight"
+)
+
+// maxCachedRoles bounds the identities whose roles are cached, expired
+// entries and then those expiring first are evicted beyond it
+const maxCachedRoles = 10000
+
+// RoleLister lists the Cloud Foundry org and space roles of a user
+type RoleLister interface {
+	// ListRoles returns the names of the orgs and spaces, as org.space,
+	// the user has a role in
+	ListRoles(userGUID string) ([]string, error)
+}
+
+// HSDPRoles uses the HSDP org and space memberships of an identity as its
+// groups, results are cached for TTL. Concurrent lookups of the same
+// identity share one call to the Lister.
+type HSDPRoles struct {
+	Lister RoleLister
+	TTL    time.Duration
+
+	mu      sync.Mutex
+	cache   map[string]cachedRoles
+	lookups singleflight.Group
+}
+
+type cachedRoles struct {
+	groups  []string
+	expires time.Time
+}
+
+// Groups implements GroupSource
+func (h *HSDPRoles) Groups(identity *Identity) ([]string, error) {
+	if identity.Provider != "hsdp" && identity.Provider != "token" {
+		return nil, nil
+	}
+	if groups, ok := h.cached(identity.Subject); ok {
+		return groups, nil
+	}
+	groups, err, _ := h.lookups.Do(identity.Subject, func() (interface{}, error) {
+		groups, err := h.Lister.ListRoles(identity.Subject)
+		if err != nil {
+			return nil, err
+		}
+		h.store(identity.Subject, groups)
+		return groups, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups.([]string), nil
+}
+
+// cached returns the live cached groups of subject
+func (h *HSDPRoles) cached(subject string) ([]string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cached, ok := h.cache[subject]
+	if !ok || time.Now().After(cached.expires) {
+		return nil, false
+	}
+	return cached.groups, true
+}
+
+// store caches the groups of subject, evicting entries at capacity
+func (h *HSDPRoles) store(subject string, groups []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if h.cache == nil {
+		h.cache = map[string]cachedRoles{}
+	}
+	if _, ok := h.cache[subject]; !ok && len(h.cache) >= maxCachedRoles {
+		for key, cached := range h.cache {
+			if now.After(cached.expires) {
+				delete(h.cache, key)
+			}
+		}
+		for len(h.cache) >= maxCachedRoles {
+			first := ""
+			for key, cached := range h.cache {
+				if first == "" || cached.expires.Before(h.cache[first].expires) {
+					first = key
+				}
+			}
+			delete(h.cache, first)
+		}
+	}
+	h.cache[subject] = cachedRoles{groups: groups, expires: now.Add(h.TTL)}
+}
+
+// NewCFRoles creates a role lister for the Cloud Foundry API of region,
+// authenticating as the given functional account. Only roles in orgs and
+// spaces visible to that account are listed.
+func NewCFRoles(region, username, password string) (*CFRoles, error) {
+	cfg, err := config.New(config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	client, err := console.NewClient(nil, &console.Config{
+		Region: region,
+		UAAURL: cfg.Service("uaa").URL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Login(username, password); err != nil {
+		return nil, fmt.Errorf("CF login: %w", err)
+	}
+	return &CFRoles{
+		apiURL: strings.TrimSuffix(cfg.Service("cf").URL, "/"),
+		client: client,
+	}, nil
+}
+
+// CFRoles lists roles with the Cloud Foundry v3 API
+type CFRoles struct {
+	apiURL string
+	client *console.Client
+}
+
+// ListRoles implements RoleLister
+func (c *CFRoles) ListRoles(userGUID string) ([]string, error) {
+	token, err := c.client.Token()
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("user_guids", userGUID)
+	query.Set("include", "organization,space")
+	query.Set("per_page", "5000")
+	req, err := http.NewRequest(http.MethodGet, c.apiURL+"/v3/roles?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "bearer "+token.AccessToken)
+	resp, err := c.client.HttpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing CF roles: unexpected status %d", resp.StatusCode)
+	}
+
+	type relationship struct {
+		Data *struct {
+			GUID string `json:"guid"`
+		} `json:"data"`
+	}
+	var roles struct {
+		Resources []struct {
+			Relationships struct {
+				Organization relationship `json:"organization"`
+				Space        relationship `json:"space"`
+			} `json:"relationships"`
+		} `json:"resources"`
+		Included struct {
+			Organizations []struct {
+				GUID string `json:"guid"`
+				Name string `json:"name"`
+			} `json:"organizations"`
+			Spaces []struct {
+				GUID          string `json:"guid"`
+				Name          string `json:"name"`
+				Relationships struct {
+					Organization relationship `json:"organization"`
+				} `json:"relationships"`
+			} `json:"spaces"`
+		} `json:"included"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&roles); err != nil {
+		return nil, fmt.Errorf("decoding CF roles: %w", err)
+	}
+
+	orgs := map[string]string{}
+	for _, org := range roles.Included.Organizations {
+		orgs[org.GUID] = org.Name
+	}
+	spaces := map[string]string{}
+	for _, space := range roles.Included.Spaces {
+		if space.Relationships.Organization.Data != nil {
+			spaces[space.GUID] = orgs[space.Relationships.Organization.Data.GUID] + "." + space.Name
+		}
+	}
+	seen := map[string]bool{}
+	var groups []string
+	for _, role := range roles.Resources {
+		var group string
+		if org := role.Relationships.Organization.Data; org != nil {
+			group = orgs[org.GUID]
+		}
+		if space := role.Relationships.Space.Data; space != nil {
+			group = spaces[space.GUID]
+		}
+		if group != "" && !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+// Fields of a client certificate an identity name can be derived from
+const (
+	CertCommonName = "cn"
+	CertEmail      = "email"
+	CertDNSName    = "dns"
+	CertURI        = "uri"
+)
+
+// ClientCert authenticates requests with a verified TLS client certificate.
+// The identity name is taken from the certificate field selected by
+// Identity, the common name by default. Organizational units are its groups.
+type ClientCert struct {
+	Identity string
+}
+
+// NewClientCert returns a ClientCert deriving identities from field
+func NewClientCert(field string) (*ClientCert, error) {
+	switch field {
+	case "", CertCommonName, CertEmail, CertDNSName, CertURI:
+		return &ClientCert{Identity: field}, nil
+	}
+	return nil, fmt.Errorf("unknown client certificate identity field: %s", field)
+}
+
+// Authenticate implements Authenticator
+func (c *ClientCert) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	name := c.name(cert)
+	if name == "" {
+		return nil, ErrNoCredentials
+	}
+	return &Identity{
+		Subject:  qualifiedSubject("cert", name),
+		Name:     name,
+		Groups:   cert.Subject.OrganizationalUnit,
+		Provider: "mtls",
+	}, nil
+}
+
+// the identity name, the first subject alternative name of the selected kind
+func (c *ClientCert) name(cert *x509.Certificate) string {
+	switch c.Identity {
+	case CertEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case CertDNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case CertURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
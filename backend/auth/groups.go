@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TeamsPrefix starts the paths of team namespaces: /teams/<team>/<path>
+const TeamsPrefix = "teams"
+
+// GroupSource resolves the groups of an identity
+type GroupSource interface {
+	Groups(identity *Identity) ([]string, error)
+}
+
+// ClaimGroups the groups the authenticator put on the identity, e.g.
+// from an OIDC groups claim
+type ClaimGroups struct{}
+
+// Groups implements GroupSource
+func (ClaimGroups) Groups(identity *Identity) ([]string, error) {
+	return identity.Groups, nil
+}
+
+// LoadStaticGroups reads a JSON file mapping group names to the subjects of
+// their members
+func LoadStaticGroups(filename string) (StaticGroups, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var groups StaticGroups
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return groups, nil
+}
+
+// StaticGroups maps group names to the subjects of their members. Names
+// are not unique across providers and are never matched.
+type StaticGroups map[string][]string
+
+// Groups implements GroupSource
+func (s StaticGroups) Groups(identity *Identity) ([]string, error) {
+	var groups []string
+	for group, members := range s {
+		for _, member := range members {
+			if member == identity.Subject {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	return groups, nil
+}
+
+// MultiGroups the union of the groups of its sources
+type MultiGroups []GroupSource
+
+// Groups implements GroupSource
+func (m MultiGroups) Groups(identity *Identity) ([]string, error) {
+	var groups []string
+	for _, source := range m {
+		g, err := source.Groups(identity)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g...)
+	}
+	return groups, nil
+}
+
+// TeamRef resolves paths starting with /teams/<team>/ to the shared team
+// namespace when the identity is a member of the group named <team>, other
+// paths are resolved by next
+func TeamRef(source GroupSource, next RefResolver) RefResolver {
+	return func(identity *Identity, path string) (string, error) {
+		parts := strings.SplitN(strings.Trim(filepath.Clean("/"+path), "/"), "/", 3)
+		if parts[0] != TeamsPrefix {
+			return next(identity, path)
+		}
+		if len(parts) < 2 {
+			return "", fmt.Errorf("missing team in %s", path)
+		}
+		team := parts[1]
+		groups, err := source.Groups(identity)
+		if err != nil {
+			return "", fmt.Errorf("resolving groups of %s: %w", identity.Name, err)
+		}
+		for _, group := range groups {
+			if group == team {
+				return filepath.Join(parts...), nil
+			}
+		}
+		return "", fmt.Errorf("%w: %s is not a member of team %s", ErrForbidden, identity.Name, team)
+	}
+}
+
+// StatePath returns the path of a ref as requested by its owner, which is
+// the ref itself for team namespaces and the ref without the subject
+// namespace otherwise
+func StatePath(ref string) string {
+	if strings.HasPrefix(ref, TeamsPrefix+"/") {
+		return ref
+	}
+	_, path, _ := strings.Cut(ref, "/")
+	return path
+}
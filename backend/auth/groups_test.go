@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRoles lists the roles of users from a map and counts the calls, calls
+// for users in block wait until the channel is closed
+type fakeRoles struct {
+	mu    sync.Mutex
+	roles map[string][]string
+	calls map[string]int
+	block map[string]chan struct{}
+	err   error
+}
+
+func (f *fakeRoles) ListRoles(userGUID string) ([]string, error) {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = map[string]int{}
+	}
+	f.calls[userGUID]++
+	wait := f.block[userGUID]
+	f.mu.Unlock()
+	if wait != nil {
+		<-wait
+	}
+	return f.roles[userGUID], f.err
+}
+
+func (f *fakeRoles) callsOf(userGUID string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[userGUID]
+}
+
+func TestStaticGroupsSubjects(t *testing.T) {
+	groups := StaticGroups{"platform": {"htpasswd:alice", "uuid-1"}, "ops": {"uuid-1"}}
+	for _, tt := range []struct {
+		identity *Identity
+		want     int
+	}{
+		{&Identity{Subject: "htpasswd:alice", Name: "alice"}, 1},
+		{&Identity{Subject: "uuid-1", Name: "bob"}, 2},
+		// the same name from another provider is not a member
+		{&Identity{Subject: "oidc:alice", Name: "alice"}, 0},
+		{&Identity{Subject: "cert:eve", Name: "uuid-1"}, 0},
+	} {
+		member, err := groups.Groups(tt.identity)
+		if err != nil || len(member) != tt.want {
+			t.Errorf("%s: expected %d groups, got %v, %v", tt.identity.Subject, tt.want, member, err)
+		}
+	}
+}
+
+func TestHSDPRolesCache(t *testing.T) {
+	lister := &fakeRoles{roles: map[string][]string{"uuid-1": {"platform", "platform.dev"}}}
+	roles := &HSDPRoles{Lister: lister, TTL: time.Minute}
+	alice := &Identity{Subject: "uuid-1", Name: "alice", Provider: "hsdp"}
+
+	for i := 0; i < 3; i++ {
+		groups, err := roles.Groups(alice)
+		if err != nil || len(groups) != 2 {
+			t.Fatalf("expected the roles of alice, got %v, %v", groups, err)
+		}
+	}
+	if calls := lister.callsOf("uuid-1"); calls != 1 {
+		t.Fatalf("expected the roles to be cached, got %d calls", calls)
+	}
+	roles.cache["uuid-1"] = cachedRoles{groups: []string{"platform"}, expires: time.Now().Add(-time.Second)}
+	if groups, _ := roles.Groups(alice); len(groups) != 2 || lister.callsOf("uuid-1") != 2 {
+		t.Fatalf("expected expired roles to be listed again, got %v", groups)
+	}
+
+	// other providers have no HSDP roles
+	if groups, _ := roles.Groups(&Identity{Subject: "oidc:uuid-1", Name: "uuid-1", Provider: "oidc"}); groups != nil {
+		t.Fatalf("expected no roles for another provider, got %v", groups)
+	}
+
+	// failures are not cached
+	failing := &HSDPRoles{Lister: &fakeRoles{err: errors.New("unavailable")}, TTL: time.Minute}
+	if _, err := failing.Groups(alice); err == nil {
+		t.Fatal("expected the failure to be returned")
+	}
+	if len(failing.cache) != 0 {
+		t.Fatal("expected the failure not to be cached")
+	}
+}
+
+func TestHSDPRolesConcurrentLookups(t *testing.T) {
+	slow := make(chan struct{})
+	lister := &fakeRoles{
+		roles: map[string][]string{"uuid-1": {"platform"}, "uuid-2": {"ops"}},
+		block: map[string]chan struct{}{"uuid-1": slow},
+	}
+	roles := &HSDPRoles{Lister: lister, TTL: time.Minute}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if groups, err := roles.Groups(&Identity{Subject: "uuid-1", Provider: "hsdp"}); err != nil || len(groups) != 1 {
+				t.Errorf("expected the roles of uuid-1, got %v, %v", groups, err)
+			}
+		}()
+	}
+	for lister.callsOf("uuid-1") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a slow lookup does not hold up other identities
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if groups, err := roles.Groups(&Identity{Subject: "uuid-2", Provider: "hsdp"}); err != nil || len(groups) != 1 {
+			t.Errorf("expected the roles of uuid-2, got %v, %v", groups, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup of uuid-2 waited for uuid-1")
+	}
+
+	close(slow)
+	wg.Wait()
+	if calls := lister.callsOf("uuid-1"); calls != 1 {
+		t.Fatalf("expected concurrent lookups to share one call, got %d", calls)
+	}
+}
+
+func TestHSDPRolesEvicts(t *testing.T) {
+	roles := &HSDPRoles{Lister: &fakeRoles{}, TTL: time.Minute, cache: map[string]cachedRoles{}}
+	now := time.Now()
+	for i := 0; i < maxCachedRoles; i++ {
+		roles.cache[fmt.Sprintf("uuid-%d", i)] = cachedRoles{expires: now.Add(time.Duration(i+1) * time.Second)}
+	}
+	roles.cache["uuid-expired"] = cachedRoles{expires: now.Add(-time.Second)}
+	delete(roles.cache, "uuid-1")
+
+	if _, err := roles.Groups(&Identity{Subject: "uuid-new", Provider: "hsdp"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := roles.cache["uuid-expired"]; ok {
+		t.Fatal("expected the expired entry to be evicted")
+	}
+	if _, ok := roles.cache["uuid-new"]; !ok || len(roles.cache) != maxCachedRoles {
+		t.Fatalf("expected the new entry within capacity, %d entries", len(roles.cache))
+	}
+
+	if _, err := roles.Groups(&Identity{Subject: "uuid-newer", Provider: "hsdp"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := roles.cache["uuid-0"]; ok || len(roles.cache) != maxCachedRoles {
+		t.Fatalf("expected the entry expiring first to be evicted, %d entries", len(roles.cache))
+	}
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dip-software/go-dip-api/config"
+)
+
+// errRejected the UAA rejected the credentials
+var errRejected = errors.New("credentials rejected")
+
+// regionClient is the UAA token endpoint and ID token verifier for an HSDP
+// region
+type regionClient struct {
+	tokenURL string
+	verifier *Verifier
+}
+
+// NewHSDP creates an authenticator for HSDP LDAP and functional accounts in
+// the given regions. Regions without a known UAA are skipped.
+func NewHSDP(regions []string) *HSDP {
+	h := &HSDP{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		clients: make(map[string]regionClient, len(regions)),
+	}
+	for _, region := range regions {
+		cfg, err := config.New(config.WithRegion(region))
+		if err != nil {
+			continue
+		}
+		uaaURL := strings.TrimSuffix(cfg.Service("uaa").URL, "/")
+		if uaaURL == "" {
+			continue
+		}
+		h.clients[region] = regionClient{
+			tokenURL: uaaURL + "/oauth/token",
+			verifier: &Verifier{
+				Issuer:   uaaURL + "/oauth/token",
+				Audience: "cf",
+				KeySet:   NewKeySet(uaaURL+"/token_keys", nil),
+			},
+		}
+	}
+	return h
+}
+
+// HSDP authenticates Basic credentials with an HSDP UAA login. The
+// optional region query parameter limits the login to that region. Logins
+// failing for other reasons than rejected credentials return ErrUnavailable.
+type HSDP struct {
+	// Cache avoids a login per request when set
+	Cache   *CredentialCache
+	client  *http.Client
+	clients map[string]regionClient
+}
+
+// Regions returns the regions a client was created for
+func (h *HSDP) Regions() []string {
+	regions := make([]string, 0, len(h.clients))
+	for region := range h.clients {
+		regions = append(regions, region)
+	}
+	return regions
+}
+
+// Authenticate implements Authenticator
+func (h *HSDP) Authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	checkRegion := r.URL.Query().Get("region")
+
+	if h.Cache != nil {
+		if identity, found, err := h.Cache.Get(username, password, checkRegion); found {
+			return identity, err
+		}
+	}
+
+	identity, region, err := h.login(username, password, checkRegion)
+	// the credentials were not verified, a later attempt may succeed
+	if errors.Is(err, ErrUnavailable) {
+		return nil, err
+	}
+	if h.Cache != nil {
+		if err != nil {
+			region = checkRegion
+		}
+		h.Cache.Put(username, password, region, identity, err)
+	}
+	return identity, err
+}
+
+// regionOrder returns the regions to try, the last known region first
+func (h *HSDP) regionOrder(username, checkRegion string) []string {
+	if checkRegion != "" {
+		return []string{checkRegion}
+	}
+	var preferred string
+	if h.Cache != nil {
+		preferred = h.Cache.Region(username)
+	}
+	regions := make([]string, 0, len(h.clients))
+	if _, ok := h.clients[preferred]; ok {
+		regions = append(regions, preferred)
+	}
+	for region := range h.clients {
+		if region != preferred {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+// login logs in to the regions in order until one succeeds, ErrUnavailable
+// when no region rejected the credentials but one could not verify them
+func (h *HSDP) login(username, password, checkRegion string) (*Identity, string, error) {
+	var unavailable error
+	for _, region := range h.regionOrder(username, checkRegion) {
+		rc, ok := h.clients[region]
+		if !ok {
+			continue
+		}
+		idToken, err := h.passwordGrant(rc, username, password)
+		if errors.Is(err, errRejected) {
+			continue
+		}
+		if err != nil {
+			unavailable = fmt.Errorf("region %s: %w", region, err)
+			continue
+		}
+		claims, err := rc.verifier.Verify(idToken)
+		if err != nil {
+			unavailable = fmt.Errorf("%w: region %s: ID token verification failed: %w", ErrUnavailable, region, err)
+			continue
+		}
+		return &Identity{
+			Subject:  claims["sub"].(string),
+			Name:     username,
+			Provider: "hsdp",
+		}, region, nil
+	}
+	if unavailable != nil {
+		return nil, "", unavailable
+	}
+	return nil, "", fmt.Errorf("authorization failed")
+}
+
+// passwordGrant logs in to the UAA of the region and returns the ID token,
+// errRejected when the UAA rejects the credentials
+func (h *HSDP) passwordGrant(rc regionClient, username, password string) (string, error) {
+	form := url.Values{}
+	form.Set("username", username)
+	form.Set("password", password)
+	form.Set("grant_type", "password")
+	req, err := http.NewRequest(http.MethodPost, rc.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth("cf", "")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusUnauthorized:
+		return "", errRejected
+	default:
+		return "", fmt.Errorf("%w: login returned status %d", ErrUnavailable, resp.StatusCode)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("%w: decoding login response: %w", ErrUnavailable, err)
+	}
+	if token.IDToken == "" {
+		return "", fmt.Errorf("%w: login response has no ID token", ErrUnavailable)
+	}
+	return token.IDToken, nil
+}
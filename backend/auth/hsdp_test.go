@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestHSDP(t *testing.T, status int) (*HSDP, *atomic.Int32) {
+	t.Helper()
+	var logins atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logins.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	h := &HSDP{
+		Cache:  NewCredentialCache(time.Minute, time.Minute, 100),
+		client: server.Client(),
+		clients: map[string]regionClient{
+			"test": {tokenURL: server.URL + "/oauth/token", verifier: newTestVerifier(server.URL)},
+		},
+	}
+	return h, &logins
+}
+
+func TestHSDPLoginFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		unavailable bool
+		logins      int32
+	}{
+		// rejected credentials are negative cached
+		{name: "rejected credentials", status: http.StatusUnauthorized, logins: 1},
+		{name: "invalid grant", status: http.StatusBadRequest, logins: 1},
+		// the UAA failing is retried on the next request
+		{name: "unavailable UAA", status: http.StatusBadGateway, unavailable: true, logins: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, logins := newTestHSDP(t, tt.status)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.SetBasicAuth("alice", "secret")
+			for i := 0; i < 2; i++ {
+				_, err := h.Authenticate(r)
+				if err == nil {
+					t.Fatal("expected the login to fail")
+				}
+				if errors.Is(err, ErrUnavailable) != tt.unavailable {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if got := logins.Load(); got != tt.logins {
+				t.Fatalf("expected %d logins, got %d", tt.logins, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LoadHtpasswd reads static users from an htpasswd style file with one
+// user:bcrypt-hash per line
+func LoadHtpasswd(filename string) (*Htpasswd, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := &Htpasswd{
+		users: map[string][]byte{},
+	}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(entry, ":")
+		if !found || !strings.HasPrefix(hash, "$2") {
+			return nil, fmt.Errorf("%s:%d: expected user:bcrypt-hash", filename, line)
+		}
+		h.users[user] = []byte(hash)
+	}
+	return h, scanner.Err()
+}
+
+// Htpasswd authenticates Basic credentials of static users
+type Htpasswd struct {
+	users map[string][]byte
+}
+
+// Authenticate implements Authenticator
+func (h *Htpasswd) Authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	hash, ok := h.users[username]
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return nil, fmt.Errorf("authorization failed")
+	}
+	return &Identity{
+		Subject:  qualifiedSubject("htpasswd", username),
+		Name:     username,
+		Provider: "htpasswd",
+	}, nil
+}
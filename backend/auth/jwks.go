@@ -0,0 +1,132 @@
+// Package auth authenticates backend requests
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// minRefreshInterval limits JWKS fetches triggered by unknown key IDs
+const minRefreshInterval = time.Minute
+
+// NewKeySet creates a key set fetching its keys from jwksURL
+func NewKeySet(jwksURL string, client *http.Client) *KeySet {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &KeySet{
+		url:    jwksURL,
+		client: client,
+		keys:   map[string]*rsa.PublicKey{},
+	}
+}
+
+// KeySet the RSA signing keys published by a token issuer as a JWKS
+type KeySet struct {
+	url     string
+	client  *http.Client
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// Keyfunc returns the key for the token kid, refreshing the key set on a miss
+func (k *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+	if time.Since(k.fetched) < minRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key: %s", kid)
+}
+
+// lookup finds the key by kid, a missing kid matches a single key set
+func (k *KeySet) lookup(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func (k *KeySet) refresh() error {
+	k.fetched = time.Now()
+
+	resp, err := k.client.Get(k.url)
+	if err != nil {
+		return fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("decoding JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := rsaPublicKey(jwk)
+		if err != nil {
+			return fmt.Errorf("decoding JWKS key %s: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	k.keys = keys
+	return nil
+}
+
+func rsaPublicKey(jwk jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+	if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("invalid RSA key")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NewOIDC creates an authenticator for bearer JWTs of an OIDC issuer. The
+// key set location is discovered from the issuer configuration.
+func NewOIDC(issuer, audience, groupsClaim string) (*OIDC, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery: unexpected status %d", resp.StatusCode)
+	}
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("OIDC discovery: issuer mismatch: %s", discovery.Issuer)
+	}
+	return &OIDC{
+		GroupsClaim: groupsClaim,
+		Verifier: &Verifier{
+			Issuer:   issuer,
+			Audience: audience,
+			KeySet:   NewKeySet(discovery.JWKSURI, client),
+		},
+	}, nil
+}
+
+// OIDC authenticates bearer JWTs issued by an OIDC provider
+type OIDC struct {
+	GroupsClaim string
+	Verifier    *Verifier
+}
+
+// Authenticate implements Authenticator
+func (o *OIDC) Authenticate(r *http.Request) (*Identity, error) {
+	raw, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	claims, err := o.Verifier.Verify(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		Subject:  qualifiedSubject("oidc", claims["sub"].(string)),
+		Provider: "oidc",
+	}
+	for _, claim := range []string{"preferred_username", "email", "name", "sub"} {
+		if name, ok := claims[claim].(string); ok && name != "" {
+			identity.Name = name
+			break
+		}
+	}
+	if groups, ok := claims[o.GroupsClaim].([]interface{}); ok {
+		for _, group := range groups {
+			if g, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, g)
+			}
+		}
+	}
+	return identity, nil
+}
+
+// bearerToken returns the token of a Bearer Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
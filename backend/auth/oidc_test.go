@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// oidcIdentity authenticates a bearer token with the subject sub
+func oidcIdentity(t *testing.T, sub string) *Identity {
+	t.Helper()
+	key := newTestKey(t)
+	server := newJWKSServer(t, map[string]*rsa.PublicKey{"kid-1": &key.PublicKey})
+	claims := validClaims()
+	claims["sub"] = sub
+	claims["preferred_username"] = sub
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+signRS256(t, key, "kid-1", claims))
+	identity, err := (&OIDC{Verifier: newTestVerifier(server.URL)}).Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestOIDCSubjectNamespace(t *testing.T) {
+	policy := &Policy{OwnerRole: RoleAdmin, TeamRole: RoleAdmin}
+	resolve := TeamRef(StaticGroups{"platform": {"alice"}}, NamespaceRef)
+
+	teams := oidcIdentity(t, TeamsPrefix)
+	if teams.Subject != "oidc:teams" {
+		t.Fatalf("expected the subject to be qualified, got %s", teams.Subject)
+	}
+	// the own namespace of the identity does not resolve into the teams
+	ref, err := resolve(teams, "platform/network")
+	if err != nil || ref != "oidc:teams/platform/network" {
+		t.Fatalf("expected a ref in the own namespace, got %s, %v", ref, err)
+	}
+	if _, err := resolve(teams, "teams/platform/network"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected the team namespace to be forbidden, got %v", err)
+	}
+
+	// the subject of another provider is another namespace
+	uuid := "7b3a4c1e-6f29-4d8e-9a51-2c0e8f6d1b47"
+	impostor := oidcIdentity(t, uuid)
+	if ref, err := resolve(impostor, "prod"); err != nil || strings.HasPrefix(ref, uuid+"/") {
+		t.Fatalf("expected a ref outside the HSDP namespace, got %s, %v", ref, err)
+	}
+	roles, err := policy.Roles(impostor, uuid+"/prod")
+	if err != nil || len(roles) != 0 {
+		t.Fatalf("expected no roles in the HSDP namespace, got %v, %v", roles, err)
+	}
+
+	// a subject with a slash stays a single segment
+	nested := oidcIdentity(t, "a/b")
+	if nested.Subject != "oidc:a%2Fb" {
+		t.Fatalf("expected the subject to be escaped, got %s", nested.Subject)
+	}
+	if roles, _ := policy.Roles(oidcIdentity(t, "a"), nested.Subject+"/prod"); len(roles) != 0 {
+		t.Fatalf("expected no roles in the nested namespace, got %v", roles)
+	}
+}
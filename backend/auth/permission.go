@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"strings"
+)
+
+// Permission an operation on a state
+type Permission string
+
+const (
+	// Read get and list states and versions
+	Read Permission = "read"
+	// Lock lock and unlock states
+	Lock Permission = "lock"
+	// Write update and delete states
+	Write Permission = "write"
+	// Admin restore versions, apply retention and manage access
+	Admin Permission = "admin"
+)
+
+// Includes reports whether permission p includes other. Admin includes
+// every permission, Write includes Lock and Read, Lock includes Read.
+func (p Permission) Includes(other Permission) bool {
+	rank := map[Permission]int{Read: 1, Lock: 2, Write: 3, Admin: 4}
+	return rank[p] > 0 && rank[p] >= rank[other]
+}
+
+// Scope restricts what an identity may do
+type Scope struct {
+	Permissions []Permission `json:"permissions"`
+	RefPrefixes []string     `json:"ref_prefixes,omitempty"`
+}
+
+// Allows reports whether the scope allows permission on the requested path
+func (s *Scope) Allows(permission Permission, path string) bool {
+	if s == nil {
+		return true
+	}
+	allowed := false
+	for _, p := range s.Permissions {
+		if p == permission {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	if len(s.RefPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range s.RefPrefixes {
+		if HasPathPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPathPrefix reports whether path is prefix or lies below it, matching
+// whole path segments so app does not cover app-secrets
+func HasPathPrefix(path, prefix string) bool {
+	path = strings.Trim(path, "/")
+	prefix = strings.Trim(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/glob"
+)
+
+// Role a named permission level on refs
+type Role string
+
+const (
+	// RoleReader may read states and versions
+	RoleReader Role = "reader"
+	// RoleLocker may additionally lock and unlock states
+	RoleLocker Role = "locker"
+	// RoleWriter may additionally update and delete states
+	RoleWriter Role = "writer"
+	// RoleAdmin may additionally restore versions and apply retention
+	RoleAdmin Role = "admin"
+	// RoleNone grants nothing, e.g. to disable the owner role
+	RoleNone Role = "none"
+)
+
+var rolePermissions = map[Role]Permission{
+	RoleReader: Read,
+	RoleLocker: Lock,
+	RoleWriter: Write,
+	RoleAdmin:  Admin,
+}
+
+// Binding assigns a role on the refs matching one of the glob patterns to
+// subjects and to members of groups. Names are not unique across providers
+// and are never matched.
+type Binding struct {
+	Role     Role     `json:"role"`
+	Refs     []string `json:"refs"`
+	Subjects []string `json:"subjects,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// Policy decides which role an identity has on a ref
+type Policy struct {
+	// OwnerRole is the role of identities in their own namespace
+	OwnerRole Role `json:"owner_role,omitempty"`
+	// TeamRole is the role of team members in the team namespace
+	TeamRole Role      `json:"team_role,omitempty"`
+	Bindings []Binding `json:"bindings"`
+	// Groups resolves the groups of identities, defaults to their claims
+	Groups GroupSource `json:"-"`
+}
+
+// LoadPolicy reads a JSON policy file. The owner and team roles default
+// to admin.
+func LoadPolicy(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if policy.OwnerRole == "" {
+		policy.OwnerRole = RoleAdmin
+	}
+	if policy.TeamRole == "" {
+		policy.TeamRole = RoleAdmin
+	}
+	roles := []Role{policy.OwnerRole, policy.TeamRole}
+	for _, binding := range policy.Bindings {
+		roles = append(roles, binding.Role)
+	}
+	for _, role := range roles {
+		if _, ok := rolePermissions[role]; !ok && role != RoleNone {
+			return nil, fmt.Errorf("%s: unknown role: %s", filename, role)
+		}
+	}
+	return &policy, nil
+}
+
+// Allows reports whether the roles of the identity on ref include permission
+func (p *Policy) Allows(identity *Identity, permission Permission, ref string) (bool, error) {
+	if p == nil {
+		return true, nil
+	}
+	roles, err := p.Roles(identity, ref)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if rolePermissions[role].Includes(permission) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Roles the roles of the identity on ref
+func (p *Policy) Roles(identity *Identity, ref string) ([]Role, error) {
+	var roles []Role
+	if ref == identity.Subject || strings.HasPrefix(ref, identity.Subject+"/") {
+		roles = append(roles, p.OwnerRole)
+	}
+	// team membership is verified when the team ref is resolved
+	if strings.HasPrefix(ref, TeamsPrefix+"/") {
+		roles = append(roles, p.TeamRole)
+	}
+	var groups []string
+	for _, binding := range p.Bindings {
+		if !binding.matchesRef(ref) {
+			continue
+		}
+		if binding.matchesSubject(identity) {
+			roles = append(roles, binding.Role)
+			continue
+		}
+		if len(binding.Groups) == 0 {
+			continue
+		}
+		if groups == nil {
+			var err error
+			if groups, err = p.groups(identity); err != nil {
+				return nil, err
+			}
+		}
+		if binding.matchesGroup(groups) {
+			roles = append(roles, binding.Role)
+		}
+	}
+	return roles, nil
+}
+
+func (p *Policy) groups(identity *Identity) ([]string, error) {
+	if p.Groups == nil {
+		return identity.Groups, nil
+	}
+	groups, err := p.Groups.Groups(identity)
+	if err != nil {
+		return nil, fmt.Errorf("resolving groups of %s: %w", identity.Name, err)
+	}
+	return groups, nil
+}
+
+func (b Binding) matchesRef(ref string) bool {
+	for _, pattern := range b.Refs {
+		if glob.Match(pattern, ref) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b Binding) matchesSubject(identity *Identity) bool {
+	for _, subject := range b.Subjects {
+		if subject == identity.Subject {
+			return true
+		}
+	}
+	return false
+}
+
+func (b Binding) matchesGroup(groups []string) bool {
+	for _, group := range b.Groups {
+		for _, g := range groups {
+			if group == g {
+				return true
+			}
+		}
+	}
+	return false
+}
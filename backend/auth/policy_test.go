@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyAllows(t *testing.T) {
+	policy := &Policy{
+		OwnerRole: RoleWriter,
+		TeamRole:  RoleLocker,
+		Bindings: []Binding{
+			{Role: RoleReader, Refs: []string{"*/prod/**"}, Groups: []string{"auditors"}},
+			{Role: RoleAdmin, Refs: []string{"teams/platform/**"}, Subjects: []string{"uuid-admin"}},
+			{Role: RoleWriter, Refs: []string{"uuid-bob/shared/*"}, Subjects: []string{"htpasswd:alice"}},
+		},
+	}
+	alice := &Identity{Subject: "htpasswd:alice", Name: "alice"}
+	auditor := &Identity{Subject: "uuid-carol", Name: "carol", Groups: []string{"auditors"}}
+	admin := &Identity{Subject: "uuid-admin", Name: "admin"}
+	// names never match bindings
+	impostor := &Identity{Subject: "oidc:eve", Name: "htpasswd:alice"}
+
+	for _, tt := range []struct {
+		name       string
+		identity   *Identity
+		permission Permission
+		ref        string
+		allowed    bool
+	}{
+		{"owner writes", alice, Write, "htpasswd:alice/prod", true},
+		{"owner role excludes admin", alice, Admin, "htpasswd:alice/prod", false},
+		{"owner role on the namespace root", alice, Read, "htpasswd:alice", true},
+		{"namespace prefix is not the namespace", alice, Read, "htpasswd:alice2/prod", false},
+		{"team role locks", alice, Lock, "teams/network/vpc", true},
+		{"team role excludes write", alice, Write, "teams/network/vpc", false},
+		{"subject binding", alice, Write, "uuid-bob/shared/db", true},
+		{"single star stays in a segment", alice, Read, "uuid-bob/shared/db/replica", false},
+		{"double star spans segments", auditor, Read, "uuid-bob/prod/network/vpc", true},
+		{"double star matches no segment", auditor, Read, "uuid-bob/prod", true},
+		{"group binding excludes lock", auditor, Lock, "uuid-bob/prod/network", false},
+		{"group binding needs the ref", auditor, Read, "uuid-bob/dev/network", false},
+		{"admin binding", admin, Admin, "teams/platform/network", true},
+		{"admin binding outside refs", admin, Read, "uuid-bob/dev", false},
+		{"name matches no subject binding", impostor, Read, "uuid-bob/shared/db", false},
+		{"name matches no owner role", impostor, Read, "htpasswd:alice/prod", false},
+	} {
+		allowed, err := policy.Allows(tt.identity, tt.permission, tt.ref)
+		if err != nil || allowed != tt.allowed {
+			t.Errorf("%s: expected %v, got %v, %v", tt.name, tt.allowed, allowed, err)
+		}
+	}
+
+	var none *Policy
+	if allowed, err := none.Allows(impostor, Admin, "uuid-bob/prod"); !allowed || err != nil {
+		t.Fatalf("expected no policy to allow everything, got %v, %v", allowed, err)
+	}
+}
+
+func TestPolicyGroupSource(t *testing.T) {
+	policy := &Policy{
+		OwnerRole: RoleNone,
+		TeamRole:  RoleNone,
+		Bindings:  []Binding{{Role: RoleReader, Refs: []string{"**"}, Groups: []string{"auditors"}}},
+		Groups:    StaticGroups{"auditors": {"uuid-carol"}},
+	}
+	for _, tt := range []struct {
+		identity *Identity
+		allowed  bool
+	}{
+		{&Identity{Subject: "uuid-carol"}, true},
+		// the group source overrides the claims
+		{&Identity{Subject: "uuid-eve", Groups: []string{"auditors"}}, false},
+	} {
+		allowed, err := policy.Allows(tt.identity, Read, "uuid-bob/prod")
+		if err != nil || allowed != tt.allowed {
+			t.Errorf("%s: expected %v, got %v, %v", tt.identity.Subject, tt.allowed, allowed, err)
+		}
+	}
+	// the none owner role leaves only bindings
+	if allowed, _ := policy.Allows(&Identity{Subject: "uuid-eve"}, Read, "uuid-eve/prod"); allowed {
+		t.Fatal("expected the none owner role to grant nothing")
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	policy, err := LoadPolicy(write("default.json", `{"bindings": [{"role": "reader", "refs": ["**"], "subjects": ["uuid-carol"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.OwnerRole != RoleAdmin || policy.TeamRole != RoleAdmin {
+		t.Fatalf("expected the owner and team roles to default to admin, got %s, %s", policy.OwnerRole, policy.TeamRole)
+	}
+	for name, content := range map[string]string{
+		"unknown owner role":   `{"owner_role": "owner"}`,
+		"unknown binding role": `{"bindings": [{"role": "root", "refs": ["**"]}]}`,
+		"invalid json":         `{"bindings": `,
+	} {
+		if _, err := LoadPolicy(write("invalid.json", content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrLockedOut the username or source address failed too often
+var ErrLockedOut = errors.New("too many failed attempts")
+
+// maxThrottleEntries bounds the failure counters kept in memory, the
+// counters with the oldest failures are evicted beyond it
+const maxThrottleEntries = 10000
+
+// throttleEvictions is how many counters are evicted at once at capacity
+const throttleEvictions = maxThrottleEntries / 10
+
+// Lockout the failure counter of a username or source address
+type Lockout struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+// ThrottleStats totals of failed attempts and lockouts since start
+type ThrottleStats struct {
+	FailedAttempts uint64 `json:"failed_attempts"`
+	Lockouts       uint64 `json:"lockouts"`
+	Rejected       uint64 `json:"rejected"`
+}
+
+// NewThrottle creates a Throttle locking out after threshold consecutive
+// failures for backoff, doubling with every further failure up to maxBackoff
+func NewThrottle(threshold int, backoff, maxBackoff time.Duration) *Throttle {
+	return &Throttle{
+		Threshold:  threshold,
+		Backoff:    backoff,
+		MaxBackoff: maxBackoff,
+		entries:    map[string]*Lockout{},
+	}
+}
+
+// Throttle counts failed authentications per username and source address.
+// Requests of locked out usernames are rejected without verifying
+// credentials, locked out source addresses are only rejected on invalid
+// credentials as they may be shared by many clients.
+type Throttle struct {
+	Authenticator Authenticator
+	Threshold     int
+	Backoff       time.Duration
+	MaxBackoff    time.Duration
+	// Addresses counts failures per source address, set only when the
+	// source address identifies the client rather than a router
+	Addresses bool
+	// ForwardedFor takes the source address from the last X-Forwarded-For
+	// entry, set when running behind a router
+	ForwardedFor bool
+
+	mu      sync.Mutex
+	entries map[string]*Lockout
+	stats   ThrottleStats
+}
+
+// Authenticate implements Authenticator
+func (t *Throttle) Authenticate(r *http.Request) (*Identity, error) {
+	address, user := t.keys(r)
+	if until := t.lockedUntil(user); !until.IsZero() {
+		return nil, fmt.Errorf("%w: locked until %s", ErrLockedOut, until.Format(time.RFC3339))
+	}
+	identity, err := t.Authenticator.Authenticate(r)
+	if errors.Is(err, ErrNoCredentials) || errors.Is(err, ErrForbidden) || errors.Is(err, ErrUnavailable) {
+		return identity, err
+	}
+	if err != nil {
+		until := t.lockedUntil(address)
+		t.fail(append(address, user...))
+		if !until.IsZero() {
+			return nil, fmt.Errorf("%w: locked until %s", ErrLockedOut, until.Format(time.RFC3339))
+		}
+		return nil, err
+	}
+	t.succeed(user)
+	return identity, nil
+}
+
+// the counter keys of the request: its source address, when counted, and
+// basic auth username
+func (t *Throttle) keys(r *http.Request) (address, user []string) {
+	if t.Addresses {
+		address = []string{"ip:" + SourceAddress(r, t.ForwardedFor)}
+	}
+	if username, _, ok := r.BasicAuth(); ok && username != "" {
+		user = []string{"user:" + username}
+	}
+	return address, user
+}
+
+func (t *Throttle) lockedUntil(keys []string) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var until time.Time
+	now := time.Now()
+	for _, key := range keys {
+		if entry, ok := t.entries[key]; ok && entry.LockedUntil.After(now) && entry.LockedUntil.After(until) {
+			until = entry.LockedUntil
+		}
+	}
+	if !until.IsZero() {
+		t.stats.Rejected++
+	}
+	return until
+}
+
+func (t *Throttle) fail(keys []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.stats.FailedAttempts++
+	if len(t.entries)+len(keys) > maxThrottleEntries {
+		t.prune(now)
+		t.evict(len(t.entries) + len(keys) - maxThrottleEntries)
+	}
+	for _, key := range keys {
+		entry, ok := t.entries[key]
+		if !ok {
+			entry = &Lockout{Key: key}
+			t.entries[key] = entry
+		}
+		entry.Failures++
+		entry.LastFailure = now
+		if entry.Failures < t.Threshold {
+			continue
+		}
+		backoff := t.Backoff
+		for i := t.Threshold; i < entry.Failures && backoff < t.MaxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > t.MaxBackoff {
+			backoff = t.MaxBackoff
+		}
+		entry.LockedUntil = now.Add(backoff)
+		t.stats.Lockouts++
+	}
+}
+
+// a successful login resets the username, not the shared source address
+func (t *Throttle) succeed(keys []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range keys {
+		delete(t.entries, key)
+	}
+}
+
+// forgets counters without failures within the maximum backoff
+func (t *Throttle) prune(now time.Time) {
+	for key, entry := range t.entries {
+		if entry.LockedUntil.Before(now) && entry.LastFailure.Add(t.MaxBackoff).Before(now) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// evicts at least n counters, those with the oldest failures first
+func (t *Throttle) evict(n int) {
+	if n <= 0 {
+		return
+	}
+	n = max(n, throttleEvictions)
+	entries := make([]*Lockout, 0, len(t.entries))
+	for _, entry := range t.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastFailure.Before(entries[j].LastFailure)
+	})
+	for _, entry := range entries[:min(n, len(entries))] {
+		delete(t.entries, entry.Key)
+	}
+}
+
+// Lockouts lists the current failure counters, locked out ones first
+func (t *Throttle) Lockouts() []Lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(time.Now())
+	lockouts := []Lockout{}
+	for _, entry := range t.entries {
+		lockouts = append(lockouts, *entry)
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		if !lockouts[i].LockedUntil.Equal(lockouts[j].LockedUntil) {
+			return lockouts[i].LockedUntil.After(lockouts[j].LockedUntil)
+		}
+		return lockouts[i].Key < lockouts[j].Key
+	})
+	return lockouts
+}
+
+// Clear resets the counter of key, or all counters when key is empty
+func (t *Throttle) Clear(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if key == "" {
+		t.entries = map[string]*Lockout{}
+		return true
+	}
+	if _, ok := t.entries[key]; !ok {
+		return false
+	}
+	delete(t.entries, key)
+	return true
+}
+
+// Stats the totals of failed attempts and lockouts since start
+func (t *Throttle) Stats() ThrottleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// SourceAddress returns the address of the client, with forwardedFor the
+// last X-Forwarded-For entry added by the trusted proxy in front
+func SourceAddress(r *http.Request, forwardedFor bool) string {
+	address := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwardedFor && forwarded != "" {
+		entries := strings.Split(forwarded, ",")
+		address = strings.TrimSpace(entries[len(entries)-1])
+	}
+	return address
+}
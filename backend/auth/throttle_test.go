@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// failingAuthenticator fails every request with err
+type failingAuthenticator struct {
+	err error
+}
+
+func (f failingAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	return nil, f.err
+}
+
+func TestThrottleEvictsOldest(t *testing.T) {
+	throttle := NewThrottle(3, time.Minute, time.Hour)
+	now := time.Now()
+	for i := 0; i < maxThrottleEntries; i++ {
+		key := fmt.Sprintf("ip:%d", i)
+		throttle.entries[key] = &Lockout{Key: key, Failures: 1, LastFailure: now.Add(time.Duration(i) * time.Second)}
+	}
+
+	throttle.fail([]string{"ip:new"})
+	if len(throttle.entries) > maxThrottleEntries {
+		t.Fatalf("expected at most %d entries, got %d", maxThrottleEntries, len(throttle.entries))
+	}
+	if _, ok := throttle.entries["ip:new"]; !ok {
+		t.Fatal("expected the new counter to be kept")
+	}
+	if _, ok := throttle.entries["ip:0"]; ok {
+		t.Fatal("expected the oldest counter to be evicted")
+	}
+	if _, ok := throttle.entries[fmt.Sprintf("ip:%d", maxThrottleEntries-1)]; !ok {
+		t.Fatal("expected the latest counter to be kept")
+	}
+}
+
+func TestThrottleIgnoresUnavailable(t *testing.T) {
+	throttle := NewThrottle(1, time.Minute, time.Hour)
+	throttle.Authenticator = failingAuthenticator{err: fmt.Errorf("%w: timeout", ErrUnavailable)}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("alice", "secret")
+
+	for i := 0; i < 3; i++ {
+		if _, err := throttle.Authenticate(r); !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("expected the provider error, got %v", err)
+		}
+	}
+	if stats := throttle.Stats(); stats.FailedAttempts != 0 || stats.Lockouts != 0 {
+		t.Fatalf("expected no failed attempts, got %+v", stats)
+	}
+}
+
+func TestSourceAddressForwardedFor(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set("X-Forwarded-For", "192.0.2.1, 198.51.100.7")
+
+	if address := SourceAddress(r, false); address != "10.0.0.1" {
+		t.Errorf("expected the connection address without forwarding, got %s", address)
+	}
+	if address := SourceAddress(r, true); address != "198.51.100.7" {
+		t.Errorf("expected the last forwarded entry, got %s", address)
+	}
+}
+
+func TestThrottleSharedAddress(t *testing.T) {
+	login := func(throttle *Throttle, username, password string) error {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.0.0.1:4321"
+		r.SetBasicAuth(username, password)
+		_, err := throttle.Authenticate(r)
+		return err
+	}
+
+	// behind a router every client has the same address
+	throttle := NewThrottle(3, time.Minute, time.Hour)
+	throttle.Authenticator = passwordAuthenticator{}
+	for i := 0; i < 5; i++ {
+		_ = login(throttle, fmt.Sprintf("mallory%d", i), "guess")
+	}
+	if err := login(throttle, "alice", "secret"); err != nil {
+		t.Fatalf("expected the address not to be locked out by default, got %v", err)
+	}
+
+	throttle = NewThrottle(3, time.Minute, time.Hour)
+	throttle.Authenticator = passwordAuthenticator{}
+	throttle.Addresses = true
+	for i := 0; i < 5; i++ {
+		_ = login(throttle, fmt.Sprintf("mallory%d", i), "guess")
+	}
+	if err := login(throttle, "alice", "secret"); err != nil {
+		t.Fatalf("expected valid credentials from a locked out address to be accepted, got %v", err)
+	}
+	if err := login(throttle, "bob", "guess"); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("expected invalid credentials from a locked out address to be rejected, got %v", err)
+	}
+
+	// a locked out username is rejected without checking credentials
+	for i := 0; i < 3; i++ {
+		_ = login(throttle, "carol", "guess")
+	}
+	if err := login(throttle, "carol", "secret"); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("expected the locked out username to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// TokenPrefix starts every API token, tokens have the form tfb_<id>_<secret>
+const TokenPrefix = "tfb_"
+
+// tokenIDLength is the length of the hex encoded 8 byte token IDs
+const tokenIDLength = 16
+
+// tokenSecretLength is the length of the hex encoded 32 byte token secrets
+const tokenSecretLength = 64
+
+const (
+	// ScopeRead read-only token scope
+	ScopeRead = "read"
+	// ScopeReadWrite read-write token scope, includes locking
+	ScopeReadWrite = "read-write"
+)
+
+// ScopePermissions returns the permissions of a token scope
+func ScopePermissions(scope string) ([]Permission, error) {
+	switch scope {
+	case ScopeRead:
+		return []Permission{Read}, nil
+	case ScopeReadWrite:
+		return []Permission{Read, Lock, Write}, nil
+	}
+	return nil, fmt.Errorf("invalid token scope: %s", scope)
+}
+
+// NewToken creates a token for identity, the returned secret is the only
+// copy of the full token value
+func NewToken(identity *Identity, description, scope string, refPrefixes []string, ttl time.Duration) (string, *types.Token, error) {
+	if _, err := ScopePermissions(scope); err != nil {
+		return "", nil, err
+	}
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	now := time.Now().UTC()
+	token := &types.Token{
+		ID:          hex.EncodeToString(id),
+		Owner:       identity.Subject,
+		OwnerName:   identity.Name,
+		Description: description,
+		Hash:        hashSecret(hex.EncodeToString(secret)),
+		Scope:       scope,
+		RefPrefixes: refPrefixes,
+		Created:     now,
+		Expires:     now.Add(ttl),
+	}
+	return TokenPrefix + token.ID + "_" + hex.EncodeToString(secret), token, nil
+}
+
+// ValidTokenID determines if id has the format of generated token IDs, so
+// it is safe to use in store paths
+func ValidTokenID(id string) bool {
+	return len(id) == tokenIDLength && isHex(id)
+}
+
+// parseToken splits value into the token ID and secret when it has the
+// full tfb_<id>_<secret> format
+func parseToken(value string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(value, TokenPrefix)
+	if !ok {
+		return "", "", false
+	}
+	id, secret, found := strings.Cut(rest, "_")
+	if !found || !ValidTokenID(id) || len(secret) != tokenSecretLength || !isHex(secret) {
+		return "", "", false
+	}
+	return id, secret, true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Tokens authenticates backend-issued API tokens passed as Bearer token or
+// as the Basic authentication password. Values without the full token
+// format, e.g. passwords that happen to start with tfb_, are left to the
+// next authenticator.
+type Tokens struct {
+	Store store.Tokens
+}
+
+// Authenticate implements Authenticator
+func (t *Tokens) Authenticate(r *http.Request) (*Identity, error) {
+	value, ok := bearerToken(r)
+	if !ok {
+		_, value, ok = r.BasicAuth()
+	}
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	id, secret, ok := parseToken(value)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	token, err := t.Store.GetToken(id)
+	if err != nil {
+		if err == store.ErrNotFound {
+			return nil, fmt.Errorf("invalid token")
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(token.Hash)) != 1 {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if time.Now().After(token.Expires) {
+		return nil, fmt.Errorf("token expired")
+	}
+	permissions, err := ScopePermissions(token.Scope)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Subject:  token.Owner,
+		Name:     token.OwnerName,
+		Provider: "token",
+		Scope: &Scope{
+			Permissions: permissions,
+			RefPrefixes: token.RefPrefixes,
+		},
+	}, nil
+}
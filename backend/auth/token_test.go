@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// memoryTokens keeps tokens in memory
+type memoryTokens map[string]types.Token
+
+func (m memoryTokens) GetToken(id string) (*types.Token, error) {
+	token, ok := m[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return &token, nil
+}
+
+func (m memoryTokens) PutToken(token types.Token) error {
+	m[token.ID] = token
+	return nil
+}
+
+func (m memoryTokens) DeleteToken(id string) error {
+	delete(m, id)
+	return nil
+}
+
+func (m memoryTokens) ListTokens() ([]types.Token, error) {
+	tokens := make([]types.Token, 0, len(m))
+	for _, token := range m {
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func TestTokensFallThrough(t *testing.T) {
+	tokens := memoryTokens{}
+	value, token, err := NewToken(&Identity{Subject: "htpasswd:alice", Name: "alice"}, "ci", ScopeRead, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = tokens.PutToken(*token)
+	chain := Chain{&Tokens{Store: tokens}, passwordAuthenticator{}}
+	login := func(password string) (*Identity, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth("alice", password)
+		return chain.Authenticate(r)
+	}
+
+	identity, err := login(value)
+	if err != nil || identity.Provider != "token" || identity.Subject != "htpasswd:alice" {
+		t.Fatalf("expected the token to authenticate alice, got %+v %v", identity, err)
+	}
+	// a wrong secret in the token format is rejected, not tried as a password
+	wrong := value[:len(value)-1] + "0"
+	if wrong == value {
+		wrong = value[:len(value)-1] + "1"
+	}
+	if _, err := login(wrong); err == nil || !strings.Contains(err.Error(), "invalid token") {
+		t.Fatalf("expected the wrong secret to be rejected, got %v", err)
+	}
+
+	// passwords that merely start with the token prefix are left to the chain
+	chain[1] = staticAuthenticator{&Identity{Subject: "htpasswd:bob", Name: "bob"}}
+	for _, password := range []string{"tfb_", "tfb_hunter2", "tfb_" + token.ID + "_short", "tfb_" + token.ID + "_" + strings.Repeat("X", 64)} {
+		if identity, err := login(password); err != nil || identity.Subject != "htpasswd:bob" {
+			t.Errorf("%s: expected the password to reach the next authenticator, got %+v %v", password, identity, err)
+		}
+	}
+}
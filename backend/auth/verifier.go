@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Verifier verifies tokens signed by an issuer
+type Verifier struct {
+	Issuer   string
+	Audience string
+	KeySet   *KeySet
+}
+
+// Verify checks the token signature, issuer, audience and expiry and
+// returns its claims. The subject claim is required.
+func (v *Verifier) Verify(raw string) (jwt.MapClaims, error) {
+	parser := &jwt.Parser{
+		ValidMethods: []string{"RS256", "RS384", "RS512"},
+	}
+	claims := jwt.MapClaims{}
+	if _, err := parser.ParseWithClaims(raw, claims, v.KeySet.Keyfunc); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+
+	now := time.Now().Unix()
+	if !claims.VerifyExpiresAt(now, true) {
+		return nil, fmt.Errorf("token is expired or has no expiry")
+	}
+	if !claims.VerifyIssuer(v.Issuer, true) {
+		return nil, fmt.Errorf("unexpected token issuer")
+	}
+	if !claims.VerifyAudience(v.Audience, true) {
+		return nil, fmt.Errorf("unexpected token audience")
+	}
+	if sub, ok := claims["sub"].(string); !ok || sub == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	return claims, nil
+}
@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "terraform-backend"
+)
+
+// jwksServer serves the public keys of a JWKS fixture and counts fetches
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetches atomic.Int32
+}
+
+func newJWKSServer(t *testing.T, keys map[string]*rsa.PublicKey) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var jwks struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		for kid, key := range s.keys {
+			jwks.Keys = append(jwks.Keys, jsonWebKey{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(&jwks)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) setKey(kid string, key *rsa.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[kid] = key
+}
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": testIssuer,
+		"aud": testAudience,
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func newTestVerifier(url string) *Verifier {
+	return &Verifier{
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		KeySet:   NewKeySet(url, nil),
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	key := newTestKey(t)
+	server := newJWKSServer(t, map[string]*rsa.PublicKey{"key-1": &key.PublicKey})
+
+	tests := []struct {
+		name    string
+		modify  func(claims jwt.MapClaims)
+		wantErr string
+	}{
+		{name: "valid token"},
+		{
+			name:    "wrong issuer",
+			modify:  func(claims jwt.MapClaims) { claims["iss"] = "https://other.example.com" },
+			wantErr: "issuer",
+		},
+		{
+			name:    "wrong audience",
+			modify:  func(claims jwt.MapClaims) { claims["aud"] = "other" },
+			wantErr: "audience",
+		},
+		{
+			name:    "expired token",
+			modify:  func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Minute).Unix() },
+			wantErr: "expired",
+		},
+		{
+			name:    "missing subject",
+			modify:  func(claims jwt.MapClaims) { delete(claims, "sub") },
+			wantErr: "subject",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+			verified, err := newTestVerifier(server.URL).Verify(signRS256(t, key, "key-1", claims))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if verified["sub"] != "alice" {
+					t.Fatalf("unexpected subject: %v", verified["sub"])
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsAlgorithms(t *testing.T) {
+	key := newTestKey(t)
+	server := newJWKSServer(t, map[string]*rsa.PublicKey{"key-1": &key.PublicKey})
+	verifier := newTestVerifier(server.URL)
+
+	hs256 := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims())
+	hs256.Header["kid"] = "key-1"
+	// an HMAC keyed with the public key must not pass as RSA signature
+	hsRaw, err := hs256.SignedString(key.PublicKey.N.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(hsRaw); err == nil {
+		t.Fatal("expected HS256 token to be rejected")
+	}
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims())
+	none.Header["kid"] = "key-1"
+	noneRaw, err := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(noneRaw); err == nil {
+		t.Fatal("expected alg=none token to be rejected")
+	}
+}
+
+func TestVerifyUnknownKeyRefetch(t *testing.T) {
+	oldKey := newTestKey(t)
+	newKey := newTestKey(t)
+	server := newJWKSServer(t, map[string]*rsa.PublicKey{"key-1": &oldKey.PublicKey})
+	verifier := newTestVerifier(server.URL)
+
+	if _, err := verifier.Verify(signRS256(t, oldKey, "key-1", validClaims())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fetches := server.fetches.Load(); fetches != 1 {
+		t.Fatalf("expected 1 fetch, got %d", fetches)
+	}
+
+	// the issuer rotates its keys
+	server.setKey("key-2", &newKey.PublicKey)
+	rotated := signRS256(t, newKey, "key-2", validClaims())
+
+	// unknown kids do not refetch within the refresh interval
+	if _, err := verifier.Verify(rotated); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("expected unknown signing key error, got %v", err)
+	}
+	if fetches := server.fetches.Load(); fetches != 1 {
+		t.Fatalf("expected no refetch within the refresh interval, got %d fetches", fetches)
+	}
+
+	// after the interval the unknown kid triggers a refetch
+	verifier.KeySet.mu.Lock()
+	verifier.KeySet.fetched = time.Now().Add(-minRefreshInterval)
+	verifier.KeySet.mu.Unlock()
+	if _, err := verifier.Verify(rotated); err != nil {
+		t.Fatalf("unexpected error after refetch: %v", err)
+	}
+	if fetches := server.fetches.Load(); fetches != 2 {
+		t.Fatalf("expected 2 fetches, got %d", fetches)
+	}
+
+	// a kid the issuer never published stays unknown
+	unknownKey := newTestKey(t)
+	verifier.KeySet.mu.Lock()
+	verifier.KeySet.fetched = time.Now().Add(-minRefreshInterval)
+	verifier.KeySet.mu.Unlock()
+	if _, err := verifier.Verify(signRS256(t, unknownKey, "key-3", validClaims())); err == nil {
+		t.Fatal("expected token signed with an unpublished key to be rejected")
+	}
+}
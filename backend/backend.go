@@ -5,21 +5,87 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	gocrypto "github.com/bhoriuchi/go-crypto"
+	"github.com/loafoe/terraform-backend-hsdp/backend/audit"
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/metrics"
+	"github.com/loafoe/terraform-backend-hsdp/backend/seal"
 	"github.com/loafoe/terraform-backend-hsdp/backend/store"
 	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+	"github.com/loafoe/terraform-backend-hsdp/backend/webhook"
 )
 
 // Options backend options
 type Options struct {
-	EncryptionKey   interface{}
-	Logger          func(level, message string, err error)
-	GetRefFunc      interface{}
-	GetEncryptFunc  interface{}
+	EncryptionKey interface{}
+	// Logger receives structured logs, credentials and state content are
+	// redacted. Logs are discarded when it is nil.
+	Logger *slog.Logger
+	// Authenticator authenticates requests, RefResolver resolves the state
+	// ref of the identity. Without an Authenticator the ref query parameter
+	// is used as is.
+	Authenticator   auth.Authenticator
+	RefResolver     auth.RefResolver
+	GetEncryptFunc  func(r *http.Request, ref string) bool
 	GetMetadataFunc func(state map[string]interface{}) map[string]interface{}
+	// ReadOnlyOnKeyMismatch serves reads only instead of failing Init
+	// when the encryption key does not match the canary in the store
+	ReadOnlyOnKeyMismatch bool
+	// EncryptLocks encrypts lock documents, keeping only the lock
+	// ID, Operation, Created and Version in plaintext
+	EncryptLocks bool
+	// EncryptMetadata encrypts state metadata, keeping only the
+	// MetadataIndexFields in plaintext
+	EncryptMetadata     bool
+	MetadataIndexFields []string
+	// ProtectSensitive additionally encrypts the values Terraform marks
+	// as sensitive so exports can be served with them redacted
+	ProtectSensitive bool
+	// Groups resolves the groups of identities for group grants, defaults
+	// to their claims
+	Groups auth.GroupSource
+	// RedirectGracePeriod is how long the old ref of a transferred state
+	// keeps working
+	RedirectGracePeriod time.Duration
+	// Policy assigns roles on refs, nil allows identities everything in
+	// their own and team namespaces
+	Policy *auth.Policy
+	// Throttle counts failed authentications, it wraps the Authenticator
+	Throttle *auth.Throttle
+	// ForwardedFor takes the source address of audit events from the last
+	// X-Forwarded-For entry
+	ForwardedFor bool
+	// Webhooks are notified of state changes
+	Webhooks *webhook.Dispatcher
+	// Audit records every handler action in the hash chained audit log of
+	// the store, appended in the background
+	Audit bool
+	// AuditSinks receive every audit event in the background, up to
+	// AuditBufferSize events per sink and for the audit log are buffered
+	AuditSinks      []audit.Sink
+	AuditBufferSize int
+	// Admins are the subjects administering the backend
+	Admins []string
+	// Middleware wraps the routes of Handler after the built-in
+	// request ID, recovery, logging and authentication middleware
+	Middleware []Middleware
+	// Metrics records request, lock and encryption metrics when set
+	Metrics *metrics.Metrics
+	// MaxTokenTTL limits the lifetime of API tokens
+	MaxTokenTTL time.Duration
+	// Sealer starts the backend sealed until its key is reconstructed
+	// from key shares, use Sealer.Key as the EncryptionKey
+	Sealer *seal.Sealer
+	// ReadinessChecks are reported by /readyz next to the store and
+	// canary checks, an error marks the instance not ready
+	ReadinessChecks map[string]func() error
 }
 
 // NewBackend creates a new backend
@@ -27,6 +93,7 @@ func NewBackend(store store.Store, opts ...*Options) *Backend {
 	backend := Backend{
 		initialized: false,
 		store:       store,
+		events:      newEventBus(),
 	}
 
 	if len(opts) > 0 {
@@ -36,7 +103,31 @@ func NewBackend(store store.Store, opts ...*Options) *Backend {
 		backend.options = &Options{}
 	}
 	if backend.options.Logger == nil {
-		backend.options.Logger = func(level, message string, err error) {}
+		backend.options.Logger = slog.New(slog.DiscardHandler)
+	}
+	backend.options.Logger = slog.New(NewRedactHandler(backend.options.Logger.Handler()))
+	if backend.options.AuditBufferSize == 0 {
+		backend.options.AuditBufferSize = 1000
+	}
+	if backend.options.Audit {
+		backend.audit = newAuditLog(store, backend.options.AuditBufferSize, backend.options.Logger)
+		if backend.audit == nil {
+			backend.options.Logger.Error("the store does not support an audit log")
+		}
+	}
+	for _, sink := range backend.options.AuditSinks {
+		backend.auditSinks = append(backend.auditSinks, audit.NewBuffered(sink, backend.options.AuditBufferSize, func(err error) {
+			backend.options.Logger.Error("audit sink failed", "error", err)
+		}))
+	}
+	if backend.options.RefResolver == nil {
+		backend.options.RefResolver = auth.NamespaceRef
+	}
+	if backend.options.RedirectGracePeriod == 0 {
+		backend.options.RedirectGracePeriod = 30 * 24 * time.Hour
+	}
+	if backend.options.MaxTokenTTL == 0 {
+		backend.options.MaxTokenTTL = 90 * 24 * time.Hour
 	}
 	if backend.options.GetMetadataFunc == nil {
 		backend.options.GetMetadataFunc = func(state map[string]interface{}) map[string]interface{} {
@@ -49,16 +140,49 @@ func NewBackend(store store.Store, opts ...*Options) *Backend {
 
 // Backend a terraform http backend
 type Backend struct {
+	mu          sync.Mutex
 	initialized bool
+	readOnly    bool
+	// keyMismatch the canary rejected the key, it is not verified again
+	keyMismatch bool
 	store       store.Store
 	options     *Options
+	audit       *auditLog
+	auditSinks  []*audit.Buffered
+	events      *eventBus
+	lockWaits   lockWaits
 }
 
-// Init initializes the backend
+// Init initializes the backend and verifies the encryption key canary
 func (c *Backend) Init() error {
-	if !c.initialized {
-		return c.store.Init()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.initialized {
+		return nil
 	}
+	if c.keyMismatch {
+		return ErrKeyMismatch
+	}
+	if err := c.store.Init(); err != nil {
+		return err
+	}
+	if c.options.Sealer != nil && c.options.Sealer.Sealed() {
+		// the canary is verified once the backend is unsealed
+		return nil
+	}
+	if err := c.verifyCanary(c.getEncryptionKey()); err != nil {
+		if err != ErrKeyMismatch {
+			return err
+		}
+		if !c.options.ReadOnlyOnKeyMismatch {
+			c.keyMismatch = true
+			return err
+		}
+		c.options.Logger.Error("encryption key does not match canary, serving read-only", "error", err)
+		c.readOnly = true
+	}
+	c.initialized = true
 	return nil
 }
 
@@ -73,49 +197,171 @@ func (c *Backend) getEncryptionKey() []byte {
 	return nil
 }
 
-// gets the state ref
-func (c *Backend) getRef(r *http.Request) (string, error) {
-	switch refFunc := c.options.GetRefFunc; refFunc.(type) {
-	case func(r *http.Request) (string, error):
-		return refFunc.(func(r *http.Request) (string, error))(r)
+// gets the state ref the request may access with permission
+func (c *Backend) getRef(r *http.Request, permission auth.Permission) (string, error) {
+	_, ref, err := c.authorize(r, permission)
+	return ref, err
+}
+
+// authenticates the request and resolves the state ref the identity may
+// access with permission
+func (c *Backend) authorize(r *http.Request, permission auth.Permission) (*auth.Identity, string, error) {
+	if c.options.Authenticator == nil {
+		return nil, r.URL.Query().Get("ref"), nil
+	}
+	identity, err := c.authenticate(r)
+	if err != nil {
+		return nil, "", err
+	}
+	path := requestPath(r)
+	if err := validateStatePath(path); err != nil {
+		return nil, "", err
+	}
+	if !identity.Scope.Allows(permission, path) {
+		return nil, "", fmt.Errorf("%w: %s access to %s is outside the scope of %s", auth.ErrForbidden, permission, path, identity.Name)
+	}
+	namespace := identity
+	// access the namespace of another owner through a grant
+	if owner := r.URL.Query().Get("owner"); owner != "" && owner != identity.Subject {
+		if err := auth.ValidateOwner(owner); err != nil {
+			return nil, "", err
+		}
+		granted, err := c.granted(identity, owner, path, permission)
+		if err != nil {
+			return nil, "", err
+		}
+		if !granted {
+			return nil, "", fmt.Errorf("%w: %s access to %s of %s is not granted to %s", auth.ErrForbidden, permission, path, owner, identity.Name)
+		}
+		namespace = &auth.Identity{Subject: owner}
+	}
+	ref, err := c.options.RefResolver(namespace, path)
+	if err != nil {
+		return nil, "", err
+	}
+	// the owner decided about access through a grant, within its roles
+	if namespace == identity {
+		if err := c.allowed(identity, permission, ref); err != nil {
+			return nil, "", err
+		}
+	}
+	target, err := c.followRedirect(ref)
+	if err != nil {
+		return nil, "", err
+	}
+	// access to a moved state is decided at its target, access to the old
+	// ref does not carry over
+	if target != ref && !c.canAccess(identity, permission, target) {
+		return nil, "", fmt.Errorf("%w: %s access to %s moved to %s is not allowed for %s", auth.ErrForbidden, permission, ref, target, identity.Name)
+	}
+	getRequestInfo(r).setRef(target)
+	return identity, target, nil
+}
+
+// determines if identity has permission on ref through its namespace, a
+// team or a grant
+func (c *Backend) canAccess(identity *auth.Identity, permission auth.Permission, ref string) bool {
+	path := auth.StatePath(ref)
+	if !identity.Scope.Allows(permission, path) {
+		return false
+	}
+	if resolved, err := c.options.RefResolver(identity, path); err == nil && resolved == ref {
+		return c.allowed(identity, permission, ref) == nil
+	}
+	if strings.HasPrefix(ref, auth.TeamsPrefix+"/") {
+		return false
 	}
-	return r.URL.Query().Get("ref"), nil
+	owner, _, _ := strings.Cut(ref, "/")
+	granted, err := c.granted(identity, owner, path, permission)
+	return err == nil && granted
 }
 
-// gets the encrypt state setting
-func (c *Backend) getEncrypt(r *http.Request) bool {
-	switch encFunc := c.options.GetRefFunc; encFunc.(type) {
-	case func(r *http.Request) bool:
-		return encFunc.(func(r *http.Request) bool)(r)
+// checks the roles of the identity on ref include permission
+func (c *Backend) allowed(identity *auth.Identity, permission auth.Permission, ref string) error {
+	allowed, err := c.options.Policy.Allows(identity, permission, ref)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s has no role with %s access to %s", auth.ErrForbidden, identity.Name, permission, ref)
 	}
-	// Encrypt by default
-	return true
+	return nil
 }
 
-// decrypts the encrypted state
-func (c *Backend) decryptState(encryptedState interface{}) (map[string]interface{}, error) {
+// gets the requested state path, the ref of the API route or the ref query
+// parameter take precedence over the URL path of the terraform protocol.
+// The path is relative to the namespace, empty for its root.
+func requestPath(r *http.Request) string {
+	if ref := r.PathValue("ref"); ref != "" {
+		return ref
+	}
+	if ref := r.URL.Query().Get("ref"); ref != "" {
+		return ref
+	}
+	if isAPIRequest(r) {
+		return ""
+	}
+	switch r.URL.Path {
+	case "/versions", "/states", "/export", "/transfer":
+		return ""
+	}
+	return strings.TrimPrefix(r.URL.Path, "/")
+}
+
+// determines if the request is served by the versioned REST API
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+}
+
+// encrypts a value to a base64 string
+func (c *Backend) encrypt(value interface{}) (string, error) {
 	key := c.getEncryptionKey()
 	if len(key) == 0 {
-		return nil, fmt.Errorf("failed to get backend encryption key")
+		return "", fmt.Errorf("failed to get backend encryption key")
 	}
 
-	s := types.EncryptedState{}
-	if err := toInterface(encryptedState, &s); err != nil {
-		return nil, err
+	j, err := json.Marshal(value)
+	if err != nil {
+		return "", err
 	}
 
-	data, err := base64.StdEncoding.DecodeString(s.EncryptedData)
+	encryptedData, err := gocrypto.Encrypt(key, j)
 	if err != nil {
-		return nil, err
+		c.options.Metrics.CryptoFailure("encrypt")
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(encryptedData), nil
+}
+
+// decrypts a base64 string into value
+func (c *Backend) decrypt(encryptedData string, value interface{}) error {
+	key := c.getEncryptionKey()
+	if len(key) == 0 {
+		return fmt.Errorf("failed to get backend encryption key")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encryptedData)
+	if err != nil {
+		return err
 	}
 
 	decryptedData, err := gocrypto.Decrypt(key, data)
 	if err != nil {
+		c.options.Metrics.CryptoFailure("decrypt")
+		return err
+	}
+	return json.Unmarshal(decryptedData, value)
+}
+
+// decrypts the encrypted state
+func (c *Backend) decryptState(encryptedState interface{}) (map[string]interface{}, error) {
+	s := types.EncryptedState{}
+	if err := toInterface(encryptedState, &s); err != nil {
 		return nil, err
 	}
 
 	var state map[string]interface{}
-	if err := json.Unmarshal(decryptedData, &state); err != nil {
+	if err := c.decrypt(s.EncryptedData, &state); err != nil {
 		return nil, err
 	}
 
@@ -124,47 +370,59 @@ func (c *Backend) decryptState(encryptedState interface{}) (map[string]interface
 
 // encrypts the state
 func (c *Backend) encryptState(state interface{}) (map[string]interface{}, error) {
-	key := c.getEncryptionKey()
-	if len(key) == 0 {
-		return nil, fmt.Errorf("failed to get backend encryption key")
+	encryptedData, err := c.encrypt(state)
+	if err != nil {
+		return nil, err
 	}
 
-	j, err := json.Marshal(state)
-	if err != nil {
+	var encryptedState map[string]interface{}
+	s := types.EncryptedState{
+		EncryptedData: encryptedData,
+	}
+
+	if err := toInterface(s, &encryptedState); err != nil {
 		return nil, err
 	}
 
-	encryptedData, err := gocrypto.Encrypt(key, j)
+	return encryptedState, nil
+}
+
+// encrypts the metadata, keeping the index fields in plaintext
+func (c *Backend) encryptMetadata(metadata map[string]interface{}) (map[string]interface{}, error) {
+	encryptedData, err := c.encrypt(metadata)
 	if err != nil {
 		return nil, err
 	}
 
-	var encryptedState map[string]interface{}
-	s := types.EncryptedState{
-		EncryptedData: base64.StdEncoding.EncodeToString(encryptedData),
+	m := types.EncryptedMetadata{
+		Index:         map[string]interface{}{},
+		EncryptedData: encryptedData,
+	}
+	for _, field := range c.options.MetadataIndexFields {
+		if value, ok := metadata[field]; ok {
+			m.Index[field] = value
+		}
 	}
 
-	if err := toInterface(s, &encryptedState); err != nil {
+	var encryptedMetadata map[string]interface{}
+	if err := toInterface(m, &encryptedMetadata); err != nil {
 		return nil, err
 	}
 
-	return encryptedState, nil
+	return encryptedMetadata, nil
 }
 
 // determines if the state can be locked
-func (c *Backend) canLock(w http.ResponseWriter, _ *http.Request, ref, id string) bool {
-	lock, err := c.store.GetLock(ref)
+func (c *Backend) canLock(w http.ResponseWriter, r *http.Request, ref, id string) bool {
+	getRequestInfo(r).setLockID(id)
+	lock, err := c.getLock(ref)
 	if err != nil {
 		if err == store.ErrNotFound {
 			return true
 		}
 
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get lock from state store for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to get lock from state store", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to get the lock")
 		return false
 	}
 
@@ -172,46 +430,35 @@ func (c *Backend) canLock(w http.ResponseWriter, _ *http.Request, ref, id string
 		return true
 	}
 
-	c.options.Logger(
-		"debug",
-		fmt.Sprintf("terraform state locked by another process for ref: %s", ref),
-		nil,
-	)
+	c.logger(r).Debug("terraform state locked by another process", "ref", ref)
+	c.options.Metrics.LockConflict(r.Method)
+	if r.Method == "LOCK" && c.options.Metrics != nil {
+		c.lockWaits.conflict(ref, id)
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusLocked)
-	_ = json.NewEncoder(w).Encode(lock)
+	writeLockConflict(w, r, ref, lock)
 	return false
 }
 
 // HandleGetState gets the state requested
 func (c *Backend) HandleGetState(w http.ResponseWriter, r *http.Request) {
-	ref, err := c.getRef(r)
+	if c.isSealed(w, r) {
+		return
+	}
+	identity, ref, err := c.authorize(r, auth.Read)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get ref: %v", err),
-			err,
-		)
-		w.WriteHeader(http.StatusUnauthorized)
+		c.logger(r).Error("failed to get ref", "error", err)
+		writeAuthError(w, r, err)
 		return
 	}
 
 	if err := c.Init(); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to initialize terraform state backend for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
 		return
 	}
 
-	c.options.Logger(
-		"debug",
-		fmt.Sprintf("getting terraform state for ref: %s", ref),
-		nil,
-	)
+	c.logger(r).Debug("getting terraform state", "ref", ref)
 	// get the state
 	state, encrypted, err := c.store.GetState(ref)
 	if err != nil {
@@ -220,12 +467,8 @@ func (c *Backend) HandleGetState(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get terraform state for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to get terraform state", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to get the state")
 		return
 	}
 
@@ -233,17 +476,21 @@ func (c *Backend) HandleGetState(w http.ResponseWriter, r *http.Request) {
 	if encrypted {
 		decryptedState, err := c.decryptState(state)
 		if err != nil {
-			c.options.Logger(
-				"error",
-				fmt.Sprintf("failed decrypt terraform state for ref: %s", ref),
-				err,
-			)
-			w.WriteHeader(http.StatusInternalServerError)
+			c.logger(r).Error("failed decrypt terraform state", "ref", ref, "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeDecryptionFailed, ref, "failed to decrypt the state")
 			return
 		}
 		state = decryptedState
 	}
 
+	// restore separately encrypted sensitive values, API readers without
+	// lock access get them redacted
+	if err := c.revealSensitive(r, identity, ref, state); err != nil {
+		c.logger(r).Error("failed decrypt sensitive values", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeDecryptionFailed, ref, "failed to decrypt sensitive values")
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(state)
@@ -251,42 +498,33 @@ func (c *Backend) HandleGetState(w http.ResponseWriter, r *http.Request) {
 
 // HandleLockState locks the state
 func (c *Backend) HandleLockState(w http.ResponseWriter, r *http.Request) {
-	ref, err := c.getRef(r)
+	if c.isSealed(w, r) {
+		return
+	}
+	ref, err := c.getRef(r, auth.Lock)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get ref: %v", err),
-			err,
-		)
-		w.WriteHeader(http.StatusUnauthorized)
+		c.logger(r).Error("failed to get ref", "error", err)
+		writeAuthError(w, r, err)
 		return
 	}
 
 	if err := c.Init(); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to initialize terraform state backend for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
+		return
+	}
+
+	if !c.canWrite(w, r, ref) {
 		return
 	}
 
-	c.options.Logger(
-		"debug",
-		fmt.Sprintf("locking terraform state for ref %s", ref),
-		nil,
-	)
+	c.logger(r).Debug("locking terraform state", "ref", ref)
 
 	// decode body
 	var lock types.Lock
 	if err := json.NewDecoder(r.Body).Decode(&lock); err != nil {
-		c.options.Logger(
-			"debug",
-			fmt.Sprintf("error decoding LOCK request body for ref %s", ref),
-			nil,
-		)
-		w.WriteHeader(http.StatusBadRequest)
+		c.logger(r).Debug("error decoding LOCK request body", "ref", ref)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, ref, "invalid lock request body")
 		return
 	}
 
@@ -296,60 +534,72 @@ func (c *Backend) HandleLockState(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// attempt to put the lock
-	if err := c.store.PutLock(ref, lock); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to set lock for ref %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := c.putLock(ref, lock); err != nil {
+		c.logger(r).Error("failed to set lock", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to store the lock")
 		return
 	}
+	if wait, ok := c.lockWaits.acquired(ref, lock.ID); ok {
+		c.options.Metrics.LockAcquired(wait)
+	}
+	c.publish(r, types.Event{
+		Type: types.EventLockAcquired,
+		Ref:  ref,
+		Lock: &lock,
+	})
+	c.watchLock(r, ref, lock)
 
 	w.WriteHeader(http.StatusOK)
 }
 
 // HandleUnlockState unlocks the state
 func (c *Backend) HandleUnlockState(w http.ResponseWriter, r *http.Request) {
-	ref, err := c.getRef(r)
+	if c.isSealed(w, r) {
+		return
+	}
+	identity, ref, err := c.authorize(r, auth.Lock)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get ref: %v", err),
-			err,
-		)
-		w.WriteHeader(http.StatusUnauthorized)
+		c.logger(r).Error("failed to get ref", "error", err)
+		writeAuthError(w, r, err)
 		return
 	}
 
 	if err := c.Init(); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to initialize terraform state backend for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
+		return
+	}
+
+	if !c.canWrite(w, r, ref) {
 		return
 	}
 
-	c.options.Logger(
-		"debug",
-		fmt.Sprintf("unlocking terraform state for ref %s", ref),
-		nil,
-	)
+	c.logger(r).Debug("unlocking terraform state", "ref", ref)
 
 	// decode body
 	var lock types.Lock
 	if err := json.NewDecoder(r.Body).Decode(&lock); err != nil && err != io.EOF {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("error decoding UNLOCK request body for ref %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusBadRequest)
+		c.logger(r).Error("error decoding UNLOCK request body", "ref", ref, "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, ref, "invalid unlock request body")
 		return
 	}
 
+	// terraform force-unlock sends no lock, administrators of the state may
+	// release the lock of another process
+	forced := false
+	if lock.ID == "" && c.canForceUnlock(identity, ref) {
+		held, err := c.getLock(ref)
+		if err != nil && err != store.ErrNotFound {
+			c.logger(r).Error("failed to get lock from state store", "ref", ref, "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to get the lock")
+			return
+		}
+		if held != nil {
+			lock = *held
+			forced = true
+		}
+	}
+
 	// check if state can be locked
 	if !c.canLock(w, r, ref, lock.ID) {
 		return
@@ -357,15 +607,26 @@ func (c *Backend) HandleUnlockState(w http.ResponseWriter, r *http.Request) {
 
 	// attempt to delete the lock
 	if err := c.store.DeleteLock(ref); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to delete lock for ref %s", ref),
-			err,
-		)
-
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to delete lock", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to delete the lock")
 		return
 	}
+	if created, err := time.Parse(time.RFC3339Nano, lock.Created); err == nil {
+		c.options.Metrics.LockReleased(time.Since(created))
+	}
+	c.publish(r, types.Event{
+		Type: types.EventLockReleased,
+		Ref:  ref,
+		Lock: &lock,
+	})
+	if forced {
+		c.logger(r).Info("force unlocked terraform state", "ref", ref, "lock_id", lock.ID)
+		c.publish(r, types.Event{
+			Type: types.EventForceUnlocked,
+			Ref:  ref,
+			Lock: &lock,
+		})
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -376,44 +637,35 @@ func (c *Backend) getVersion(now time.Time) string {
 
 // HandleUpdateState updates the state
 func (c *Backend) HandleUpdateState(w http.ResponseWriter, r *http.Request) {
-	ref, err := c.getRef(r)
+	if c.isSealed(w, r) {
+		return
+	}
+	ref, err := c.getRef(r, auth.Write)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get ref: %v", err),
-			err,
-		)
-		w.WriteHeader(http.StatusUnauthorized)
+		c.logger(r).Error("failed to get ref", "error", err)
+		writeAuthError(w, r, err)
 		return
 	}
-	encrypt := c.getEncrypt(r)
+	encrypt := c.getEncrypt(r, ref)
 	id := r.URL.Query().Get("ID")
 
 	if err := c.Init(); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to initialize terraform state backend for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
+		return
+	}
+
+	if !c.canWrite(w, r, ref) {
 		return
 	}
 
-	c.options.Logger(
-		"debug",
-		fmt.Sprintf("setting terraform state for ref %s", ref),
-		nil,
-	)
+	c.logger(r).Debug("setting terraform state", "ref", ref)
 
 	// decode body
 	var state map[string]interface{}
 	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("error decoding request body for ref %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusBadRequest)
+		c.logger(r).Error("error decoding request body", "ref", ref, "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, ref, "invalid state in request body")
 		return
 	}
 
@@ -421,260 +673,286 @@ func (c *Backend) HandleUpdateState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// summarize before sensitive values are protected
+	changes := c.summarizeChanges(r, types.EventStateUpdated, ref, state)
+	serial := webhook.Serial(state)
+
+	version, ok := c.writeState(w, r, ref, state, encrypt)
+	if !ok {
+		return
+	}
+	c.publish(r, types.Event{
+		Type:    types.EventStateUpdated,
+		Ref:     ref,
+		Serial:  serial,
+		Version: version,
+		Changes: changes,
+	})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeState stores state as the current state of ref and as a new version,
+// encrypted when encrypt is set or the current state is encrypted, so an
+// encrypted state is never downgraded to plaintext. It responds to failures
+// and returns the version written, empty when only the state was written.
+func (c *Backend) writeState(w http.ResponseWriter, r *http.Request, ref string, state map[string]interface{}, encrypt bool) (string, bool) {
+	if !encrypt {
+		encrypted, err := c.isEncrypted(ref)
+		if err != nil {
+			c.logger(r).Error("failed to get terraform state", "ref", ref, "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to get the state")
+			return "", false
+		}
+		if encrypted {
+			c.logger(r).Warn("keeping terraform state encrypted", "ref", ref)
+			encrypt = true
+		}
+	}
+
 	// get metadata using a metadata processor
 	metadata := c.options.GetMetadataFunc(state)
+	if c.options.EncryptMetadata && len(metadata) > 0 {
+		encryptedMetadata, err := c.encryptMetadata(metadata)
+		if err != nil {
+			c.logger(r).Error("failed encrypt terraform state metadata", "ref", ref, "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeEncryptionFailed, ref, "failed to encrypt the state metadata")
+			return "", false
+		}
+		metadata = encryptedMetadata
+	}
+
+	// separately encrypt sensitive values if specified
+	if c.options.ProtectSensitive {
+		if err := c.protectSensitive(state); err != nil {
+			c.logger(r).Error("failed encrypt sensitive values", "ref", ref, "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeEncryptionFailed, ref, "failed to encrypt sensitive values")
+			return "", false
+		}
+	}
 
 	// encrypt if specified
 	if encrypt {
 		encryptedState, err := c.encryptState(state)
 		if err != nil {
-			c.options.Logger(
-				"error",
-				fmt.Sprintf("failed encrypt terraform state for ref: %s", ref),
-				err,
-			)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			c.logger(r).Error("failed encrypt terraform state", "ref", ref, "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeEncryptionFailed, ref, "failed to encrypt the state")
+			return "", false
 		}
 		state = encryptedState
 	}
 
 	// set the state on the backend
 	if err := c.store.PutState(ref, state, metadata, encrypt); err != nil {
-		c.options.Logger(
-			"debug",
-			fmt.Sprintf("error updating terraform state for ref %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		c.logger(r).Debug("error updating terraform state", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to store the state")
+		return "", false
 	}
 	// write a version
-	_ = c.store.PutState(ref, state, metadata, encrypt, c.getVersion(time.Now()))
-
-	w.WriteHeader(http.StatusOK)
+	version := c.getVersion(time.Now())
+	if err := c.store.PutState(ref, state, metadata, encrypt, version); err == nil {
+		getRequestInfo(r).setVersion(version)
+	} else {
+		version = ""
+	}
+	return version, true
 }
 
 // HandleDeleteState deletes the state
 func (c *Backend) HandleDeleteState(w http.ResponseWriter, r *http.Request) {
-	ref, err := c.getRef(r)
+	if c.isSealed(w, r) {
+		return
+	}
+	ref, err := c.getRef(r, auth.Write)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get ref: %v", err),
-			err,
-		)
-		w.WriteHeader(http.StatusUnauthorized)
+		c.logger(r).Error("failed to get ref", "error", err)
+		writeAuthError(w, r, err)
 		return
 	}
 	id := r.URL.Query().Get("ID")
 
 	if err := c.Init(); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to initialize terraform state backend for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
+		return
+	}
+
+	if !c.canWrite(w, r, ref) {
 		return
 	}
 
-	c.options.Logger(
-		"debug",
-		fmt.Sprintf("deleting terraform state for ref %s", ref),
-		nil,
-	)
+	c.logger(r).Debug("deleting terraform state", "ref", ref)
 
 	if !c.canLock(w, r, ref, id) {
 		return
 	}
 
 	if err := c.store.DeleteState(ref); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("error deleting terraform state for ref %s", ref),
-			err,
-		)
+		c.logger(r).Error("error deleting terraform state", "ref", ref, "error", err)
 		if err == store.ErrNotFound {
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, r, http.StatusNotFound, ErrCodeNotFound, ref, "state not found")
 			return
 		}
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to delete the state")
 		return
 	}
+	c.publish(r, types.Event{
+		Type: types.EventStateDeleted,
+		Ref:  ref,
+	})
 
 	w.WriteHeader(http.StatusOK)
 }
 
-// HandleKeepVersions
+// HandleKeepVersions removes all but the last versions given by the keep
+// query parameter
 func (c *Backend) HandleKeepVersions(w http.ResponseWriter, r *http.Request) {
-	ref, err := c.getRef(r)
+	if c.isSealed(w, r) {
+		return
+	}
+	ref, err := c.getRef(r, auth.Admin)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get ref in HandleKeepVersions: %v", err),
-			err,
-		)
-		w.WriteHeader(http.StatusUnauthorized)
+		c.logger(r).Error("failed to get ref in HandleKeepVersions", "error", err)
+		writeAuthError(w, r, err)
+		return
+	}
+	last, err := strconv.Atoi(r.URL.Query().Get("keep"))
+	if err != nil || last < 1 {
+		c.logger(r).Error("expecting a positive keep query parameter", "ref", ref, "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, ref, "expecting a positive keep query parameter")
 		return
 	}
 
 	if err := c.Init(); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to initialize terraform state backend for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
+		return
+	}
+
+	if !c.canWrite(w, r, ref) {
 		return
 	}
+
+	if err := c.store.Keep(ref, last); err != nil {
+		c.logger(r).Error("failed to keep versions", "ref", ref, "keep", last, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to remove versions")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // HandleListStates
 func (c *Backend) HandleListStates(w http.ResponseWriter, r *http.Request) {
-	ref, err := c.getRef(r)
+	if c.isSealed(w, r) {
+		return
+	}
+	if owner := r.URL.Query().Get("owner"); owner != "" {
+		c.handleListGrantedStates(w, r, owner)
+		return
+	}
+	ref, err := c.getRef(r, auth.Read)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get ref in HandleListStates: %v", err),
-			err,
-		)
-		w.WriteHeader(http.StatusUnauthorized)
+		c.logger(r).Error("failed to get ref in HandleListStates", "error", err)
+		writeAuthError(w, r, err)
 		return
 	}
 
 	if err := c.Init(); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to initialize terraform state backend for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
 		return
 	}
-	states, err := c.store.GetStates(ref)
+	refs, err := c.store.GetStates(ref)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to retrieve list of states for ref [%s]: %v", ref, err),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to retrieve list of states", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to list states")
+		return
+	}
+	states := make([]string, 0, len(refs))
+	for _, stateRef := range refs {
+		states = append(states, auth.StatePath(stateRef))
 	}
 	data, err := json.Marshal(states)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to marshal states(%d) for ref %s: %v", len(states), ref, err),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to marshal states", "ref", ref, "count", len(states), "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, ref, "failed to encode the response")
+		return
 	}
 	_, _ = w.Write(data)
 }
 
 // HandleListVersions
 func (c *Backend) HandleListVersions(w http.ResponseWriter, r *http.Request) {
-	ref, err := c.getRef(r)
+	if c.isSealed(w, r) {
+		return
+	}
+	ref, err := c.getRef(r, auth.Read)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get ref in HandleListVersions: %v", err),
-			err,
-		)
-		w.WriteHeader(http.StatusUnauthorized)
+		c.logger(r).Error("failed to get ref in HandleListVersions", "error", err)
+		writeAuthError(w, r, err)
 		return
 	}
 	// Check if ref came in properly
-	if r.URL.Query().Get("ref") == "" {
-		c.options.Logger(
-			"error",
-			"expecting ref as query parameter",
-			err,
-		)
-		w.WriteHeader(http.StatusBadRequest)
+	if r.URL.Query().Get("ref") == "" && r.PathValue("ref") == "" {
+		c.logger(r).Error("expecting ref as query parameter", "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, ref, "expecting a ref")
 		return
 	}
 
 	if err := c.Init(); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to initialize terraform state backend for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
 		return
 	}
 	versions, err := c.store.List(ref)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to retrieve list of versions for ref [%s]: %v", ref, err),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to retrieve list of versions", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to list versions")
+		return
 	}
 	data, err := json.Marshal(versions)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to marshal list(%d) for ref %s: %v", len(versions), ref, err),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to marshal versions", "ref", ref, "count", len(versions), "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, ref, "failed to encode the response")
+		return
 	}
 	_, _ = w.Write(data)
 }
 
 // HandleRetrieveVersion
 func (c *Backend) HandleRetrieveVersion(w http.ResponseWriter, r *http.Request) {
-	ref, err := c.getRef(r)
+	if c.isSealed(w, r) {
+		return
+	}
+	identity, ref, err := c.authorize(r, auth.Read)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get ref in HandleRestoreVersion: %v", err),
-			err,
-		)
-		w.WriteHeader(http.StatusUnauthorized)
+		c.logger(r).Error("failed to get ref in HandleRestoreVersion", "error", err)
+		writeAuthError(w, r, err)
 		return
 	}
 
 	if err := c.Init(); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to initialize terraform state backend for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
 		return
 	}
-	var versionRequest struct {
-		Version string `json:"version"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&versionRequest); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to read version in body for ref [%s]: %v", ref, err),
-			err,
-		)
-		w.WriteHeader(http.StatusBadRequest)
+	version, err := requestVersion(r)
+	if err != nil {
+		c.logger(r).Error("failed to read version in body", "ref", ref, "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, ref, "expecting a version")
 		return
 	}
 
 	// get the state
-	state, encrypted, err := c.store.GetState(ref, versionRequest.Version)
+	state, encrypted, err := c.store.GetState(ref, version)
 	if err != nil {
 		if err == store.ErrNotFound {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get terraform state for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to get terraform state", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to get the state")
 		return
 	}
 
@@ -682,44 +960,159 @@ func (c *Backend) HandleRetrieveVersion(w http.ResponseWriter, r *http.Request)
 	if encrypted {
 		decryptedState, err := c.decryptState(state)
 		if err != nil {
-			c.options.Logger(
-				"error",
-				fmt.Sprintf("failed decrypt terraform state for ref [%s]: %v", ref, err),
-				err,
-			)
-			w.WriteHeader(http.StatusInternalServerError)
+			c.logger(r).Error("failed decrypt terraform state", "ref", ref, "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeDecryptionFailed, ref, "failed to decrypt the state")
 			return
 		}
 		state = decryptedState
 	}
 
+	// restore separately encrypted sensitive values, API readers without
+	// lock access get them redacted
+	if err := c.revealSensitive(r, identity, ref, state); err != nil {
+		c.logger(r).Error("failed decrypt sensitive values", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeDecryptionFailed, ref, "failed to decrypt sensitive values")
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(state)
 }
 
-// HandleRestoreVersion
+// HandleRestoreVersion makes a version the current state
 func (c *Backend) HandleRestoreVersion(w http.ResponseWriter, r *http.Request) {
-	ref, err := c.getRef(r)
+	if c.isSealed(w, r) {
+		return
+	}
+	ref, err := c.getRef(r, auth.Admin)
 	if err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to get ref in HandleRestoreVersion: %v", err),
-			err,
-		)
-		w.WriteHeader(http.StatusUnauthorized)
+		c.logger(r).Error("failed to get ref in HandleRestoreVersion", "error", err)
+		writeAuthError(w, r, err)
+		return
+	}
+	version, err := requestVersion(r)
+	if err != nil || version == "" {
+		c.logger(r).Error("failed to read version", "ref", ref, "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, ref, "expecting a version")
+		return
+	}
+
+	if err := c.Init(); err != nil {
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
+		return
+	}
+
+	if !c.canWrite(w, r, ref) {
+		return
+	}
+
+	// a locked state can only be restored by the lock holder
+	if !c.canLock(w, r, ref, r.URL.Query().Get("ID")) {
+		return
+	}
+
+	// write the version as a new state, encrypted by the same rules as
+	// an update, rather than copying it as stored
+	restored, err := c.readState(ref, version)
+	if err != nil {
+		if err == store.ErrNotFound {
+			writeError(w, r, http.StatusNotFound, ErrCodeNotFound, ref, "version not found")
+			return
+		}
+		c.logger(r).Error("failed to read version", "ref", ref, "version", version, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to restore the version")
+		return
+	}
+	event := types.Event{
+		Type:    types.EventStateRestored,
+		Ref:     ref,
+		Version: version,
+		Serial:  webhook.Serial(restored),
+		Changes: c.summarizeChanges(r, types.EventStateRestored, ref, restored),
+	}
+	if _, ok := c.writeState(w, r, ref, restored, c.getEncrypt(r, ref)); !ok {
+		return
+	}
+	c.logger(r).Info("restored terraform state version", "ref", ref, "version", version)
+	c.publish(r, event)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// gets the requested version from the API route or the JSON request body
+func requestVersion(r *http.Request) (string, error) {
+	version := r.PathValue("version")
+	if version == "" {
+		var versionRequest struct {
+			Version string `json:"version"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&versionRequest); err != nil {
+			return "", err
+		}
+		version = versionRequest.Version
+	}
+	getRequestInfo(r).setVersion(version)
+	return version, nil
+}
+
+// HandleExportState gets the state, or a version of it, with sensitive values redacted
+func (c *Backend) HandleExportState(w http.ResponseWriter, r *http.Request) {
+	if c.isSealed(w, r) {
+		return
+	}
+	ref, err := c.getRef(r, auth.Read)
+	if err != nil {
+		c.logger(r).Error("failed to get ref in HandleExportState", "error", err)
+		writeAuthError(w, r, err)
 		return
 	}
 
 	if err := c.Init(); err != nil {
-		c.options.Logger(
-			"error",
-			fmt.Sprintf("failed to initialize terraform state backend for ref: %s", ref),
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
+		return
+	}
+
+	var versions []string
+	if version := r.URL.Query().Get("version"); version != "" {
+		getRequestInfo(r).setVersion(version)
+		versions = append(versions, version)
+	}
+
+	// get the state
+	state, encrypted, err := c.store.GetState(ref, versions...)
+	if err != nil {
+		if err == store.ErrNotFound {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		c.logger(r).Error("failed to get terraform state", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to get the state")
 		return
 	}
+
+	// decrypt
+	if encrypted {
+		decryptedState, err := c.decryptState(state)
+		if err != nil {
+			c.logger(r).Error("failed decrypt terraform state", "ref", ref, "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeDecryptionFailed, ref, "failed to decrypt the state")
+			return
+		}
+		state = decryptedState
+	}
+
+	if err := redactSensitive(state); err != nil {
+		c.logger(r).Error("failed to redact terraform state", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, ref, "failed to redact the state")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(state)
 }
 
 // simple interface
@@ -0,0 +1,2030 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/seal"
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+	"github.com/loafoe/terraform-backend-hsdp/backend/webhook"
+)
+
+// memoryStore keeps states, versions, locks and redirects in memory
+type memoryStore struct {
+	mu            sync.Mutex
+	states        map[string]types.StateDocument
+	stateVersions map[string]map[string]types.StateDocument
+	locks         map[string]types.LockDocument
+	redirects     map[string]types.Redirect
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		states:        map[string]types.StateDocument{},
+		stateVersions: map[string]map[string]types.StateDocument{},
+		locks:         map[string]types.LockDocument{},
+		redirects:     map[string]types.Redirect{},
+	}
+}
+
+func (m *memoryStore) Init() error { return nil }
+
+func (m *memoryStore) GetStates(ref string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var refs []string
+	for stateRef := range m.states {
+		if ref == "" || strings.HasPrefix(stateRef, ref+"/") {
+			refs = append(refs, stateRef)
+		}
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+func (m *memoryStore) GetState(ref string, version ...string) (map[string]interface{}, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	document, ok := m.states[ref]
+	if len(version) > 0 {
+		document, ok = m.stateVersions[ref][version[0]]
+	}
+	if !ok {
+		return nil, false, store.ErrNotFound
+	}
+	return document.State, document.Encrypted, nil
+}
+
+func (m *memoryStore) PutState(ref string, state, metadata map[string]interface{}, encrypted bool, version ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// store a copy as the S3 store does
+	var stored map[string]interface{}
+	if err := toInterface(state, &stored); err != nil {
+		return err
+	}
+	document := types.StateDocument{Ref: ref, State: stored, Encrypted: encrypted, Metadata: metadata}
+	if len(version) > 0 {
+		if m.stateVersions[ref] == nil {
+			m.stateVersions[ref] = map[string]types.StateDocument{}
+		}
+		m.stateVersions[ref][version[0]] = document
+		return nil
+	}
+	m.states[ref] = document
+	return nil
+}
+
+func (m *memoryStore) DeleteState(ref string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.states, ref)
+	return nil
+}
+
+func (m *memoryStore) GetLock(ref string) (*types.LockDocument, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lock, ok := m.locks[ref]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return &lock, nil
+}
+
+func (m *memoryStore) PutLock(ref string, lock types.LockDocument) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locks[ref] = lock
+	return nil
+}
+
+func (m *memoryStore) DeleteLock(ref string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.locks, ref)
+	return nil
+}
+
+// sorted versions of ref, the caller holds the lock
+func (m *memoryStore) sortedVersions(ref string) []string {
+	versions := []string{}
+	for version := range m.stateVersions[ref] {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+func (m *memoryStore) List(ref string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sortedVersions(ref), nil
+}
+
+func (m *memoryStore) Restore(ref, version string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	document, ok := m.stateVersions[ref][version]
+	if !ok {
+		return store.ErrNotFound
+	}
+	m.states[ref] = document
+	return nil
+}
+
+func (m *memoryStore) Keep(ref string, last int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions := m.sortedVersions(ref)
+	for i := 0; i < len(versions)-last; i++ {
+		delete(m.stateVersions[ref], versions[i])
+	}
+	return nil
+}
+
+func (m *memoryStore) CopyState(ref, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	document, ok := m.states[ref]
+	if !ok {
+		return store.ErrNotFound
+	}
+	document.Ref = target
+	m.states[target] = document
+	for version, document := range m.stateVersions[ref] {
+		if m.stateVersions[target] == nil {
+			m.stateVersions[target] = map[string]types.StateDocument{}
+		}
+		document.Ref = target
+		m.stateVersions[target][version] = document
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteVersions(ref string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.stateVersions, ref)
+	return nil
+}
+
+func (m *memoryStore) ReplaceLock(ref string, lock types.LockDocument, current string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, locked := m.locks[ref]
+	if (current == "" && locked) || (current != "" && (!locked || existing.Lock.ID != current)) {
+		return store.ErrConflict
+	}
+	m.locks[ref] = lock
+	return nil
+}
+
+func (m *memoryStore) GetRedirect(ref string) (*types.Redirect, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	redirect, ok := m.redirects[ref]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return &redirect, nil
+}
+
+func (m *memoryStore) PutRedirect(redirect types.Redirect) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.redirects[redirect.Ref] = redirect
+	return nil
+}
+
+// headerAuthenticator authenticates the subject in the X-Subject header
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	subject := r.Header.Get("X-Subject")
+	if subject == "" {
+		return nil, auth.ErrNoCredentials
+	}
+	return &auth.Identity{Subject: subject, Name: subject, Provider: "test"}, nil
+}
+
+func newTestServer(t *testing.T, admins ...string) (*httptest.Server, *Backend, *memoryGrants) {
+	t.Helper()
+	memory := newMemoryGrants()
+	backend := NewBackend(memory, &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: headerAuthenticator{},
+		Admins:        admins,
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+	return server, backend, memory
+}
+
+// serial reads the serial of a stored state
+func serial(t *testing.T, backend *Backend, ref string) interface{} {
+	t.Helper()
+	state, err := backend.readState(ref)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", ref, err)
+	}
+	return state["serial"]
+}
+
+// testState is a minimal Terraform state, the cipher rejects payloads
+// shorter than 17 bytes
+func testState(serial int) string {
+	return fmt.Sprintf(`{"version": 4, "lineage": "test", "serial": %d}`, serial)
+}
+
+func parseState(t *testing.T, data string) map[string]interface{} {
+	t.Helper()
+	var state map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func doRequest(t *testing.T, server *httptest.Server, subject, method, target, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+target, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Subject", subject)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+// canaryStore counts the canary reads of a memory store
+type canaryStore struct {
+	*memoryStore
+	canary *types.EncryptedState
+	reads  int
+}
+
+func (c *canaryStore) GetCanary() (*types.EncryptedState, error) {
+	c.reads++
+	if c.canary == nil {
+		return nil, store.ErrNotFound
+	}
+	return c.canary, nil
+}
+
+func (c *canaryStore) PutCanary(canary types.EncryptedState) error {
+	if c.canary != nil {
+		return store.ErrConflict
+	}
+	c.canary = &canary
+	return nil
+}
+
+func TestCanaryProbesPastPlaintextStates(t *testing.T) {
+	canaries := &canaryStore{memoryStore: newMemoryStore()}
+	writer := NewBackend(canaries, &Options{EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption")})
+	for i := 0; i < 12; i++ {
+		ref := fmt.Sprintf("alice/plain-%02d", i)
+		if err := canaries.PutState(ref, map[string]interface{}{"serial": i}, nil, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encrypted, err := writer.encryptState(map[string]interface{}{"version": 4, "lineage": "test", "serial": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := canaries.PutState("zed/secret", encrypted, nil, true); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatched := NewBackend(canaries, &Options{EncryptionKey: []byte("AnotherKeyThatDoesNotMatchTheCanary")})
+	if err := mismatched.Init(); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("expected a key mismatch, got %v", err)
+	}
+	if canaries.canary != nil {
+		t.Fatal("expected no canary to be written with the wrong key")
+	}
+	if err := writer.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if canaries.canary == nil {
+		t.Fatal("expected the canary to be written with the right key")
+	}
+}
+
+// unsealShare submits a key share to the unseal route
+func unsealShare(t *testing.T, server *httptest.Server, share []byte) (int, seal.Status) {
+	t.Helper()
+	status, response := doRequest(t, server, "admin", http.MethodPost, "/unseal", fmt.Sprintf(`{"share": %q}`, base64.StdEncoding.EncodeToString(share)))
+	var sealStatus seal.Status
+	_ = json.Unmarshal([]byte(response), &sealStatus)
+	return status, sealStatus
+}
+
+func TestHandleUnseal(t *testing.T) {
+	key := []byte("SecretKeyHereThisIsUsedForEncryption")
+	canaries := &canaryStore{memoryStore: newMemoryStore()}
+	if err := NewBackend(canaries, &Options{EncryptionKey: key}).Init(); err != nil {
+		t.Fatal(err)
+	}
+	shares, err := seal.Split(key, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// shares with known hashes of another key
+	wrong, err := seal.Split([]byte("AnotherKeyThatDoesNotMatchTheCanary"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, share := range append(shares, wrong...) {
+		hashes = append(hashes, seal.HashShare(share))
+	}
+	sealer, err := seal.NewSealer(2, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := NewBackend(canaries, &Options{
+		EncryptionKey: sealer.Key,
+		Authenticator: headerAuthenticator{},
+		Sealer:        sealer,
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	unknown, err := seal.Split(key, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, sealStatus := unsealShare(t, server, unknown[0]); status != http.StatusBadRequest {
+		t.Fatalf("expected an unknown share to be rejected, got %d: %+v", status, sealStatus)
+	}
+	if progress := sealer.Status().Progress; progress != 0 {
+		t.Fatalf("expected the unknown share not to count, progress %d", progress)
+	}
+
+	if status, _ := unsealShare(t, server, wrong[0]); status != http.StatusOK {
+		t.Fatalf("expected the share to be accepted, got %d", status)
+	}
+	if status, _ := unsealShare(t, server, wrong[1]); status != http.StatusBadRequest {
+		t.Fatalf("expected the wrong key to be rejected, got %d", status)
+	}
+	if !sealer.Sealed() || sealer.Key() != nil {
+		t.Fatal("expected the wrong key to leave the backend sealed")
+	}
+	if status, _ := doRequest(t, server, "alice", http.MethodGet, "/prod", ""); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected the sealed backend to reject requests, got %d", status)
+	}
+
+	unsealShare(t, server, shares[2])
+	status, sealStatus := unsealShare(t, server, shares[0])
+	if status != http.StatusOK || sealStatus.Sealed {
+		t.Fatalf("expected the backend to unseal, got %d: %+v", status, sealStatus)
+	}
+	if !bytes.Equal(sealer.Key(), key) {
+		t.Fatal("expected the key to be reconstructed")
+	}
+}
+
+func TestEncryptionPolicyDowngrade(t *testing.T) {
+	policy, err := ParseEncryptionPolicy("*/sandbox/**=plaintext,**=encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := newMemoryStore()
+	backend := NewBackend(memory, &Options{
+		EncryptionKey:  []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator:  headerAuthenticator{},
+		GetEncryptFunc: policy.GetEncryptFunc(),
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	encrypted, err := backend.encryptState(parseState(t, testState(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.PutState("alice/sandbox/legacy", encrypted, nil, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		ref       string
+		encrypted bool
+	}{
+		// the policy allows a plaintext state
+		{"sandbox/dev", false},
+		{"prod", true},
+		// an encrypted state is not downgraded by the policy
+		{"sandbox/legacy", true},
+	} {
+		if status, response := doRequest(t, server, "alice", http.MethodPost, "/"+tt.ref, testState(2)); status != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", tt.ref, status, response)
+		}
+		document := memory.states["alice/"+tt.ref]
+		if document.Encrypted != tt.encrypted {
+			t.Fatalf("%s: expected encrypted %v, got %v", tt.ref, tt.encrypted, document.Encrypted)
+		}
+		if _, plaintext := document.State["serial"]; plaintext == tt.encrypted {
+			t.Fatalf("%s: expected the stored state to match encrypted %v: %v", tt.ref, tt.encrypted, document.State)
+		}
+		if serial := serial(t, backend, "alice/"+tt.ref); serial != float64(2) {
+			t.Fatalf("%s: expected serial 2, got %v", tt.ref, serial)
+		}
+	}
+
+	// restoring a plaintext version does not downgrade an encrypted state either
+	if err := memory.PutState("alice/sandbox/legacy", parseState(t, testState(1)), nil, false, "20000101000000"); err != nil {
+		t.Fatal(err)
+	}
+	if status, response := doRequest(t, server, "alice", http.MethodPost, "/api/v1/states/sandbox%2Flegacy/versions/20000101000000/restore", ""); status != http.StatusNoContent {
+		t.Fatalf("expected the version to be restored, got %d: %s", status, response)
+	}
+	if document := memory.states["alice/sandbox/legacy"]; !document.Encrypted {
+		t.Fatalf("expected the restored state to stay encrypted, got %v", document.State)
+	}
+	if serial := serial(t, backend, "alice/sandbox/legacy"); serial != float64(1) {
+		t.Fatalf("expected the restored serial 1, got %v", serial)
+	}
+}
+
+func TestEncryptedLocksAndMetadata(t *testing.T) {
+	memory := newMemoryStore()
+	backend := NewBackend(memory, &Options{
+		EncryptionKey:       []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator:       headerAuthenticator{},
+		EncryptLocks:        true,
+		EncryptMetadata:     true,
+		MetadataIndexFields: []string{"team"},
+		GetMetadataFunc: func(state map[string]interface{}) map[string]interface{} {
+			return map[string]interface{}{"team": "network", "owner": "jane.doe@example.com"}
+		},
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	lock := `{"ID": "lock-1", "Operation": "OperationTypeApply", "Who": "jane.doe@example.com", "Info": "nightly apply", "Created": "2026-10-19T10:00:00Z", "Version": "1.9.0"}`
+	if status, response := doRequest(t, server, "alice", "LOCK", "/prod", lock); status != http.StatusOK {
+		t.Fatalf("expected the lock to succeed, got %d: %s", status, response)
+	}
+	document := memory.locks["alice/prod"]
+	if !document.Encrypted || document.EncryptedLock == "" {
+		t.Fatalf("expected the lock to be encrypted: %+v", document)
+	}
+	want := types.Lock{ID: "lock-1", Operation: "OperationTypeApply", Created: "2026-10-19T10:00:00Z", Version: "1.9.0"}
+	if document.Lock != want {
+		t.Fatalf("expected only the index fields in plaintext, got %+v", document.Lock)
+	}
+	stored, _ := json.Marshal(document)
+	if strings.Contains(string(stored), "jane.doe") || strings.Contains(string(stored), "nightly") {
+		t.Fatalf("stored lock leaks its content: %s", stored)
+	}
+
+	// another lock ID conflicts and gets the decrypted lock
+	status, response := doRequest(t, server, "alice", "LOCK", "/prod", `{"ID": "lock-2"}`)
+	if status != http.StatusLocked || !strings.Contains(response, "jane.doe@example.com") {
+		t.Fatalf("expected a conflict with the decrypted lock, got %d: %s", status, response)
+	}
+	// the holder writes and unlocks by its ID
+	if status, response := doRequest(t, server, "alice", http.MethodPost, "/prod?ID=lock-1", testState(1)); status != http.StatusOK {
+		t.Fatalf("expected the lock holder to write, got %d: %s", status, response)
+	}
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/prod?ID=lock-2", testState(2)); status != http.StatusLocked {
+		t.Fatalf("expected another lock ID to be rejected, got %d", status)
+	}
+	if status, response := doRequest(t, server, "alice", "UNLOCK", "/prod", `{"ID": "lock-1"}`); status != http.StatusOK {
+		t.Fatalf("expected the lock holder to unlock, got %d: %s", status, response)
+	}
+	if _, locked := memory.locks["alice/prod"]; locked {
+		t.Fatal("expected the lock to be removed")
+	}
+
+	metadata := memory.states["alice/prod"].Metadata
+	var encryptedMetadata types.EncryptedMetadata
+	if err := toInterface(metadata, &encryptedMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if encryptedMetadata.Index["team"] != "network" || len(encryptedMetadata.Index) != 1 {
+		t.Fatalf("expected only the team in plaintext, got %v", encryptedMetadata.Index)
+	}
+	if strings.Contains(encryptedMetadata.EncryptedData, "jane.doe") {
+		t.Fatal("expected the metadata to be encrypted")
+	}
+	var decrypted map[string]interface{}
+	if err := backend.decrypt(encryptedMetadata.EncryptedData, &decrypted); err != nil {
+		t.Fatal(err)
+	}
+	if decrypted["owner"] != "jane.doe@example.com" || decrypted["team"] != "network" {
+		t.Fatalf("expected the metadata to decrypt, got %v", decrypted)
+	}
+}
+
+// sensitiveState has a sensitive output and sensitive attributes at an
+// attribute, a map key and a list index
+const sensitiveState = `{
+	"version": 4, "lineage": "test", "serial": 1,
+	"outputs": {
+		"password": {"value": "hunter2", "type": "string", "sensitive": true},
+		"name": {"value": "db", "type": "string"}
+	},
+	"resources": [{"mode": "managed", "type": "db", "name": "main", "instances": [{
+		"attributes": {"password": "hunter2", "tags": {"token": "abc", "env": "prod"}, "keys": ["a", "b"]},
+		"sensitive_attributes": [
+			[{"type": "get_attr", "value": "password"}],
+			[{"type": "get_attr", "value": "tags"}, {"type": "index", "value": {"value": "token", "type": "string"}}],
+			[{"type": "get_attr", "value": "keys"}, {"type": "index", "value": {"value": 1, "type": "number"}}]
+		]
+	}]}]
+}`
+
+func TestWalkSensitive(t *testing.T) {
+	state := parseState(t, sensitiveState)
+	var visited []string
+	if err := walkSensitive(state, func(value interface{}) (interface{}, error) {
+		visited = append(visited, fmt.Sprint(value))
+		return "replaced", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(visited)
+	if want := []string{"abc", "b", "hunter2", "hunter2"}; fmt.Sprint(visited) != fmt.Sprint(want) {
+		t.Fatalf("expected the sensitive values %v, got %v", want, visited)
+	}
+	outputs := state["outputs"].(map[string]interface{})
+	if value := outputs["name"].(map[string]interface{})["value"]; value != "db" {
+		t.Fatalf("expected the plain output to stay, got %v", value)
+	}
+	resources := state["resources"].([]interface{})
+	attributes := resources[0].(map[string]interface{})["instances"].([]interface{})[0].(map[string]interface{})["attributes"].(map[string]interface{})
+	if tags := attributes["tags"].(map[string]interface{}); tags["token"] != "replaced" || tags["env"] != "prod" {
+		t.Fatalf("expected only the sensitive map key to be replaced, got %v", tags)
+	}
+	if keys := attributes["keys"].([]interface{}); keys[0] != "a" || keys[1] != "replaced" {
+		t.Fatalf("expected only the sensitive list index to be replaced, got %v", keys)
+	}
+}
+
+func TestProtectSensitive(t *testing.T) {
+	backend := NewBackend(newMemoryStore(), &Options{EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption")})
+	original := parseState(t, sensitiveState)
+	state := parseState(t, sensitiveState)
+	if err := backend.protectSensitive(state); err != nil {
+		t.Fatal(err)
+	}
+	protected, _ := json.Marshal(state)
+	if strings.Contains(string(protected), "hunter2") || strings.Contains(string(protected), `"abc"`) {
+		t.Fatalf("expected the sensitive values to be encrypted: %s", protected)
+	}
+	// the stored state passes through JSON
+	state = parseState(t, string(protected))
+
+	redacted := parseState(t, string(protected))
+	if err := redactSensitive(redacted); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(redacted)
+	if strings.Contains(string(data), protectedValueKey) || strings.Count(string(data), redactedValue) != 4 {
+		t.Fatalf("expected the protected values to be redacted: %s", data)
+	}
+
+	if err := backend.unprotectSensitive(state); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(state) != fmt.Sprint(original) {
+		t.Fatalf("expected the round-trip to restore the state\n got: %v\nwant: %v", state, original)
+	}
+}
+
+func TestSensitiveRoutes(t *testing.T) {
+	for _, protect := range []bool{false, true} {
+		memory := newMemoryGrants()
+		backend := NewBackend(memory, &Options{
+			EncryptionKey:    []byte("SecretKeyHereThisIsUsedForEncryption"),
+			Authenticator:    headerAuthenticator{},
+			ProtectSensitive: protect,
+		})
+		server := httptest.NewServer(backend.Handler())
+		t.Cleanup(server.Close)
+
+		if status, _ := doRequest(t, server, "bob", http.MethodPost, "/prod", sensitiveState); status != http.StatusOK {
+			t.Fatalf("bob failed to write his state: %d", status)
+		}
+		memory.grants["bob"] = []types.Grant{{Path: "prod", Grantee: "alice", Permissions: []string{"read"}}}
+
+		for _, tt := range []struct {
+			subject, target string
+			redacted        bool
+		}{
+			// terraform_remote_state with read access gets the full state
+			{"alice", "/?owner=bob&ref=prod", false},
+			{"alice", "/api/v1/states/prod?owner=bob", protect},
+			{"bob", "/api/v1/states/prod", false},
+			{"bob", "/export?ref=prod", true},
+		} {
+			status, response := doRequest(t, server, tt.subject, http.MethodGet, tt.target, "")
+			if status != http.StatusOK {
+				t.Fatalf("protect %v: %s %s: expected 200, got %d: %s", protect, tt.subject, tt.target, status, response)
+			}
+			if redacted := !strings.Contains(response, "hunter2"); redacted != tt.redacted {
+				t.Fatalf("protect %v: %s %s: expected redacted %v: %s", protect, tt.subject, tt.target, tt.redacted, response)
+			}
+			if strings.Contains(response, protectedValueKey) {
+				t.Fatalf("protect %v: %s %s: response leaks an envelope: %s", protect, tt.subject, tt.target, response)
+			}
+		}
+	}
+}
+
+// memoryGrants keeps versioned grants in memory, the next conflicts puts
+// fail as if a concurrent request changed the grants
+type memoryGrants struct {
+	*memoryStore
+	grants    map[string][]types.Grant
+	versions  map[string]int
+	conflicts int
+}
+
+func newMemoryGrants() *memoryGrants {
+	return &memoryGrants{memoryStore: newMemoryStore(), grants: map[string][]types.Grant{}, versions: map[string]int{}}
+}
+
+func (m *memoryGrants) GetGrants(owner string) ([]types.Grant, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.grants[owner]; !ok {
+		return nil, "", nil
+	}
+	return m.grants[owner], fmt.Sprint(m.versions[owner]), nil
+}
+
+func (m *memoryGrants) PutGrants(owner string, grants []types.Grant, version string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := ""
+	if _, ok := m.grants[owner]; ok {
+		current = fmt.Sprint(m.versions[owner])
+	}
+	if m.conflicts > 0 {
+		m.conflicts--
+		m.versions[owner]++
+		return store.ErrConflict
+	}
+	if version != current {
+		return store.ErrConflict
+	}
+	m.grants[owner] = grants
+	m.versions[owner]++
+	return nil
+}
+
+// memoryTokens keeps API tokens in memory
+type memoryTokens struct {
+	*memoryGrants
+	tokens map[string]types.Token
+}
+
+func (m *memoryTokens) GetToken(id string) (*types.Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.tokens[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return &token, nil
+}
+
+func (m *memoryTokens) PutToken(token types.Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[token.ID] = token
+	return nil
+}
+
+func (m *memoryTokens) DeleteToken(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, id)
+	return nil
+}
+
+func (m *memoryTokens) ListTokens() ([]types.Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var tokens []types.Token
+	for _, token := range m.tokens {
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// doTokenRequest sends a request authenticated with a bearer token
+func doTokenRequest(t *testing.T, server *httptest.Server, token, method, target, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+target, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func newTokenServer(t *testing.T) (*httptest.Server, *memoryTokens) {
+	t.Helper()
+	memory := &memoryTokens{memoryGrants: newMemoryGrants(), tokens: map[string]types.Token{}}
+	backend := NewBackend(memory, &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: auth.Chain{&auth.Tokens{Store: memory}, headerAuthenticator{}},
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+	return server, memory
+}
+
+// createToken mints a token for subject and returns its ID and value
+func createToken(t *testing.T, server *httptest.Server, subject, request string) (string, string) {
+	t.Helper()
+	status, response := doRequest(t, server, subject, http.MethodPost, "/tokens", request)
+	if status != http.StatusCreated {
+		t.Fatalf("expected the token to be created, got %d: %s", status, response)
+	}
+	var created tokenResponse
+	if err := json.Unmarshal([]byte(response), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Secret == "" || created.Hash != "" {
+		t.Fatalf("expected the token value without its hash: %s", response)
+	}
+	return created.ID, created.Secret
+}
+
+func TestTokenScopes(t *testing.T) {
+	server, _ := newTokenServer(t)
+	for _, ref := range []string{"prod", "prod/network", "dev", "prod-secrets"} {
+		if status, _ := doRequest(t, server, "alice", http.MethodPost, "/"+ref, testState(1)); status != http.StatusOK {
+			t.Fatalf("alice failed to write %s: %d", ref, status)
+		}
+	}
+	_, read := createToken(t, server, "alice", `{"scope": "read"}`)
+	_, prefixed := createToken(t, server, "alice", `{"scope": "read-write", "ref_prefixes": ["prod"]}`)
+
+	for _, tt := range []struct {
+		token, method, target, body string
+		status                      int
+	}{
+		{read, http.MethodGet, "/prod", "", http.StatusOK},
+		{read, http.MethodGet, "/api/v1/states/prod", "", http.StatusOK},
+		{read, http.MethodGet, "/versions?ref=prod", "", http.StatusOK},
+		{read, http.MethodGet, "/export?ref=prod", "", http.StatusOK},
+		{read, http.MethodGet, "/states", "", http.StatusOK},
+		{read, http.MethodPost, "/prod", testState(2), http.StatusForbidden},
+		{read, "LOCK", "/prod", `{"ID": "1"}`, http.StatusForbidden},
+		{read, "UNLOCK", "/prod", `{"ID": "1"}`, http.StatusForbidden},
+		{read, http.MethodDelete, "/prod", "", http.StatusForbidden},
+		{read, http.MethodPut, "/versions?ref=prod", `{"version": "1"}`, http.StatusForbidden},
+		{read, http.MethodDelete, "/versions?ref=prod&keep=1", "", http.StatusForbidden},
+		{read, http.MethodPost, "/transfer?ref=prod", `{"target": "moved"}`, http.StatusForbidden},
+		{read, http.MethodPost, "/api/v1/states/prod/versions/1/restore", "", http.StatusForbidden},
+
+		{prefixed, http.MethodPost, "/prod/network", testState(2), http.StatusOK},
+		{prefixed, "LOCK", "/prod/network", `{"ID": "1"}`, http.StatusOK},
+		{prefixed, "UNLOCK", "/prod/network", `{"ID": "1"}`, http.StatusOK},
+		{prefixed, http.MethodGet, "/api/v1/states/prod%2Fnetwork", "", http.StatusOK},
+		{prefixed, http.MethodGet, "/states?ref=prod", "", http.StatusOK},
+		{prefixed, http.MethodGet, "/dev", "", http.StatusForbidden},
+		{prefixed, http.MethodPost, "/dev", testState(2), http.StatusForbidden},
+		{prefixed, "LOCK", "/dev", `{"ID": "1"}`, http.StatusForbidden},
+		{prefixed, http.MethodGet, "/prod-secrets", "", http.StatusForbidden},
+		{prefixed, http.MethodGet, "/api/v1/states/dev", "", http.StatusForbidden},
+		{prefixed, http.MethodGet, "/states", "", http.StatusForbidden},
+		{prefixed, http.MethodGet, "/export?ref=dev", "", http.StatusForbidden},
+		{prefixed, http.MethodDelete, "/versions?ref=prod&keep=1", "", http.StatusForbidden},
+		{prefixed, http.MethodPost, "/transfer?ref=prod", `{"target": "prod/moved"}`, http.StatusForbidden},
+	} {
+		scope := "read"
+		if tt.token == prefixed {
+			scope = "prefixed"
+		}
+		if status, response := doTokenRequest(t, server, tt.token, tt.method, tt.target, tt.body); status != tt.status {
+			t.Errorf("%s token: %s %s: expected %d, got %d: %s", scope, tt.method, tt.target, tt.status, status, response)
+		}
+	}
+}
+
+func TestTokenRejected(t *testing.T) {
+	server, memory := newTokenServer(t)
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/prod", testState(1)); status != http.StatusOK {
+		t.Fatalf("alice failed to write her state: %d", status)
+	}
+
+	// tokens cannot mint tokens or manage access
+	id, token := createToken(t, server, "alice", `{"scope": "read-write"}`)
+	for _, tt := range []struct{ method, target, body string }{
+		{http.MethodPost, "/tokens", `{"scope": "read-write"}`},
+		{http.MethodGet, "/tokens", ""},
+		{http.MethodDelete, "/tokens?id=" + id, ""},
+		{http.MethodPost, "/grants", `{"path": "prod", "grantee": "eve", "permissions": ["read"]}`},
+	} {
+		if status, response := doTokenRequest(t, server, token, tt.method, tt.target, tt.body); status != http.StatusForbidden {
+			t.Errorf("%s %s: expected 403, got %d: %s", tt.method, tt.target, status, response)
+		}
+	}
+	if len(memory.tokens) != 1 {
+		t.Fatalf("expected only the token of alice, got %d tokens", len(memory.tokens))
+	}
+
+	if status, _ := doTokenRequest(t, server, token, http.MethodGet, "/prod", ""); status != http.StatusOK {
+		t.Fatalf("expected the token to read, got %d", status)
+	}
+	wrong := token[:len(token)-1] + "0"
+	if wrong == token {
+		wrong = token[:len(token)-1] + "1"
+	}
+	if status, _ := doTokenRequest(t, server, wrong, http.MethodGet, "/prod", ""); status != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong secret to be rejected, got %d", status)
+	}
+
+	// expired
+	memory.mu.Lock()
+	expired := memory.tokens[id]
+	expired.Expires = time.Now().Add(-time.Minute)
+	memory.tokens[id] = expired
+	memory.mu.Unlock()
+	if status, _ := doTokenRequest(t, server, token, http.MethodGet, "/prod", ""); status != http.StatusUnauthorized {
+		t.Fatalf("expected the expired token to be rejected, got %d", status)
+	}
+
+	// revoked, only by its owner
+	id, token = createToken(t, server, "alice", `{"scope": "read"}`)
+	if status, _ := doRequest(t, server, "eve", http.MethodDelete, "/tokens?id="+id, ""); status != http.StatusNotFound {
+		t.Fatalf("expected the token of alice to be hidden from eve, got %d", status)
+	}
+	if status, _ := doRequest(t, server, "alice", http.MethodDelete, "/tokens?id="+id, ""); status != http.StatusOK {
+		t.Fatalf("expected alice to revoke her token, got %d", status)
+	}
+	if status, _ := doTokenRequest(t, server, token, http.MethodGet, "/prod", ""); status != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked token to be rejected, got %d", status)
+	}
+}
+
+func TestNamespaceTraversal(t *testing.T) {
+	server, backend, memory := newTestServer(t)
+
+	if status, _ := doRequest(t, server, "bob", http.MethodPost, "/prod", testState(1)); status != http.StatusOK {
+		t.Fatalf("bob failed to write his state: %d", status)
+	}
+	if _, ok := memory.states["bob/prod"]; !ok {
+		t.Fatal("expected bob/prod to be stored")
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+	}{
+		{"read through ref parameter", http.MethodGet, "/?ref=../bob/prod"},
+		{"write through ref parameter", http.MethodPost, "/?ref=../bob/prod"},
+		{"lock through ref parameter", "LOCK", "/?ref=../bob/prod"},
+		{"nested traversal", http.MethodGet, "/?ref=prod/../../bob/prod"},
+		{"absolute ref", http.MethodGet, "/?ref=/bob/prod"},
+		{"empty segment", http.MethodGet, "/?ref=prod//x"},
+		{"read through API route", http.MethodGet, "/api/v1/states/..%2Fbob%2Fprod"},
+		{"export through API route", http.MethodGet, "/api/v1/states/..%2Fbob%2Fprod/export"},
+		{"list through owner", http.MethodGet, "/states?owner=bob/.."},
+		{"read through owner", http.MethodGet, "/?owner=../bob&ref=prod"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ""
+			switch tt.method {
+			case http.MethodPost:
+				body = testState(2)
+			case "LOCK":
+				body = `{"ID": "1"}`
+			}
+			status, response := doRequest(t, server, "alice", tt.method, tt.target, body)
+			if status != http.StatusBadRequest && status != http.StatusForbidden {
+				t.Fatalf("expected the request to be rejected, got %d: %s", status, response)
+			}
+			if strings.Contains(response, "serial") {
+				t.Fatalf("response leaks the state: %s", response)
+			}
+		})
+	}
+
+	if serial := serial(t, backend, "bob/prod"); serial != float64(1) {
+		t.Fatalf("bob's state was overwritten: serial %v", serial)
+	}
+	if _, locked := memory.locks["bob/prod"]; locked {
+		t.Fatal("bob's state was locked")
+	}
+	for ref := range memory.states {
+		if !strings.HasPrefix(ref, "bob/") {
+			t.Fatalf("unexpected state outside the namespaces: %s", ref)
+		}
+	}
+}
+
+func TestNamespaceRefs(t *testing.T) {
+	server, _, memory := newTestServer(t)
+
+	for _, target := range []string{"/network", "/?ref=apps/web", "/?ref=apps/web/"} {
+		if status, response := doRequest(t, server, "alice", http.MethodPost, target, testState(1)); status != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", target, status, response)
+		}
+	}
+	for _, ref := range []string{"alice/network", "alice/apps/web"} {
+		if _, ok := memory.states[ref]; !ok {
+			t.Fatalf("expected %s to be stored", ref)
+		}
+	}
+	status, response := doRequest(t, server, "alice", http.MethodGet, "/api/v1/states/apps%2Fweb", "")
+	if status != http.StatusOK || !strings.Contains(response, "serial") {
+		t.Fatalf("expected the state, got %d: %s", status, response)
+	}
+}
+
+func TestGrantCovers(t *testing.T) {
+	identity := &auth.Identity{Subject: "alice", Name: "alice"}
+	prefix := types.Grant{Path: "app", Prefix: true, Grantee: "alice", Permissions: []string{"read"}}
+	for p, want := range map[string]bool{
+		"app":            true,
+		"app/prod":       true,
+		"app-secrets":    false,
+		"app-secrets/db": false,
+		"application":    false,
+	} {
+		if got := grantCovers(prefix, identity, nil, p, auth.Read); got != want {
+			t.Errorf("prefix grant on app covers %s: got %v, want %v", p, got, want)
+		}
+	}
+
+	group := types.Grant{Path: "app", Grantee: "ops", Group: true, Permissions: []string{"read"}}
+	if grantCovers(group, identity, nil, "app", auth.Read) {
+		t.Error("group grant covers a non-member")
+	}
+	if !grantCovers(group, identity, []string{"ops"}, "app", auth.Read) {
+		t.Error("group grant does not cover a member")
+	}
+}
+
+func TestGrantGroupSource(t *testing.T) {
+	memory := newMemoryGrants()
+	memory.grants["bob"] = []types.Grant{{Path: "prod", Grantee: "ops", Group: true, Permissions: []string{"read"}}}
+	backend := NewBackend(memory, &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Groups:        auth.StaticGroups{"ops": {"alice"}},
+	})
+
+	// the claims of alice do not list the group, the group source does
+	granted, err := backend.granted(&auth.Identity{Subject: "alice", Name: "alice"}, "bob", "prod", auth.Read)
+	if err != nil || !granted {
+		t.Fatalf("expected the group grant to apply, got %v, %v", granted, err)
+	}
+	granted, err = backend.granted(&auth.Identity{Subject: "eve", Name: "eve", Groups: []string{"ops"}}, "bob", "prod", auth.Read)
+	if err != nil || granted {
+		t.Fatalf("expected the group source to override the claims, got %v, %v", granted, err)
+	}
+}
+
+func TestUpdateGrantsConflicts(t *testing.T) {
+	memory := newMemoryGrants()
+	backend := NewBackend(memory, &Options{EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption")})
+	add := func(grantee string) func([]types.Grant) ([]types.Grant, error) {
+		return func(grants []types.Grant) ([]types.Grant, error) {
+			return append(grants, types.Grant{Path: "prod", Grantee: grantee, Permissions: []string{"read"}}), nil
+		}
+	}
+
+	if err := backend.updateGrants(memory, "bob", add("alice")); err != nil {
+		t.Fatal(err)
+	}
+	// concurrent updates are retried on the latest grants
+	memory.conflicts = 2
+	if err := backend.updateGrants(memory, "bob", add("carol")); err != nil {
+		t.Fatal(err)
+	}
+	if len(memory.grants["bob"]) != 2 {
+		t.Fatalf("expected both grants to be kept, got %v", memory.grants["bob"])
+	}
+	memory.conflicts = grantUpdateAttempts
+	if err := backend.updateGrants(memory, "bob", add("dave")); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+}
+
+// teamRoles lists the HSDP org and space roles of users from a map
+type teamRoles map[string][]string
+
+func (t teamRoles) ListRoles(userGUID string) ([]string, error) {
+	return t[userGUID], nil
+}
+
+// hsdpAuthenticator authenticates the subject in the X-Subject header as
+// an HSDP user
+type hsdpAuthenticator struct{}
+
+func (hsdpAuthenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	identity, err := headerAuthenticator{}.Authenticate(r)
+	if err == nil {
+		identity.Provider = "hsdp"
+	}
+	return identity, err
+}
+
+func TestTeamNamespaceRoles(t *testing.T) {
+	memory := newMemoryGrants()
+	roles := &auth.HSDPRoles{
+		Lister: teamRoles{"alice": {"platform", "platform.dev"}, "bob": {"platform"}, "eve": {"ops"}},
+		TTL:    time.Minute,
+	}
+	backend := NewBackend(memory, &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: hsdpAuthenticator{},
+		RefResolver:   auth.TeamRef(roles, auth.NamespaceRef),
+		Groups:        roles,
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	if status, response := doRequest(t, server, "alice", http.MethodPost, "/teams/platform/network", testState(1)); status != http.StatusOK {
+		t.Fatalf("expected the org member to write, got %d: %s", status, response)
+	}
+	if _, ok := memory.states["teams/platform/network"]; !ok {
+		t.Fatal("expected the state in the team namespace")
+	}
+	if status, response := doRequest(t, server, "alice", http.MethodPost, "/teams/platform.dev/network", testState(1)); status != http.StatusOK {
+		t.Fatalf("expected the space member to write, got %d: %s", status, response)
+	}
+
+	// another member reads, locks and writes the team state
+	if status, response := doRequest(t, server, "bob", http.MethodGet, "/teams/platform/network", ""); status != http.StatusOK || !strings.Contains(response, "serial") {
+		t.Fatalf("expected the team member to read, got %d: %s", status, response)
+	}
+	if status, _ := doRequest(t, server, "bob", "LOCK", "/teams/platform/network", `{"ID": "1"}`); status != http.StatusOK {
+		t.Fatalf("expected the team member to lock, got %d", status)
+	}
+	if status, _ := doRequest(t, server, "bob", http.MethodPost, "/teams/platform/network?ID=1", testState(2)); status != http.StatusOK {
+		t.Fatalf("expected the team member to write, got %d", status)
+	}
+
+	for _, tt := range []struct{ subject, method, target, body string }{
+		{"eve", http.MethodGet, "/teams/platform/network", ""},
+		{"eve", http.MethodPost, "/teams/platform/network", testState(3)},
+		{"eve", "LOCK", "/teams/platform/network", `{"ID": "2"}`},
+		{"eve", http.MethodGet, "/states?ref=teams/platform", ""},
+		{"bob", http.MethodGet, "/teams/platform.dev/network", ""},
+	} {
+		status, response := doRequest(t, server, tt.subject, tt.method, tt.target, tt.body)
+		if status != http.StatusForbidden {
+			t.Errorf("%s %s %s: expected 403, got %d: %s", tt.subject, tt.method, tt.target, status, response)
+		}
+		if strings.Contains(response, "serial") {
+			t.Errorf("%s %s %s: response leaks the state: %s", tt.subject, tt.method, tt.target, response)
+		}
+	}
+	if serial := serial(t, backend, "teams/platform/network"); serial != float64(2) {
+		t.Fatalf("expected the non-member not to write, serial %v", serial)
+	}
+}
+
+func TestTransferRedirect(t *testing.T) {
+	server, _, memory := newTestServer(t, "admin")
+
+	if status, _ := doRequest(t, server, "bob", http.MethodPost, "/prod", testState(1)); status != http.StatusOK {
+		t.Fatalf("bob failed to write his state: %d", status)
+	}
+	memory.grants["bob"] = []types.Grant{{Path: "prod", Grantee: "alice", Permissions: []string{"read"}}}
+	if status, _ := doRequest(t, server, "alice", http.MethodGet, "/?owner=bob&ref=prod", ""); status != http.StatusOK {
+		t.Fatalf("expected alice to read the granted state, got %d", status)
+	}
+
+	// only backend administrators transfer the states of other owners
+	transfer := `{"target": "prod", "target_owner": "carol"}`
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/transfer?source_owner=bob&ref=prod", transfer); status != http.StatusForbidden {
+		t.Fatalf("expected the transfer of alice to be forbidden, got %d", status)
+	}
+	if status, response := doRequest(t, server, "admin", http.MethodPost, "/transfer?source_owner=bob&ref=prod", transfer); status != http.StatusOK {
+		t.Fatalf("expected the transfer to succeed, got %d: %s", status, response)
+	}
+	if _, ok := memory.states["carol/prod"]; !ok {
+		t.Fatal("expected carol/prod to be stored")
+	}
+	if _, ok := memory.states["bob/prod"]; ok {
+		t.Fatal("expected bob/prod to be removed")
+	}
+
+	// the grant of bob does not carry over to the state of carol
+	if status, response := doRequest(t, server, "alice", http.MethodGet, "/?owner=bob&ref=prod", ""); status != http.StatusForbidden {
+		t.Fatalf("expected the redirect to be forbidden, got %d: %s", status, response)
+	}
+	memory.grants["carol"] = []types.Grant{{Path: "prod", Grantee: "alice", Permissions: []string{"read"}}}
+	if status, response := doRequest(t, server, "alice", http.MethodGet, "/?owner=bob&ref=prod", ""); status != http.StatusOK || !strings.Contains(response, "serial") {
+		t.Fatalf("expected the redirect to be followed, got %d: %s", status, response)
+	}
+}
+
+func TestTransferLocked(t *testing.T) {
+	server, _, memory := newTestServer(t)
+
+	if status, _ := doRequest(t, server, "bob", http.MethodPost, "/prod", testState(1)); status != http.StatusOK {
+		t.Fatalf("bob failed to write his state: %d", status)
+	}
+	if status, _ := doRequest(t, server, "bob", "LOCK", "/prod", `{"ID": "1"}`); status != http.StatusOK {
+		t.Fatalf("bob failed to lock his state: %d", status)
+	}
+	if status, _ := doRequest(t, server, "bob", http.MethodPost, "/transfer?ref=prod", `{"target": "moved"}`); status != http.StatusLocked {
+		t.Fatalf("expected the locked state to stay, got %d", status)
+	}
+
+	if status, response := doRequest(t, server, "bob", http.MethodPost, "/transfer?ref=prod", `{"target": "moved", "move_lock": true}`); status != http.StatusOK {
+		t.Fatalf("expected the transfer with the lock to succeed, got %d: %s", status, response)
+	}
+	if lock := memory.locks["bob/moved"]; lock.Lock.ID != "1" {
+		t.Fatalf("expected the lock to move, got %v", lock)
+	}
+}
+
+// copyHookStore calls onCopy before copying a state
+type copyHookStore struct {
+	*memoryGrants
+	onCopy func(ref, target string)
+}
+
+func (c *copyHookStore) CopyState(ref, target string) error {
+	if c.onCopy != nil {
+		c.onCopy(ref, target)
+	}
+	return c.memoryGrants.CopyState(ref, target)
+}
+
+func TestTransferLocksTarget(t *testing.T) {
+	memory := &copyHookStore{memoryGrants: newMemoryGrants()}
+	backend := NewBackend(memory, &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: headerAuthenticator{},
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	for _, ref := range []string{"prod", "staging", "existing"} {
+		if status, _ := doRequest(t, server, "bob", http.MethodPost, "/"+ref, testState(1)); status != http.StatusOK {
+			t.Fatalf("bob failed to write %s: %d", ref, status)
+		}
+	}
+
+	// a locked target is not overwritten
+	if status, _ := doRequest(t, server, "bob", "LOCK", "/moved", `{"ID": "1"}`); status != http.StatusOK {
+		t.Fatalf("bob failed to lock the target: %d", status)
+	}
+	if status, response := doRequest(t, server, "bob", http.MethodPost, "/transfer?ref=prod", `{"target": "moved"}`); status != http.StatusLocked {
+		t.Fatalf("expected the locked target to be rejected, got %d: %s", status, response)
+	}
+	if lock := memory.locks["bob/moved"]; lock.Lock.ID != "1" {
+		t.Fatalf("expected the lock of the target to stay, got %+v", lock)
+	}
+	if _, locked := memory.locks["bob/prod"]; locked {
+		t.Fatal("expected the source to stay unlocked")
+	}
+	doRequest(t, server, "bob", "UNLOCK", "/moved", `{"ID": "1"}`)
+
+	// an existing target keeps no transfer lock
+	if status, _ := doRequest(t, server, "bob", http.MethodPost, "/transfer?ref=prod", `{"target": "existing"}`); status != http.StatusConflict {
+		t.Fatalf("expected the existing target to be rejected, got %d", status)
+	}
+	if _, locked := memory.locks["bob/existing"]; locked {
+		t.Fatal("expected the transfer lock of the target to be released")
+	}
+
+	// the target cannot be written while the state is copied
+	memory.onCopy = func(ref, target string) {
+		if status, _ := doRequest(t, server, "bob", http.MethodPost, "/moved", testState(9)); status != http.StatusLocked {
+			t.Errorf("expected the target to be locked during the transfer, got %d", status)
+		}
+		if status, _ := doRequest(t, server, "bob", "LOCK", "/moved", `{"ID": "2"}`); status != http.StatusLocked {
+			t.Errorf("expected the target lock to conflict during the transfer, got %d", status)
+		}
+	}
+	if status, response := doRequest(t, server, "bob", http.MethodPost, "/transfer?ref=prod", `{"target": "moved"}`); status != http.StatusOK {
+		t.Fatalf("expected the transfer to succeed, got %d: %s", status, response)
+	}
+	if serial := serial(t, backend, "bob/moved"); serial != float64(1) {
+		t.Fatalf("expected the transferred state, serial %v", serial)
+	}
+	if _, locked := memory.locks["bob/moved"]; locked {
+		t.Fatal("expected the transfer lock of the target to be released")
+	}
+}
+
+func TestPolicyRoutes(t *testing.T) {
+	memory := newMemoryGrants()
+	backend := NewBackend(memory, &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: headerAuthenticator{},
+		Policy:        &auth.Policy{OwnerRole: auth.RoleWriter, TeamRole: auth.RoleNone},
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/prod", testState(1)); status != http.StatusOK {
+		t.Fatalf("expected the writer to write, got %d", status)
+	}
+	for _, tt := range []struct {
+		subject, method, target, body string
+		status                        int
+		code                          string
+	}{
+		{"alice", http.MethodGet, "/prod", "", http.StatusOK, ""},
+		{"alice", http.MethodDelete, "/versions?ref=prod&keep=1", "", http.StatusForbidden, ErrCodeForbidden},
+		{"alice", http.MethodPost, "/api/v1/states/prod/versions/1/restore", "", http.StatusForbidden, ErrCodeForbidden},
+		{"", http.MethodGet, "/prod", "", http.StatusUnauthorized, ErrCodeUnauthorized},
+		// owners cannot grant more than their roles
+		{"alice", http.MethodPost, "/grants", `{"path": "prod", "grantee": "bob", "permissions": ["admin"]}`, http.StatusForbidden, ErrCodeForbidden},
+		{"alice", http.MethodPost, "/grants", `{"path": "prod", "grantee": "bob", "permissions": ["write"]}`, http.StatusOK, ""},
+	} {
+		status, response := doRequest(t, server, tt.subject, tt.method, tt.target, tt.body)
+		if status != tt.status {
+			t.Fatalf("%s %s %s: expected %d, got %d: %s", tt.subject, tt.method, tt.target, tt.status, status, response)
+		}
+		if tt.code != "" && !strings.Contains(response, fmt.Sprintf(`"code":%q`, tt.code)) {
+			t.Fatalf("%s %s %s: expected code %s: %s", tt.subject, tt.method, tt.target, tt.code, response)
+		}
+	}
+
+	// a grant beyond the roles of the owner gives only what the owner holds
+	memory.grants["alice"] = []types.Grant{{Path: "prod", Grantee: "bob", Permissions: []string{"admin"}}}
+	if status, _ := doRequest(t, server, "bob", http.MethodPost, "/?owner=alice&ref=prod", testState(2)); status != http.StatusOK {
+		t.Fatalf("expected the grantee to write, got %d", status)
+	}
+	if status, _ := doRequest(t, server, "bob", http.MethodDelete, "/versions?owner=alice&ref=prod&keep=1", ""); status != http.StatusForbidden {
+		t.Fatalf("expected the grantee not to administer, got %d", status)
+	}
+	if status, _ := doRequest(t, server, "alice", "LOCK", "/prod", `{"ID": "1"}`); status != http.StatusOK {
+		t.Fatalf("expected the owner to lock, got %d", status)
+	}
+	if status, _ := doRequest(t, server, "bob", "UNLOCK", "/?owner=alice&ref=prod", ""); status != http.StatusLocked {
+		t.Fatalf("expected the grantee not to force unlock, got %d", status)
+	}
+
+	// without a policy a lock grant does not force unlock either
+	backend.options.Policy = nil
+	memory.grants["alice"] = []types.Grant{{Path: "prod", Grantee: "bob", Permissions: []string{"lock"}}}
+	if status, _ := doRequest(t, server, "bob", "UNLOCK", "/?owner=alice&ref=prod", ""); status != http.StatusLocked {
+		t.Fatalf("expected the lock grantee not to force unlock, got %d", status)
+	}
+	memory.grants["alice"] = []types.Grant{{Path: "prod", Grantee: "bob", Permissions: []string{"admin"}}}
+	if status, _ := doRequest(t, server, "bob", "UNLOCK", "/?owner=alice&ref=prod", ""); status != http.StatusOK {
+		t.Fatalf("expected the admin grantee to force unlock, got %d", status)
+	}
+}
+
+// nameAuthenticator authenticates X-Subject with the display name in X-Name
+type nameAuthenticator struct{}
+
+func (nameAuthenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	subject := r.Header.Get("X-Subject")
+	if subject == "" {
+		return nil, auth.ErrNoCredentials
+	}
+	return &auth.Identity{Subject: subject, Name: r.Header.Get("X-Name"), Provider: "test"}, nil
+}
+
+func TestAdminsMatchSubjects(t *testing.T) {
+	backend := NewBackend(newMemoryGrants(), &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: nameAuthenticator{},
+		Throttle:      auth.NewThrottle(5, time.Minute, time.Hour),
+		Admins:        []string{"hsdp:admin"},
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	lockouts := func(subject, name string) int {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/lockouts", nil)
+		req.Header.Set("X-Subject", subject)
+		req.Header.Set("X-Name", name)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := lockouts("hsdp:admin", "admin"); status != http.StatusOK {
+		t.Fatalf("expected the admin subject to be allowed, got %d", status)
+	}
+	// another provider may issue the same name
+	if status := lockouts("htpasswd:hsdp:admin", "hsdp:admin"); status != http.StatusForbidden {
+		t.Fatalf("expected a matching name not to be an admin, got %d", status)
+	}
+}
+
+func TestHandlerMiddleware(t *testing.T) {
+	var seen []string
+	record := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info := getRequestInfo(r)
+			if info == nil || !info.authenticated {
+				t.Error("expected custom middleware to run after authentication")
+			}
+			seen = append(seen, RequestID(r))
+			if r.Header.Get("X-Panic") != "" {
+				panic("boom")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	backend := NewBackend(newMemoryGrants(), &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: headerAuthenticator{},
+		Middleware:    []Middleware{record},
+	})
+	// mounted under a sub-path
+	mux := http.NewServeMux()
+	mux.Handle("/tfstate/", http.StripPrefix("/tfstate", backend.Handler()))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/tfstate/prod", testState(1)); status != http.StatusOK {
+		t.Fatalf("expected the write under the sub-path to succeed, got %d", status)
+	}
+	status, body := doRequest(t, server, "alice", http.MethodGet, "/tfstate/prod", "")
+	if status != http.StatusOK || !strings.Contains(body, `"serial":1`) {
+		t.Fatalf("expected to read the state under the sub-path, got %d %s", status, body)
+	}
+
+	// an incoming request ID is kept and echoed
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/tfstate/prod", nil)
+	req.Header.Set("X-Subject", "alice")
+	req.Header.Set(RequestIDHeader, "trace-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if id := resp.Header.Get(RequestIDHeader); id != "trace-1" {
+		t.Fatalf("expected the request ID to be echoed, got %q", id)
+	}
+	if last := seen[len(seen)-1]; last != "trace-1" {
+		t.Fatalf("expected the middleware to see the request ID, got %q", last)
+	}
+
+	// panics become JSON errors
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/tfstate/prod", nil)
+	req.Header.Set("X-Subject", "alice")
+	req.Header.Set("X-Panic", "1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response ErrorResponse
+	_ = json.NewDecoder(resp.Body).Decode(&response)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || response.Code != ErrCodeInternal || response.RequestID == "" {
+		t.Fatalf("expected a recovered internal error, got %d %+v", resp.StatusCode, response)
+	}
+
+	// unknown methods list the allowed ones
+	req, _ = http.NewRequest(http.MethodPatch, server.URL+"/tfstate/versions", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "DELETE, GET, PUT, RETRIEVE" {
+		t.Fatalf("expected 405 with the allowed methods, got %d %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestReservedRoutes(t *testing.T) {
+	server, backend, _ := newTestServer(t)
+
+	// metrics are disabled, the route is still not a state
+	status, body := doRequest(t, server, "alice", http.MethodGet, "/metrics", "")
+	var response ErrorResponse
+	if err := json.Unmarshal([]byte(body), &response); err != nil || status != http.StatusNotFound || response.Code != ErrCodeNotFound {
+		t.Fatalf("expected disabled metrics to be not found, got %d %s", status, body)
+	}
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/metrics", testState(1)); status != http.StatusMethodNotAllowed {
+		t.Fatalf("expected no state to be written at /metrics, got %d", status)
+	}
+
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/prod", testState(1)); status != http.StatusOK {
+		t.Fatalf("failed to write: %d", status)
+	}
+	for route := range reservedRoutes {
+		status, _ := doRequest(t, server, "alice", http.MethodPost, "/transfer?ref=prod", `{"target": "`+route+`"}`)
+		if status != http.StatusBadRequest {
+			t.Errorf("expected a transfer to %s to be rejected, got %d", route, status)
+		}
+	}
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/transfer?ref=prod", `{"target": "api/v1/states"}`); status != http.StatusBadRequest {
+		t.Errorf("expected a transfer below the API to be rejected, got %d", status)
+	}
+	// nested paths below a route name remain states
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/metrics/prod", testState(1)); status != http.StatusOK {
+		t.Fatalf("expected a nested state to be written, got %d", status)
+	}
+	if _, _, err := backend.store.GetState("alice/metrics/prod"); err != nil {
+		t.Fatalf("expected alice/metrics/prod to be stored: %v", err)
+	}
+}
+
+func TestVersionsAPI(t *testing.T) {
+	server, _, memory := newTestServer(t)
+
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/team/network", testState(1)); status != http.StatusOK {
+		t.Fatalf("failed to write the state: %d", status)
+	}
+	memory.mu.Lock()
+	for _, document := range memory.stateVersions["alice/team/network"] {
+		memory.stateVersions["alice/team/network"]["20000101000000"] = document
+	}
+	memory.mu.Unlock()
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/team/network", testState(2)); status != http.StatusOK {
+		t.Fatalf("failed to update the state: %d", status)
+	}
+
+	// refs are a single escaped segment
+	status, body := doRequest(t, server, "alice", http.MethodGet, "/api/v1/states/team%2Fnetwork/versions", "")
+	var versions []string
+	if err := json.Unmarshal([]byte(body), &versions); err != nil || status != http.StatusOK || len(versions) != 2 || versions[0] != "20000101000000" {
+		t.Fatalf("expected both versions, got %d %s", status, body)
+	}
+	status, body = doRequest(t, server, "alice", http.MethodGet, "/api/v1/states/team%2Fnetwork/versions/20000101000000", "")
+	if status != http.StatusOK || !strings.Contains(body, `"serial":1`) {
+		t.Fatalf("expected the first version, got %d %s", status, body)
+	}
+	if status, body := doRequest(t, server, "alice", http.MethodPost, "/api/v1/states/team%2Fnetwork/versions/20000101000000/restore", ""); status != http.StatusNoContent {
+		t.Fatalf("expected the version to be restored, got %d %s", status, body)
+	}
+	status, body = doRequest(t, server, "alice", http.MethodGet, "/api/v1/states/team%2Fnetwork", "")
+	if status != http.StatusOK || !strings.Contains(body, `"serial":1`) {
+		t.Fatalf("expected the restored state, got %d %s", status, body)
+	}
+	if status, body := doRequest(t, server, "alice", http.MethodDelete, "/api/v1/states/team%2Fnetwork/versions?keep=1", ""); status != http.StatusNoContent {
+		t.Fatalf("expected older versions to be removed, got %d %s", status, body)
+	}
+	if _, ok := memory.stateVersions["alice/team/network"]["20000101000000"]; ok || len(memory.stateVersions["alice/team/network"]) != 1 {
+		t.Fatalf("expected only the last version to be kept, got %v", memory.stateVersions["alice/team/network"])
+	}
+	status, body = doRequest(t, server, "alice", http.MethodGet, "/api/v1/states", "")
+	if status != http.StatusOK || !strings.Contains(body, `"team/network"`) {
+		t.Fatalf("expected the state to be listed, got %d %s", status, body)
+	}
+
+	// other namespaces stay out of reach
+	if status, body := doRequest(t, server, "bob", http.MethodGet, "/api/v1/states/..%2Falice%2Fteam%2Fnetwork/versions", ""); status == http.StatusOK {
+		t.Fatalf("expected the traversal to be rejected, got %d %s", status, body)
+	}
+
+	status, body = doRequest(t, server, "alice", http.MethodGet, "/api/v1/unknown", "")
+	var response ErrorResponse
+	if err := json.Unmarshal([]byte(body), &response); err != nil || status != http.StatusNotFound || response.Code != ErrCodeNotFound {
+		t.Fatalf("expected unknown API routes to be not found, got %d %s", status, body)
+	}
+}
+
+// unavailableStore fails to read states
+type unavailableStore struct {
+	*memoryStore
+}
+
+func (unavailableStore) GetState(ref string, version ...string) (map[string]interface{}, bool, error) {
+	return nil, false, errors.New("connection refused")
+}
+
+func TestErrorResponses(t *testing.T) {
+	server, _, memory := newTestServer(t)
+
+	// decodes the error of a response
+	errorCode := func(t *testing.T, subject, method, target, body string, expected int) ErrorResponse {
+		t.Helper()
+		status, data := doRequest(t, server, subject, method, target, body)
+		var response ErrorResponse
+		if err := json.Unmarshal([]byte(data), &response); err != nil {
+			t.Fatalf("expected a JSON error, got %d %s", status, data)
+		}
+		if status != expected || response.RequestID == "" {
+			t.Fatalf("expected %d with a request ID, got %d %s", expected, status, data)
+		}
+		return response
+	}
+
+	if response := errorCode(t, "", http.MethodGet, "/prod", "", http.StatusUnauthorized); response.Code != ErrCodeUnauthorized {
+		t.Errorf("expected %s, got %s", ErrCodeUnauthorized, response.Code)
+	}
+	if response := errorCode(t, "alice", http.MethodGet, "/prod?owner=bob", "", http.StatusForbidden); response.Code != ErrCodeForbidden {
+		t.Errorf("expected %s, got %s", ErrCodeForbidden, response.Code)
+	}
+	if response := errorCode(t, "alice", http.MethodPost, "/prod", "not json", http.StatusBadRequest); response.Code != ErrCodeInvalidRequest || response.Ref != "prod" {
+		t.Errorf("expected %s for prod, got %+v", ErrCodeInvalidRequest, response)
+	}
+	if response := errorCode(t, "alice", http.MethodDelete, "/versions?ref=prod&keep=0", "", http.StatusBadRequest); response.Code != ErrCodeInvalidRequest {
+		t.Errorf("expected %s, got %s", ErrCodeInvalidRequest, response.Code)
+	}
+
+	// lock conflicts carry the lock for terraform
+	if status, _ := doRequest(t, server, "alice", "LOCK", "/prod", `{"ID": "1", "Who": "ci"}`); status != http.StatusOK {
+		t.Fatalf("failed to lock: %d", status)
+	}
+	status, data := doRequest(t, server, "alice", "LOCK", "/prod", `{"ID": "2"}`)
+	var conflict struct {
+		ID   string
+		Who  string
+		Code string `json:"code"`
+		Ref  string `json:"ref"`
+	}
+	if err := json.Unmarshal([]byte(data), &conflict); err != nil || status != http.StatusLocked ||
+		conflict.ID != "1" || conflict.Who != "ci" || conflict.Code != ErrCodeStateLocked || conflict.Ref != "prod" {
+		t.Fatalf("expected the lock holder in the conflict, got %d %s", status, data)
+	}
+	if status, _ := doRequest(t, server, "alice", "UNLOCK", "/prod", `{"ID": "1"}`); status != http.StatusOK {
+		t.Fatalf("failed to unlock: %d", status)
+	}
+
+	// states encrypted with another key
+	if status, _ := doRequest(t, server, "alice", http.MethodPost, "/prod", testState(1)); status != http.StatusOK {
+		t.Fatalf("failed to write: %d", status)
+	}
+	other := NewBackend(memory, &Options{
+		EncryptionKey: []byte("AnotherKeyHereThisIsUsedForEncryption"),
+		Authenticator: headerAuthenticator{},
+	})
+	server = httptest.NewServer(other.Handler())
+	t.Cleanup(server.Close)
+	if response := errorCode(t, "alice", http.MethodGet, "/prod", "", http.StatusInternalServerError); response.Code != ErrCodeDecryptionFailed {
+		t.Errorf("expected %s, got %s", ErrCodeDecryptionFailed, response.Code)
+	}
+
+	unavailable := NewBackend(unavailableStore{memory.memoryStore}, &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: headerAuthenticator{},
+	})
+	server = httptest.NewServer(unavailable.Handler())
+	t.Cleanup(server.Close)
+	if response := errorCode(t, "alice", http.MethodGet, "/prod", "", http.StatusInternalServerError); response.Code != ErrCodeStoreUnavailable {
+		t.Errorf("expected %s, got %s", ErrCodeStoreUnavailable, response.Code)
+	}
+}
+
+func TestLockWaits(t *testing.T) {
+	var waits lockWaits
+	if _, ok := waits.acquired("alice/prod", "1"); ok {
+		t.Fatal("expected a lock without conflict not to wait")
+	}
+	waits.conflict("alice/prod", "1")
+	first := waits.conflicts[lockWaitKey("alice/prod", "1")]
+	// retries keep the first conflict
+	waits.conflict("alice/prod", "1")
+	if waits.conflicts[lockWaitKey("alice/prod", "1")] != first {
+		t.Fatal("expected the first conflict to be kept")
+	}
+	if _, ok := waits.acquired("alice/prod", "1"); !ok {
+		t.Fatal("expected the lock to have waited")
+	}
+	if _, ok := waits.acquired("alice/prod", "1"); ok {
+		t.Fatal("expected the wait to be recorded once")
+	}
+}
+
+// memoryDeliveries keeps webhook deliveries in memory
+type memoryDeliveries struct {
+	mu         sync.Mutex
+	deliveries []types.WebhookDelivery
+}
+
+func (m *memoryDeliveries) PutDelivery(delivery types.WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries = append(m.deliveries, delivery)
+	return nil
+}
+
+func (m *memoryDeliveries) DeleteDelivery(string) error { return nil }
+
+func (m *memoryDeliveries) ListDeliveries() ([]types.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]types.WebhookDelivery(nil), m.deliveries...), nil
+}
+
+func TestLockHeldEvent(t *testing.T) {
+	deliveries := &memoryDeliveries{}
+	backend := NewBackend(newMemoryStore(), &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: headerAuthenticator{},
+		Webhooks: webhook.NewDispatcher(&webhook.Config{
+			Webhooks:      []webhook.Webhook{{Name: "ci", URL: "https://hooks.example.com", Secret: "s", Events: []string{types.EventLockHeld}}},
+			LockThreshold: webhook.Duration(50 * time.Millisecond),
+		}, deliveries, nil),
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+	events := backend.events.subscribe()
+	// lockHeld waits for the next lock_held event, streams receive all events
+	lockHeld := func(timeout time.Duration) *types.Event {
+		deadline := time.After(timeout)
+		for {
+			select {
+			case event := <-events:
+				if event.Type == types.EventLockHeld {
+					return &event
+				}
+			case <-deadline:
+				return nil
+			}
+		}
+	}
+
+	// sent after the locking request completed, with its identity
+	if status, _ := doRequest(t, server, "alice", "LOCK", "/prod", `{"ID": "1"}`); status != http.StatusOK {
+		t.Fatalf("failed to lock: %d", status)
+	}
+	event := lockHeld(5 * time.Second)
+	if event == nil || event.Ref != "alice/prod" || event.Identity != "alice" || event.Lock.ID != "1" {
+		t.Fatalf("expected lock_held of alice/prod to be sent, got %+v", event)
+	}
+	if pending, _ := deliveries.ListDeliveries(); len(pending) != 1 {
+		t.Fatalf("expected one webhook delivery, got %d", len(pending))
+	}
+
+	// not sent for a released lock
+	if status, _ := doRequest(t, server, "alice", "LOCK", "/dev", `{"ID": "2"}`); status != http.StatusOK {
+		t.Fatalf("failed to lock: %d", status)
+	}
+	if status, _ := doRequest(t, server, "alice", "UNLOCK", "/dev", `{"ID": "2"}`); status != http.StatusOK {
+		t.Fatalf("failed to unlock: %d", status)
+	}
+	if event := lockHeld(200 * time.Millisecond); event != nil {
+		t.Fatalf("expected no lock_held for the released lock, got %+v", event)
+	}
+}
+
+func TestReadinessCachesCanary(t *testing.T) {
+	canaries := &canaryStore{memoryStore: newMemoryStore()}
+	backend := NewBackend(canaries, &Options{EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption")})
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+	reads := canaries.reads
+	for i := 0; i < 3; i++ {
+		if status := backend.Health(); status.Status != checkOK {
+			t.Fatalf("expected the backend to be ready, got %+v", status)
+		}
+	}
+	if canaries.reads != reads {
+		t.Fatalf("expected probes not to read the canary, got %d reads", canaries.reads-reads)
+	}
+
+	// a key mismatch is not verified again
+	mismatched := NewBackend(canaries, &Options{EncryptionKey: []byte("AnotherKeyThatDoesNotMatchTheCanary")})
+	for i := 0; i < 3; i++ {
+		if err := mismatched.Init(); !errors.Is(err, ErrKeyMismatch) {
+			t.Fatalf("expected a key mismatch, got %v", err)
+		}
+	}
+	if canaries.reads != reads+1 {
+		t.Fatalf("expected the canary to be read once, got %d reads", canaries.reads-reads)
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	var logs bytes.Buffer
+	var backend *Backend
+	// logs credentials and state content through the backend logger
+	leak := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backend.logger(r).Debug("leaking",
+				"token", r.Header.Get("X-Token"),
+				"password", "hunter2",
+				"header", r.Header.Get("Authorization"),
+				slog.Group("request", "state", testState(7)),
+			)
+			next.ServeHTTP(w, r)
+		})
+	}
+	backend = NewBackend(newMemoryGrants(), &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: headerAuthenticator{},
+		Logger:        slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Middleware:    []Middleware{leak},
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/prod", strings.NewReader(testState(7)))
+	req.Header.Set("X-Subject", "alice")
+	req.Header.Set("X-Token", "tfs_secret")
+	req.Header.Set("Authorization", "Bearer eyJhbGciOi")
+	req.Header.Set(RequestIDHeader, "trace-2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	for _, secret := range []string{"tfs_secret", "hunter2", "eyJhbGciOi", `\"serial\": 7`} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("expected %s to be redacted: %s", secret, logs.String())
+		}
+	}
+
+	var request map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("expected JSON logs, got %s", line)
+		}
+		if record["msg"] == "request" {
+			request = record
+		}
+	}
+	if request == nil {
+		t.Fatalf("expected a request log: %s", logs.String())
+	}
+	for key, value := range map[string]interface{}{
+		"request_id": "trace-2",
+		"identity":   "alice",
+		"operation":  http.MethodPost,
+		"ref":        "alice/prod",
+		"status":     float64(http.StatusOK),
+	} {
+		if request[key] != value {
+			t.Errorf("expected %s %v in the request log, got %v", key, value, request[key])
+		}
+	}
+	if _, ok := request["latency"]; !ok {
+		t.Error("expected the latency in the request log")
+	}
+}
+
+// memoryAudit keeps audit events and checkpoints in memory, it counts the
+// events read and the events scanned for the newest one
+type memoryAudit struct {
+	*memoryStore
+	events      map[uint64]types.AuditEvent
+	checkpoints []types.AuditCheckpoint
+	version     int
+	read        int
+	scanned     int
+}
+
+func newMemoryAudit() *memoryAudit {
+	return &memoryAudit{memoryStore: newMemoryStore(), events: map[uint64]types.AuditEvent{}}
+}
+
+func (m *memoryAudit) AppendAuditEvent(event types.AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.events[event.Sequence]; ok {
+		return store.ErrConflict
+	}
+	m.events[event.Sequence] = event
+	return nil
+}
+
+func (m *memoryAudit) sequences(after uint64) []uint64 {
+	var sequences []uint64
+	for sequence := range m.events {
+		if sequence > after {
+			sequences = append(sequences, sequence)
+		}
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	return sequences
+}
+
+func (m *memoryAudit) ListAuditEvents(after uint64, limit int) ([]types.AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []types.AuditEvent
+	for _, sequence := range m.sequences(after) {
+		events = append(events, m.events[sequence])
+		if len(events) == limit {
+			break
+		}
+	}
+	m.read += len(events)
+	return events, nil
+}
+
+func (m *memoryAudit) LastAuditEvent(after uint64) (*types.AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sequences := m.sequences(after)
+	m.scanned += len(sequences)
+	if len(sequences) == 0 {
+		return nil, store.ErrNotFound
+	}
+	event := m.events[sequences[len(sequences)-1]]
+	return &event, nil
+}
+
+func (m *memoryAudit) GetAuditCheckpoints() ([]types.AuditCheckpoint, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.checkpoints == nil {
+		return nil, "", nil
+	}
+	return append([]types.AuditCheckpoint{}, m.checkpoints...), fmt.Sprint(m.version), nil
+}
+
+func (m *memoryAudit) PutAuditCheckpoints(checkpoints []types.AuditCheckpoint, version string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := ""
+	if m.checkpoints != nil {
+		current = fmt.Sprint(m.version)
+	}
+	if version != current {
+		return store.ErrConflict
+	}
+	m.checkpoints = checkpoints
+	m.version++
+	return nil
+}
+
+// verifyChain checks the events of the store form one hash chain
+func verifyChain(t *testing.T, memory *memoryAudit) {
+	t.Helper()
+	previous := &types.AuditEvent{}
+	for _, sequence := range memory.sequences(0) {
+		event := memory.events[sequence]
+		if !verifyAuditEvent(previous, event) {
+			t.Fatalf("audit chain broken at %d", sequence)
+		}
+		previous = &event
+	}
+}
+
+func TestAuditLogAppends(t *testing.T) {
+	memory := newMemoryAudit()
+	first := newAuditLog(memory, 10, slog.New(slog.DiscardHandler))
+	second := newAuditLog(memory, 10, slog.New(slog.DiscardHandler))
+
+	// two instances append to the same chain
+	for i := 0; i < auditCheckpointInterval+10; i++ {
+		log := first
+		if i%3 == 0 {
+			log = second
+		}
+		if err := log.append(&types.AuditEvent{Time: time.Now().UTC(), Action: "read"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verifyChain(t, memory)
+	if len(memory.checkpoints) != 1 || memory.checkpoints[0].Sequence != auditCheckpointInterval {
+		t.Fatalf("expected a checkpoint at %d, got %v", auditCheckpointInterval, memory.checkpoints)
+	}
+
+	// a restarted instance continues from the last checkpoint
+	memory.scanned = 0
+	restarted := newAuditLog(memory, 10, slog.New(slog.DiscardHandler))
+	if err := restarted.record(types.AuditEvent{Time: time.Now().UTC(), Action: "write"}); err != nil {
+		t.Fatal(err)
+	}
+	restarted.close()
+	if memory.scanned > 20 {
+		t.Fatalf("expected only the events after the checkpoint to be scanned, scanned %d", memory.scanned)
+	}
+	verifyChain(t, memory)
+	if err := restarted.record(types.AuditEvent{Action: "write"}); !errors.Is(err, errAuditClosed) {
+		t.Fatalf("expected the closed log to reject events, got %v", err)
+	}
+}
+
+func TestAuditQueryStartsAtCheckpoint(t *testing.T) {
+	memory := newMemoryAudit()
+	backend := NewBackend(memory, &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: headerAuthenticator{},
+		Audit:         true,
+		Admins:        []string{"admin"},
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	// another instance appended the events
+	writer := newAuditLog(memory, 10, slog.New(slog.DiscardHandler))
+	start := time.Now().UTC().Add(-time.Hour)
+	for i := 0; i < 2*auditCheckpointInterval; i++ {
+		event := types.AuditEvent{Time: start.Add(time.Duration(i) * time.Second), Action: "read"}
+		if err := writer.append(&event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.close()
+
+	memory.mu.Lock()
+	memory.read = 0
+	memory.mu.Unlock()
+	from := start.Add(time.Duration(2*auditCheckpointInterval-10) * time.Second).Format(time.RFC3339)
+	status, response := doRequest(t, server, "admin", http.MethodGet, "/audit?from="+from, "")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", status, response)
+	}
+	if !strings.Contains(response, `"verified":true`) {
+		t.Fatalf("expected the events to be verified: %s", response)
+	}
+	memory.mu.Lock()
+	read := memory.read
+	// tampering within the window is detected
+	tampered := memory.events[2*auditCheckpointInterval-5]
+	tampered.Action = "delete"
+	memory.events[tampered.Sequence] = tampered
+	memory.mu.Unlock()
+	if read > auditCheckpointInterval {
+		t.Fatalf("expected the query to start at the checkpoint, read %d events", read)
+	}
+
+	_, response = doRequest(t, server, "admin", http.MethodGet, "/audit?from="+from, "")
+	if !strings.Contains(response, fmt.Sprintf(`"broken_at":%d`, tampered.Sequence)) {
+		t.Fatalf("expected the chain to break at %d: %s", tampered.Sequence, response)
+	}
+}
+
+func TestAuditRecordsSubjects(t *testing.T) {
+	memory := newMemoryAudit()
+	backend := NewBackend(memory, &Options{
+		EncryptionKey: []byte("SecretKeyHereThisIsUsedForEncryption"),
+		Authenticator: nameAuthenticator{},
+		Audit:         true,
+		Admins:        []string{"hsdp:admin"},
+	})
+	server := httptest.NewServer(backend.Handler())
+	t.Cleanup(server.Close)
+
+	// two identities with the same display name
+	for _, subject := range []string{"hsdp:alice", "htpasswd:alice"} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/prod", strings.NewReader(testState(1)))
+		req.Header.Set("X-Subject", subject)
+		req.Header.Set("X-Name", "alice")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	_ = backend.Close()
+
+	status, body := doRequest(t, server, "hsdp:admin", http.MethodGet, "/audit?subject=htpasswd:alice", "")
+	var response auditResponse
+	if err := json.Unmarshal([]byte(body), &response); err != nil || status != http.StatusOK {
+		t.Fatalf("expected the audit events, got %d %s", status, body)
+	}
+	if len(response.Events) != 1 {
+		t.Fatalf("expected one event of the subject, got %+v", response.Events)
+	}
+	if event := response.Events[0]; event.Subject != "htpasswd:alice" || event.Identity != "alice" || event.Action != "write" {
+		t.Fatalf("expected the write of htpasswd:alice, got %+v", event)
+	}
+}
+
+func TestEventAccessExpires(t *testing.T) {
+	_, backend, memory := newTestServer(t)
+	bob := &auth.Identity{Subject: "bob", Name: "bob", Provider: "test"}
+	memory.grants["alice"] = []types.Grant{{Path: "prod", Grantee: "bob", Permissions: []string{"read"}}}
+
+	decided := map[string]eventAccess{}
+	start := time.Now()
+	if !backend.streamReadable(bob, decided, "alice/prod", start) {
+		t.Fatal("expected the grantee to receive the events")
+	}
+	if backend.streamReadable(bob, decided, "alice/staging", start) {
+		t.Fatal("expected the events of other states to be withheld")
+	}
+
+	// the revoked grant applies once the decision expired
+	memory.grants["alice"] = nil
+	if !backend.streamReadable(bob, decided, "alice/prod", start.Add(eventAccessTTL/2)) {
+		t.Fatal("expected the access to be kept until it expires")
+	}
+	if backend.streamReadable(bob, decided, "alice/prod", start.Add(eventAccessTTL)) {
+		t.Fatal("expected the revoked grant to withhold the events")
+	}
+}
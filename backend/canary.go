@@ -0,0 +1,115 @@
+package backend
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	gocrypto "github.com/bhoriuchi/go-crypto"
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// canaryText is the known plaintext sealed in the canary object
+const canaryText = "terraform-backend-hsdp encryption key canary"
+
+// ErrKeyMismatch the encryption key does not decrypt the canary
+var ErrKeyMismatch = errors.New("encryption key does not match canary")
+
+// verifyCanary checks the encryption key against the canary in the store.
+// The canary is written with key when the store has none yet and key
+// decrypts the existing states.
+func (c *Backend) verifyCanary(key []byte) error {
+	canaryStore, ok := c.store.(store.Canary)
+	if !ok {
+		return nil
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("failed to get backend encryption key")
+	}
+
+	canary, err := canaryStore.GetCanary()
+	if err == store.ErrNotFound {
+		if err := c.writeCanary(canaryStore, key); err != store.ErrConflict {
+			return err
+		}
+		// another instance wrote the canary first
+		canary, err = canaryStore.GetCanary()
+	}
+	if err != nil {
+		return fmt.Errorf("get canary: %w", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(canary.EncryptedData)
+	if err != nil {
+		return fmt.Errorf("decode canary: %w", err)
+	}
+	decryptedData, err := gocrypto.Decrypt(key, data)
+	if err != nil || string(decryptedData) != canaryText {
+		return ErrKeyMismatch
+	}
+	return nil
+}
+
+// writeCanary writes the canary with key, the key must decrypt an existing
+// encrypted state so a wrong key is not taken for the right one on upgrade
+func (c *Backend) writeCanary(canaryStore store.Canary, key []byte) error {
+	if err := c.verifyExistingState(key); err != nil {
+		return err
+	}
+	encryptedData, err := gocrypto.Encrypt(key, []byte(canaryText))
+	if err != nil {
+		return err
+	}
+	c.options.Logger.Info("writing encryption key canary")
+	return canaryStore.PutCanary(types.EncryptedState{
+		EncryptedData: base64.StdEncoding.EncodeToString(encryptedData),
+	})
+}
+
+// verifyExistingState decrypts the first encrypted state of the store with
+// key, ErrKeyMismatch when it does not decrypt. Plaintext states are skipped
+// until an encrypted one is found, however many precede it.
+func (c *Backend) verifyExistingState(key []byte) error {
+	refs, err := c.store.GetStates("")
+	if err != nil {
+		return fmt.Errorf("list states: %w", err)
+	}
+	for _, ref := range refs {
+		state, encrypted, err := c.store.GetState(ref)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("get state %s: %w", ref, err)
+		}
+		if !encrypted {
+			continue
+		}
+		var encryptedState types.EncryptedState
+		if err := toInterface(state, &encryptedState); err != nil {
+			return fmt.Errorf("decode state %s: %w", ref, err)
+		}
+		data, err := base64.StdEncoding.DecodeString(encryptedState.EncryptedData)
+		if err != nil {
+			return fmt.Errorf("decode state %s: %w", ref, err)
+		}
+		if _, err := gocrypto.Decrypt(key, data); err != nil {
+			c.options.Logger.Error("encryption key does not decrypt existing state", "ref", ref, "error", err)
+			return ErrKeyMismatch
+		}
+		return nil
+	}
+	return nil
+}
+
+// determines if the backend accepts writes, responds when it does not
+func (c *Backend) canWrite(w http.ResponseWriter, r *http.Request, ref string) bool {
+	if !c.readOnly {
+		return true
+	}
+	c.logger(r).Debug("rejecting write in read-only mode", "ref", ref)
+	writeError(w, r, http.StatusServiceUnavailable, ErrCodeReadOnly, ref, "the backend is read-only as the encryption key does not match")
+	return false
+}
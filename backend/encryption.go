@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/glob"
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+)
+
+// EncryptionRule decides encryption for refs matching Pattern
+type EncryptionRule struct {
+	Pattern string
+	Encrypt bool
+}
+
+// EncryptionPolicy a list of encryption rules, the first matching rule
+// decides. Refs without a matching rule are encrypted.
+type EncryptionPolicy []EncryptionRule
+
+// ParseEncryptionPolicy parses a comma separated list of pattern=encrypt
+// or pattern=plaintext rules, e.g. "*/sandbox/**=plaintext,**=encrypt"
+func ParseEncryptionPolicy(policy string) (EncryptionPolicy, error) {
+	var rules EncryptionPolicy
+	for _, rule := range strings.Split(policy, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		pattern, mode, found := strings.Cut(rule, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid encryption rule: %s", rule)
+		}
+		switch mode {
+		case "encrypt":
+			rules = append(rules, EncryptionRule{Pattern: pattern, Encrypt: true})
+		case "plaintext":
+			rules = append(rules, EncryptionRule{Pattern: pattern, Encrypt: false})
+		default:
+			return nil, fmt.Errorf("invalid encryption mode in rule: %s", rule)
+		}
+	}
+	return rules, nil
+}
+
+// Encrypt reports whether the state for ref should be encrypted
+func (p EncryptionPolicy) Encrypt(ref string) bool {
+	for _, rule := range p {
+		if glob.Match(rule.Pattern, ref) {
+			return rule.Encrypt
+		}
+	}
+	return true
+}
+
+// GetEncryptFunc returns the policy as a backend GetEncryptFunc
+func (p EncryptionPolicy) GetEncryptFunc() func(r *http.Request, ref string) bool {
+	return func(_ *http.Request, ref string) bool {
+		return p.Encrypt(ref)
+	}
+}
+
+// gets the encrypt state setting
+func (c *Backend) getEncrypt(r *http.Request, ref string) bool {
+	if c.options.GetEncryptFunc != nil {
+		return c.options.GetEncryptFunc(r, ref)
+	}
+	// Encrypt by default
+	return true
+}
+
+// determines if the current state of ref is encrypted
+func (c *Backend) isEncrypted(ref string) (bool, error) {
+	_, encrypted, err := c.store.GetState(ref)
+	if err == store.ErrNotFound {
+		return false, nil
+	}
+	return encrypted, err
+}
@@ -0,0 +1,86 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// Codes of JSON error responses
+const (
+	ErrCodeInvalidRequest   = "invalid_request"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeTooManyAttempts  = "too_many_attempts"
+	ErrCodeAuthUnavailable  = "auth_unavailable"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeConflict         = "conflict"
+	ErrCodeStateLocked      = "state_locked"
+	ErrCodeDecryptionFailed = "decryption_failed"
+	ErrCodeEncryptionFailed = "encryption_failed"
+	ErrCodeStoreUnavailable = "store_unavailable"
+	ErrCodeSealed           = "sealed"
+	ErrCodeReadOnly         = "read_only"
+	ErrCodeNotImplemented   = "not_implemented"
+	ErrCodeInternal         = "internal_error"
+)
+
+// ErrorResponse the JSON body of failed requests
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Ref       string `json:"ref,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// responds with a JSON error, ref is reported as the requested state path
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, ref, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(newErrorResponse(r, code, ref, message))
+}
+
+func newErrorResponse(r *http.Request, code, ref, message string) ErrorResponse {
+	response := ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: RequestID(r),
+	}
+	if ref != "" {
+		response.Ref = auth.StatePath(ref)
+	}
+	return response
+}
+
+// responds to a failed authentication or authorization
+func writeAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, auth.ErrForbidden):
+		writeError(w, r, http.StatusForbidden, ErrCodeForbidden, "", err.Error())
+	case errors.Is(err, auth.ErrInvalidPath):
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "", err.Error())
+	case errors.Is(err, auth.ErrLockedOut):
+		writeError(w, r, http.StatusTooManyRequests, ErrCodeTooManyAttempts, "", err.Error())
+	case errors.Is(err, auth.ErrUnavailable):
+		writeError(w, r, http.StatusServiceUnavailable, ErrCodeAuthUnavailable, "", "the identity provider is unavailable, retry later")
+	default:
+		writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "", "missing or invalid credentials")
+	}
+}
+
+// responds with the lock holding the state, terraform shows its fields
+func writeLockConflict(w http.ResponseWriter, r *http.Request, ref string, lock *types.Lock) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusLocked)
+	_ = json.NewEncoder(w).Encode(struct {
+		*types.Lock
+		ErrorResponse
+	}{
+		Lock:          lock,
+		ErrorResponse: newErrorResponse(r, ErrCodeStateLocked, ref, "the state is locked"),
+	})
+}
@@ -0,0 +1,175 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+	"github.com/loafoe/terraform-backend-hsdp/backend/webhook"
+)
+
+const (
+	// eventBufferSize events are buffered per subscriber before they are
+	// dropped
+	eventBufferSize = 64
+	// eventKeepAlive keeps idle event streams open through proxies
+	eventKeepAlive = 15 * time.Second
+	// eventAccessTTL is how long a stream keeps the access decided for a
+	// ref, so revoked grants and team roles apply to open streams
+	eventAccessTTL = 30 * time.Second
+)
+
+// eventBus fans the events of the handlers out to the subscribers of this
+// instance
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan types.Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: map[chan types.Event]struct{}{}}
+}
+
+// subscribe returns a channel receiving the published events
+func (b *eventBus) subscribe() chan types.Event {
+	events := make(chan types.Event, eventBufferSize)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[events] = struct{}{}
+	return events
+}
+
+func (b *eventBus) unsubscribe(events chan types.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, events)
+}
+
+// publish sends the event to every subscriber, it does not block and drops
+// the event for subscribers that do not keep up
+func (b *eventBus) publish(event types.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// publish sends the event of the request to the webhooks and the event
+// streams
+func (c *Backend) publish(r *http.Request, event types.Event) {
+	if info := getRequestInfo(r); info != nil && info.identity != nil && event.Identity == "" {
+		event.Identity = info.identity.Name
+	}
+	c.notify(c.logger(r), event)
+}
+
+// notify sends event to the webhooks and the event streams, logging
+// failures to logger
+func (c *Backend) notify(logger *slog.Logger, event types.Event) {
+	event.ID = webhook.NewID()
+	event.Time = time.Now().UTC()
+	if err := c.options.Webhooks.Notify(event); err != nil {
+		logger.Error("failed to notify webhooks", "event", event.Type, "ref", event.Ref, "error", err)
+	}
+	c.events.publish(event)
+}
+
+// determines if identity may read ref through its namespace, a team, a
+// grant or as backend administrator
+func (c *Backend) canRead(identity *auth.Identity, ref string) bool {
+	if identity == nil || c.isAdmin(identity) {
+		return true
+	}
+	return c.canAccess(identity, auth.Read, ref)
+}
+
+// eventAccess the access of a stream to a ref, decided at checked
+type eventAccess struct {
+	allowed bool
+	checked time.Time
+}
+
+// determines if the stream of identity may receive the events of ref,
+// deciding again once the access recorded in decided expired
+func (c *Backend) streamReadable(identity *auth.Identity, decided map[string]eventAccess, ref string, now time.Time) bool {
+	access, ok := decided[ref]
+	if !ok || now.Sub(access.checked) >= eventAccessTTL {
+		access = eventAccess{allowed: c.canRead(identity, ref), checked: now}
+		decided[ref] = access
+	}
+	return access.allowed
+}
+
+// HandleEvents streams the events of the states the caller may read as
+// server-sent events
+func (c *Backend) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if c.isSealed(w, r) {
+		return
+	}
+	var identity *auth.Identity
+	if c.options.Authenticator != nil {
+		var err error
+		if identity, err = c.authenticate(r); err != nil {
+			c.logger(r).Error("failed to authenticate request", "error", err)
+			writeAuthError(w, r, err)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		c.logger(r).Error("response writer does not support streaming")
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "", "streaming is not supported")
+		return
+	}
+	if err := c.Init(); err != nil {
+		c.logger(r).Error("failed to initialize terraform state backend", "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to initialize the backend")
+		return
+	}
+
+	events := c.events.subscribe()
+	defer c.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	c.logger(r).Debug("streaming events")
+
+	decided := map[string]eventAccess{}
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			if !c.streamReadable(identity, decided, event.Ref, time.Now()) {
+				continue
+			}
+			data, err := json.Marshal(&event)
+			if err != nil {
+				c.logger(r).Error("failed to marshal event", "event", event.Type, "ref", event.Ref, "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,44 @@
+// Package glob matches slash separated refs against glob patterns
+package glob
+
+import (
+	"path"
+	"strings"
+)
+
+// Match reports whether ref matches pattern. Pattern segments use the
+// path.Match syntax where `*` stays within a segment, a `**` segment
+// matches zero or more segments.
+func Match(pattern, ref string) bool {
+	return match(split(pattern), split(ref))
+}
+
+func match(pattern, ref []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(ref); i++ {
+				if match(pattern[1:], ref[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(ref) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], ref[0]); err != nil || !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		ref = ref[1:]
+	}
+	return len(ref) == 0
+}
+
+func split(s string) []string {
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "/")
+}
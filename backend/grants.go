@@ -0,0 +1,368 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// grantUpdateAttempts bounds the retries of grant updates conflicting with
+// concurrent ones
+const grantUpdateAttempts = 5
+
+// errGrantNotFound the grant to remove does not exist
+var errGrantNotFound = errors.New("grant not found")
+
+// normalizes a state path for grant matching
+func grantPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// determines if the grant gives identity, a member of groups, permission on
+// the state path
+func grantCovers(grant types.Grant, identity *auth.Identity, groups []string, p string, permission auth.Permission) bool {
+	if grant.Group {
+		member := false
+		for _, group := range groups {
+			if group == grant.Grantee {
+				member = true
+				break
+			}
+		}
+		if !member {
+			return false
+		}
+	} else if grant.Grantee != identity.Subject {
+		return false
+	}
+
+	p = grantPath(p)
+	if grant.Prefix {
+		if !auth.HasPathPrefix(p, grantPath(grant.Path)) {
+			return false
+		}
+	} else if p != grantPath(grant.Path) {
+		return false
+	}
+
+	for _, granted := range grant.Permissions {
+		if auth.Permission(granted).Includes(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// determines if identity has permission on the state path in the
+// namespace of owner through a grant
+func (c *Backend) granted(identity *auth.Identity, owner, p string, permission auth.Permission) (bool, error) {
+	grantStore, ok := c.store.(store.Grants)
+	if !ok {
+		return false, nil
+	}
+	if err := c.Init(); err != nil {
+		return false, err
+	}
+	grants, _, err := grantStore.GetGrants(owner)
+	if err != nil {
+		return false, err
+	}
+	groups, err := c.grantGroups(identity, grants)
+	if err != nil {
+		return false, err
+	}
+	for _, grant := range grants {
+		if grantCovers(grant, identity, groups, p, permission) {
+			return c.ownerAllows(owner, p, permission)
+		}
+	}
+	return false, nil
+}
+
+// determines if the roles of owner on the state path in its namespace
+// include permission, owners cannot grant more than their roles allow
+func (c *Backend) ownerAllows(owner, p string, permission auth.Permission) (bool, error) {
+	if c.options.Policy == nil {
+		return true, nil
+	}
+	namespace := &auth.Identity{Subject: owner, Name: owner}
+	ref, err := c.options.RefResolver(namespace, p)
+	if err != nil {
+		return false, err
+	}
+	return c.options.Policy.Allows(namespace, permission, ref)
+}
+
+// resolves the groups of identity through the group source when one of the
+// grants is for a group
+func (c *Backend) grantGroups(identity *auth.Identity, grants []types.Grant) ([]string, error) {
+	for _, grant := range grants {
+		if !grant.Group {
+			continue
+		}
+		if c.options.Groups == nil {
+			return identity.Groups, nil
+		}
+		groups, err := c.options.Groups.Groups(identity)
+		if err != nil {
+			return nil, fmt.Errorf("resolving groups of %s: %w", identity.Name, err)
+		}
+		return groups, nil
+	}
+	return nil, nil
+}
+
+// updateGrants applies update to the grants of owner, retrying when a
+// concurrent request changed them
+func (c *Backend) updateGrants(grantStore store.Grants, owner string, update func(grants []types.Grant) ([]types.Grant, error)) error {
+	for attempt := 0; attempt < grantUpdateAttempts; attempt++ {
+		grants, version, err := grantStore.GetGrants(owner)
+		if err != nil {
+			return err
+		}
+		updated, err := update(grants)
+		if err != nil {
+			return err
+		}
+		if err := grantStore.PutGrants(owner, updated, version); err != store.ErrConflict {
+			return err
+		}
+	}
+	return fmt.Errorf("update grants of %s: %w", owner, store.ErrConflict)
+}
+
+// lists the states of owner the caller has been granted read access to
+func (c *Backend) handleListGrantedStates(w http.ResponseWriter, r *http.Request, owner string) {
+	identity, err := c.authenticate(r)
+	if err == nil {
+		err = auth.ValidateOwner(owner)
+	}
+	if err != nil {
+		c.logger(r).Error("failed to authenticate request", "error", err)
+		writeAuthError(w, r, err)
+		return
+	}
+	if err := c.Init(); err != nil {
+		c.logger(r).Error("failed to initialize terraform state backend", "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to initialize the backend")
+		return
+	}
+
+	var grants []types.Grant
+	if grantStore, ok := c.store.(store.Grants); ok {
+		grants, _, err = grantStore.GetGrants(owner)
+	}
+	var groups []string
+	if err == nil {
+		groups, err = c.grantGroups(identity, grants)
+	}
+	var refs []string
+	if err == nil {
+		var ref string
+		ref, err = c.options.RefResolver(&auth.Identity{Subject: owner}, "/")
+		if err == nil {
+			refs, err = c.store.GetStates(ref)
+		}
+	}
+	if err != nil {
+		c.logger(r).Error("failed to retrieve list of states", "owner", owner, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to list states")
+		return
+	}
+
+	granted := []string{}
+	for _, stateRef := range refs {
+		state := auth.StatePath(stateRef)
+		if !identity.Scope.Allows(auth.Read, state) {
+			continue
+		}
+		if owner == identity.Subject {
+			granted = append(granted, state)
+			continue
+		}
+		for _, grant := range grants {
+			if grantCovers(grant, identity, groups, state, auth.Read) {
+				if allowed, err := c.ownerAllows(owner, state, auth.Read); err == nil && allowed {
+					granted = append(granted, state)
+				}
+				break
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(granted)
+}
+
+// authenticates a management request, scoped identities such as API
+// tokens cannot manage tokens or grants
+func (c *Backend) principal(w http.ResponseWriter, r *http.Request) (*auth.Identity, bool) {
+	identity, err := c.authenticate(r)
+	if err != nil {
+		c.logger(r).Error("failed to authenticate request", "error", err)
+		writeAuthError(w, r, err)
+		return nil, false
+	}
+	if identity.Scope != nil {
+		c.logger(r).Debug("scoped identity cannot manage tokens or grants")
+		writeError(w, r, http.StatusForbidden, ErrCodeForbidden, "", "scoped identities cannot manage tokens or grants")
+		return nil, false
+	}
+	if err := c.Init(); err != nil {
+		c.logger(r).Error("failed to initialize terraform state backend", "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to initialize the backend")
+		return nil, false
+	}
+	return identity, true
+}
+
+// authenticates a grant management request, owners manage their grants
+func (c *Backend) grantOwner(w http.ResponseWriter, r *http.Request) (*auth.Identity, store.Grants, bool) {
+	grantStore, ok := c.store.(store.Grants)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "the store does not support grants")
+		return nil, nil, false
+	}
+	identity, ok := c.principal(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	return identity, grantStore, true
+}
+
+// HandleListGrants lists the grants of the caller
+func (c *Backend) HandleListGrants(w http.ResponseWriter, r *http.Request) {
+	identity, grantStore, ok := c.grantOwner(w, r)
+	if !ok {
+		return
+	}
+
+	grants, _, err := grantStore.GetGrants(identity.Subject)
+	if err != nil {
+		c.logger(r).Error("failed to get grants", "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to get grants")
+		return
+	}
+	if grants == nil {
+		grants = []types.Grant{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(grants)
+}
+
+// HandleAddGrant adds or replaces a grant of the caller
+func (c *Backend) HandleAddGrant(w http.ResponseWriter, r *http.Request) {
+	identity, grantStore, ok := c.grantOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var grant types.Grant
+	if err := json.NewDecoder(r.Body).Decode(&grant); err != nil {
+		c.logger(r).Error("error decoding grant request body", "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "", "invalid grant request body")
+		return
+	}
+	grant.Path = grantPath(grant.Path)
+	valid := grant.Grantee != "" && len(grant.Permissions) > 0 && (grant.Prefix || grant.Path != "")
+	// every valid permission includes read
+	for _, permission := range grant.Permissions {
+		if !auth.Permission(permission).Includes(auth.Read) {
+			valid = false
+		}
+	}
+	if !valid {
+		c.logger(r).Error("invalid grant")
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "", "a grant needs a grantee, a path or prefix and read, lock, write or admin permissions")
+		return
+	}
+	for _, permission := range grant.Permissions {
+		allowed, err := c.ownerAllows(identity.Subject, grant.Path, auth.Permission(permission))
+		if err == nil && !allowed {
+			err = fmt.Errorf("%w: %s access to %s exceeds the roles of %s", auth.ErrForbidden, permission, grant.Path, identity.Name)
+		}
+		if err != nil {
+			c.logger(r).Error("failed to authorize grant", "path", grant.Path, "permission", permission, "error", err)
+			writeAuthError(w, r, err)
+			return
+		}
+	}
+
+	err := c.updateGrants(grantStore, identity.Subject, func(grants []types.Grant) ([]types.Grant, error) {
+		return append(removeGrant(grants, grant), grant), nil
+	})
+	if errors.Is(err, store.ErrConflict) {
+		c.logger(r).Error("failed to store grants", "error", err)
+		writeError(w, r, http.StatusConflict, ErrCodeConflict, "", "grants were changed concurrently, retry")
+		return
+	}
+	if err != nil {
+		c.logger(r).Error("failed to store grants", "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to store grants")
+		return
+	}
+	c.logger(r).Info("granted access", "path", grant.Path, "grantee", grant.Grantee, "permissions", grant.Permissions)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleRemoveGrant removes a grant of the caller
+func (c *Backend) HandleRemoveGrant(w http.ResponseWriter, r *http.Request) {
+	identity, grantStore, ok := c.grantOwner(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	grant := types.Grant{
+		Path:    grantPath(query.Get("path")),
+		Prefix:  query.Get("prefix") == "true",
+		Grantee: query.Get("grantee"),
+		Group:   query.Get("group") == "true",
+	}
+	err := c.updateGrants(grantStore, identity.Subject, func(grants []types.Grant) ([]types.Grant, error) {
+		remaining := removeGrant(grants, grant)
+		if len(remaining) == len(grants) {
+			return nil, errGrantNotFound
+		}
+		return remaining, nil
+	})
+	if err == errGrantNotFound {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "grant not found")
+		return
+	}
+	if errors.Is(err, store.ErrConflict) {
+		c.logger(r).Error("failed to store grants", "error", err)
+		writeError(w, r, http.StatusConflict, ErrCodeConflict, "", "grants were changed concurrently, retry")
+		return
+	}
+	if err != nil {
+		c.logger(r).Error("failed to store grants", "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to store grants")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// removes the grants for the same grantee and path
+func removeGrant(grants []types.Grant, grant types.Grant) []types.Grant {
+	var remaining []types.Grant
+	for _, g := range grants {
+		if g.Grantee == grant.Grantee && g.Group == grant.Group && g.Prefix == grant.Prefix && grantPath(g.Path) == grant.Path {
+			continue
+		}
+		remaining = append(remaining, g)
+	}
+	return remaining
+}
@@ -0,0 +1,165 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+)
+
+// apiPrefix starts the routes of the versioned REST API. Refs are a single
+// URL encoded path segment, e.g. /api/v1/states/prod%2Fnetwork/versions.
+const apiPrefix = "/api/v1"
+
+// reservedRoutes are the top-level routes served next to the terraform
+// protocol, states cannot take their paths
+var reservedRoutes = map[string]bool{
+	"audit":    true,
+	"events":   true,
+	"export":   true,
+	"grants":   true,
+	"healthz":  true,
+	"lockouts": true,
+	"metrics":  true,
+	"readyz":   true,
+	"states":   true,
+	"tokens":   true,
+	"transfer": true,
+	"unseal":   true,
+	"versions": true,
+}
+
+// validateStatePath rejects invalid state paths and those served by other
+// routes than the terraform protocol
+func validateStatePath(p string) error {
+	if err := auth.ValidatePath(p); err != nil {
+		return err
+	}
+	p = strings.TrimSuffix(p, "/")
+	api := strings.TrimPrefix(apiPrefix, "/")
+	if reservedRoutes[p] || p == api || strings.HasPrefix(p, api+"/") {
+		return fmt.Errorf("%w: %s is a reserved route", auth.ErrInvalidPath, p)
+	}
+	return nil
+}
+
+// methods dispatches requests to the handler of their method
+type methods map[string]http.HandlerFunc
+
+// ServeHTTP implements http.Handler
+func (m methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := m[r.Method]; ok {
+		handler(w, r)
+		return
+	}
+	allowed := make([]string, 0, len(m))
+	for method := range m {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "", r.Method+" is not allowed")
+}
+
+// Handler serves all backend routes through the middleware chain. Mount it
+// under a sub-path with http.StripPrefix.
+func (c *Backend) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/states", methods{
+		http.MethodGet: c.audited("list_states", c.HandleListStates),
+	})
+	mux.Handle("/versions", methods{
+		http.MethodGet:    c.audited("list_versions", c.HandleListVersions),
+		http.MethodDelete: c.audited("keep_versions", c.HandleKeepVersions),
+		"RETRIEVE":        c.audited("read_version", c.HandleRetrieveVersion),
+		http.MethodPut:    c.audited("restore_version", c.HandleRestoreVersion),
+	})
+	mux.Handle("/export", methods{
+		http.MethodGet: c.audited("export", c.HandleExportState),
+	})
+	mux.Handle("/transfer", methods{
+		http.MethodPost: c.audited("transfer", c.HandleTransferState),
+	})
+	mux.Handle("/tokens", methods{
+		http.MethodGet:    c.audited("list_tokens", c.HandleListTokens),
+		http.MethodPost:   c.audited("create_token", c.HandleCreateToken),
+		http.MethodDelete: c.audited("revoke_token", c.HandleRevokeToken),
+	})
+	mux.Handle("/grants", methods{
+		http.MethodGet:    c.audited("list_grants", c.HandleListGrants),
+		http.MethodPost:   c.audited("add_grant", c.HandleAddGrant),
+		http.MethodDelete: c.audited("remove_grant", c.HandleRemoveGrant),
+	})
+	mux.Handle("/lockouts", methods{
+		http.MethodGet:    c.audited("list_lockouts", c.HandleListLockouts),
+		http.MethodDelete: c.audited("clear_lockout", c.HandleClearLockout),
+	})
+	mux.Handle("/audit", methods{
+		http.MethodGet: c.audited("list_audit_events", c.HandleListAuditEvents),
+	})
+	mux.Handle("/events", methods{
+		http.MethodGet: c.audited("stream_events", c.HandleEvents),
+	})
+	// reserved when disabled, so it is not taken for a state
+	serveMetrics := func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "metrics are not enabled")
+	}
+	if c.options.Metrics != nil {
+		serveMetrics = c.options.Metrics.Handler().ServeHTTP
+	}
+	mux.Handle("/metrics", methods{
+		http.MethodGet: serveMetrics,
+	})
+	mux.Handle("/healthz", methods{
+		http.MethodGet: c.HandleHealthz,
+	})
+	mux.Handle("/readyz", methods{
+		http.MethodGet: c.HandleReadyz,
+	})
+	mux.Handle("/unseal", methods{
+		http.MethodGet:  c.HandleSealStatus,
+		http.MethodPost: c.audited("unseal", c.HandleUnseal),
+	})
+
+	// versioned REST API
+	mux.HandleFunc("GET "+apiPrefix+"/states", c.audited("list_states", c.HandleListStates))
+	mux.HandleFunc("GET "+apiPrefix+"/states/{ref}", c.audited("read", c.HandleGetState))
+	mux.HandleFunc("GET "+apiPrefix+"/states/{ref}/export", c.audited("export", c.HandleExportState))
+	mux.HandleFunc("POST "+apiPrefix+"/states/{ref}/transfer", c.audited("transfer", c.HandleTransferState))
+	mux.HandleFunc("GET "+apiPrefix+"/states/{ref}/versions", c.audited("list_versions", c.HandleListVersions))
+	mux.HandleFunc("DELETE "+apiPrefix+"/states/{ref}/versions", c.audited("keep_versions", c.HandleKeepVersions))
+	mux.HandleFunc("GET "+apiPrefix+"/states/{ref}/versions/{version}", c.audited("read_version", c.HandleRetrieveVersion))
+	mux.HandleFunc("POST "+apiPrefix+"/states/{ref}/versions/{version}/restore", c.audited("restore_version", c.HandleRestoreVersion))
+	mux.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "unknown API route")
+	})
+
+	// terraform http backend protocol
+	mux.Handle("/", methods{
+		"LOCK":            c.audited("lock", c.HandleLockState),
+		"UNLOCK":          c.audited("unlock", c.HandleUnlockState),
+		http.MethodGet:    c.audited("read", c.HandleGetState),
+		http.MethodPost:   c.audited("write", c.HandleUpdateState),
+		http.MethodDelete: c.audited("delete", c.HandleDeleteState),
+	})
+
+	chain := []Middleware{
+		c.RequestID,
+		c.Recover,
+		c.LogRequests,
+		c.Authenticate,
+	}
+	chain = append(chain, c.options.Middleware...)
+	// innermost to see the route matched by the mux
+	if c.options.Metrics != nil {
+		chain = append(chain, c.ObserveRequests)
+	}
+
+	var handler http.Handler = mux
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return handler
+}
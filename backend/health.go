@@ -0,0 +1,120 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+)
+
+const (
+	checkOK       = "ok"
+	checkDegraded = "degraded"
+	checkFailed   = "failed"
+)
+
+// HealthCheck the result of a single readiness check
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthStatus the readiness of the backend
+type HealthStatus struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+func newHealthCheck(name string, err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Name: name, Status: checkFailed, Error: err.Error()}
+	}
+	return HealthCheck{Name: name, Status: checkOK}
+}
+
+// checkStore verifies the store is reachable and its bucket exists
+func (c *Backend) checkStore() HealthCheck {
+	if err := c.store.Init(); err != nil {
+		return newHealthCheck("store", err)
+	}
+	healthStore, ok := c.store.(store.Health)
+	if !ok {
+		return newHealthCheck("store", nil)
+	}
+	return newHealthCheck("store", healthStore.Ping())
+}
+
+// checkCanary reports the verification of the encryption key against the
+// canary when the backend was initialized, probes do not read the canary. A
+// key mismatch served read-only is degraded rather than failed.
+func (c *Backend) checkCanary() HealthCheck {
+	if c.options.Sealer != nil && c.options.Sealer.Sealed() {
+		return HealthCheck{Name: "canary", Status: checkFailed, Error: "the backend is sealed"}
+	}
+	if err := c.Init(); err != nil {
+		return newHealthCheck("canary", err)
+	}
+	if c.readOnly {
+		return HealthCheck{Name: "canary", Status: checkDegraded, Error: ErrKeyMismatch.Error()}
+	}
+	return newHealthCheck("canary", nil)
+}
+
+// Health reports the readiness of the backend
+func (c *Backend) Health() HealthStatus {
+	status := HealthStatus{Status: checkOK}
+	status.Checks = append(status.Checks, c.checkStore())
+	if status.Checks[0].Status == checkOK {
+		status.Checks = append(status.Checks, c.checkCanary())
+	} else {
+		status.Checks = append(status.Checks, HealthCheck{Name: "canary", Status: checkFailed, Error: "store unavailable"})
+	}
+
+	names := make([]string, 0, len(c.options.ReadinessChecks))
+	for name := range c.options.ReadinessChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		status.Checks = append(status.Checks, newHealthCheck(name, c.options.ReadinessChecks[name]()))
+	}
+
+	for _, check := range status.Checks {
+		switch check.Status {
+		case checkFailed:
+			status.Status = checkFailed
+		case checkDegraded:
+			if status.Status == checkOK {
+				status.Status = checkDegraded
+			}
+		}
+	}
+	return status
+}
+
+// HandleHealthz reports the process is alive
+func (c *Backend) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(HealthStatus{Status: checkOK})
+}
+
+// HandleReadyz reports whether the backend can serve requests, a
+// degraded backend is ready
+func (c *Backend) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := c.Health()
+	code := http.StatusOK
+	if status.Status == checkFailed {
+		for _, check := range status.Checks {
+			if check.Status == checkFailed {
+				c.logger(r).Error("readiness check failed", "check", check.Name, "error", check.Error)
+			}
+		}
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+const (
+	// maxLockWait lock attempts waiting longer are forgotten
+	maxLockWait = time.Hour
+	// maxLockWaits bounds the lock attempts tracked
+	maxLockWaits = 10000
+)
+
+// lockWaits tracks the first conflict of lock attempts per ref and lock ID.
+// Terraform retries a lock with the same ID until it is acquired, the time
+// since the first conflict is how long the client waited.
+type lockWaits struct {
+	mu        sync.Mutex
+	conflicts map[string]time.Time
+}
+
+func lockWaitKey(ref, id string) string {
+	return ref + "\x00" + id
+}
+
+// conflict records the first conflict of the lock attempt
+func (l *lockWaits) conflict(ref, id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.conflicts == nil {
+		l.conflicts = map[string]time.Time{}
+	}
+	key := lockWaitKey(ref, id)
+	if _, ok := l.conflicts[key]; ok {
+		return
+	}
+	if len(l.conflicts) >= maxLockWaits {
+		for k, first := range l.conflicts {
+			if now.Sub(first) > maxLockWait {
+				delete(l.conflicts, k)
+			}
+		}
+		if len(l.conflicts) >= maxLockWaits {
+			return
+		}
+	}
+	l.conflicts[key] = now
+}
+
+// acquired returns how long the lock attempt waited, false when it did not
+// conflict
+func (l *lockWaits) acquired(ref, id string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := lockWaitKey(ref, id)
+	first, ok := l.conflicts[key]
+	if !ok {
+		return 0, false
+	}
+	delete(l.conflicts, key)
+	wait := time.Since(first)
+	return wait, wait <= maxLockWait
+}
+
+// lockIndex returns the lock fields kept in plaintext when locks are encrypted
+func lockIndex(lock types.Lock) types.Lock {
+	return types.Lock{
+		ID:        lock.ID,
+		Operation: lock.Operation,
+		Created:   lock.Created,
+		Version:   lock.Version,
+	}
+}
+
+// gets the lock, decrypting it when needed
+func (c *Backend) getLock(ref string) (*types.Lock, error) {
+	document, err := c.store.GetLock(ref)
+	if err != nil {
+		return nil, err
+	}
+	if !document.Encrypted {
+		return &document.Lock, nil
+	}
+
+	var lock types.Lock
+	if err := c.decrypt(document.EncryptedLock, &lock); err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// builds the lock document, encrypting the lock when configured
+func (c *Backend) lockDocument(lock types.Lock) (types.LockDocument, error) {
+	if !c.options.EncryptLocks {
+		return types.LockDocument{Lock: lock}, nil
+	}
+
+	encryptedLock, err := c.encrypt(lock)
+	if err != nil {
+		return types.LockDocument{}, err
+	}
+	return types.LockDocument{
+		Lock:          lockIndex(lock),
+		Encrypted:     true,
+		EncryptedLock: encryptedLock,
+	}, nil
+}
+
+// puts the lock, encrypting it when configured
+func (c *Backend) putLock(ref string, lock types.Lock) error {
+	document, err := c.lockDocument(lock)
+	if err != nil {
+		return err
+	}
+	return c.store.PutLock(ref, document)
+}
@@ -0,0 +1,74 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+)
+
+// reports whether the identity administers the backend
+func (c *Backend) isAdmin(identity *auth.Identity) bool {
+	for _, admin := range c.options.Admins {
+		if admin == identity.Subject {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticates a backend administration request
+func (c *Backend) admin(w http.ResponseWriter, r *http.Request) (*auth.Identity, bool) {
+	identity, ok := c.principal(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !c.isAdmin(identity) {
+		c.logger(r).Warn("not a backend administrator")
+		writeError(w, r, http.StatusForbidden, ErrCodeForbidden, "", "not a backend administrator")
+		return nil, false
+	}
+	return identity, true
+}
+
+// HandleListLockouts lists the failed authentication counters and totals
+func (c *Backend) HandleListLockouts(w http.ResponseWriter, r *http.Request) {
+	if c.options.Throttle == nil {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "lockouts are not enabled")
+		return
+	}
+	if _, ok := c.admin(w, r); !ok {
+		return
+	}
+
+	response := struct {
+		auth.ThrottleStats
+		Lockouts []auth.Lockout `json:"lockouts"`
+	}{
+		ThrottleStats: c.options.Throttle.Stats(),
+		Lockouts:      c.options.Throttle.Lockouts(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// HandleClearLockout resets the counter of the key query parameter, e.g.
+// user:alice or ip:10.0.0.1, or all counters without it
+func (c *Backend) HandleClearLockout(w http.ResponseWriter, r *http.Request) {
+	if c.options.Throttle == nil {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "lockouts are not enabled")
+		return
+	}
+	if _, ok := c.admin(w, r); !ok {
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if !c.options.Throttle.Clear(key) {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "lockout not found")
+		return
+	}
+	c.logger(r).Info("cleared lockout", "lockout", key)
+	w.WriteHeader(http.StatusNoContent)
+}
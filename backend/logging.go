@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// redacted replaces the value of sensitive log attributes
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are log attribute keys whose values are never logged
+var sensitiveKeys = map[string]bool{
+	"authorization": true,
+	"credentials":   true,
+	"key":           true,
+	"password":      true,
+	"secret":        true,
+	"share":         true,
+	"state":         true,
+	"token":         true,
+}
+
+// redactHandler removes credentials and state content from log records
+type redactHandler struct {
+	slog.Handler
+}
+
+// NewRedactHandler wraps h to redact the values of sensitive attributes
+// and credentials passed as attribute values
+func NewRedactHandler(h slog.Handler) slog.Handler {
+	if _, ok := h.(*redactHandler); ok {
+		return h
+	}
+	return &redactHandler{Handler: h}
+}
+
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redactedRecord := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redactedRecord.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return h.Handler.Handle(ctx, redactedRecord)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		redactedAttrs = append(redactedAttrs, redactAttr(attr))
+	}
+	return &redactHandler{Handler: h.Handler.WithAttrs(redactedAttrs)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// redactAttr redacts attr, the attributes of groups are redacted recursively
+func redactAttr(attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindGroup:
+		groupAttrs := value.Group()
+		redactedAttrs := make([]any, 0, len(groupAttrs))
+		for _, groupAttr := range groupAttrs {
+			redactedAttrs = append(redactedAttrs, redactAttr(groupAttr))
+		}
+		return slog.Group(attr.Key, redactedAttrs...)
+	case slog.KindString:
+		if isCredential(value.String()) {
+			return slog.String(attr.Key, redacted)
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
+
+// isCredential determines if s is an Authorization header value
+func isCredential(s string) bool {
+	scheme, _, found := strings.Cut(s, " ")
+	if !found {
+		return false
+	}
+	return strings.EqualFold(scheme, "Basic") || strings.EqualFold(scheme, "Bearer")
+}
+
+// logger returns the logger with the request ID and identity of r
+func (c *Backend) logger(r *http.Request) *slog.Logger {
+	info := getRequestInfo(r)
+	if info == nil {
+		return c.options.Logger
+	}
+	logger := c.options.Logger.With("request_id", info.id)
+	if info.identity != nil {
+		logger = logger.With("identity", info.identity.Name)
+	}
+	return logger
+}
@@ -0,0 +1,245 @@
+// Package metrics exports backend metrics to Prometheus
+package metrics
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+)
+
+const namespace = "tfstate"
+
+// staleLockAge the age in days of locks counted as stale
+const staleLockAge = 1
+
+// Metrics the backend collectors. A nil *Metrics records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	lockConflicts   *prometheus.CounterVec
+	lockWait        prometheus.Histogram
+	lockHeld        prometheus.Histogram
+	cryptoFailures  *prometheus.CounterVec
+	storeDuration   *prometheus.HistogramVec
+
+	states     prometheus.Gauge
+	locks      prometheus.Gauge
+	staleLocks prometheus.Gauge
+	identities prometheus.Gauge
+	statsTime  prometheus.Gauge
+}
+
+// New creates the collectors in their own registry
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status.",
+		}, []string{"handler", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"handler", "method"}),
+		lockConflicts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "lock_conflicts_total",
+			Help:      "Requests rejected because another process holds the lock, by operation.",
+		}, []string{"operation"}),
+		lockWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "lock_wait_seconds",
+			Help:      "How long clients retried a lock held by another process until they acquired it.",
+			Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+		}),
+		lockHeld: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "lock_held_seconds",
+			Help:      "How long state locks were held until unlocked.",
+			Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+		}),
+		cryptoFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "crypto_failures_total",
+			Help:      "Failed encryptions and decryptions.",
+		}, []string{"operation"}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "store_operation_duration_seconds",
+			Help:      "Latency of S3 store operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		states: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "states",
+			Help:      "Stored states.",
+		}),
+		locks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "locks",
+			Help:      "Locked states.",
+		}),
+		staleLocks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stale_locks",
+			Help:      "States locked for more than a day.",
+		}),
+		identities: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "identities",
+			Help:      "Identities owning states.",
+		}),
+		statsTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stats_last_success_timestamp_seconds",
+			Help:      "When the store statistics were last collected.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.requestDuration,
+		m.lockConflicts, m.lockWait, m.lockHeld, m.cryptoFailures,
+		m.storeDuration,
+		m.states, m.locks, m.staleLocks, m.identities, m.statsTime,
+	)
+	return m
+}
+
+// Registry the registry to add further collectors to
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// RegisterThrottle exports the failed authentication totals of throttle
+func (m *Metrics) RegisterThrottle(throttle *auth.Throttle) {
+	m.registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_failures_total",
+			Help:      "Failed authentication attempts.",
+		}, func() float64 {
+			return float64(throttle.Stats().FailedAttempts)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_lockouts_total",
+			Help:      "Usernames and source addresses locked out after failed attempts.",
+		}, func() float64 {
+			return float64(throttle.Stats().Lockouts)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_rejected_total",
+			Help:      "Requests rejected while locked out.",
+		}, func() float64 {
+			return float64(throttle.Stats().Rejected)
+		}),
+	)
+}
+
+// Handler serves the metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest records a served request, handler is the matched route
+func (m *Metrics) ObserveRequest(handler, method string, status int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	if handler == "" {
+		handler = "unmatched"
+	}
+	m.requests.WithLabelValues(handler, method, strconv.Itoa(status)).Inc()
+	m.requestDuration.WithLabelValues(handler, method).Observe(duration.Seconds())
+}
+
+// LockConflict records a request rejected by the lock of another process
+func (m *Metrics) LockConflict(operation string) {
+	if m == nil {
+		return
+	}
+	m.lockConflicts.WithLabelValues(operation).Inc()
+}
+
+// LockAcquired records how long a client waited for a lock after its first
+// conflict
+func (m *Metrics) LockAcquired(wait time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lockWait.Observe(wait.Seconds())
+}
+
+// LockReleased records how long a lock was held
+func (m *Metrics) LockReleased(held time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lockHeld.Observe(held.Seconds())
+}
+
+// CryptoFailure records a failed encrypt or decrypt operation
+func (m *Metrics) CryptoFailure(operation string) {
+	if m == nil {
+		return
+	}
+	m.cryptoFailures.WithLabelValues(operation).Inc()
+}
+
+// ObserveStore records the latency of a store operation
+func (m *Metrics) ObserveStore(operation string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.storeDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
+
+// CollectStats updates the store gauges every interval, it does not return
+func (m *Metrics) CollectStats(stats store.Stats, interval time.Duration, logger *slog.Logger) {
+	for {
+		if err := m.collectStats(stats); err != nil {
+			logger.Error("failed to collect store statistics", "error", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (m *Metrics) collectStats(stats store.Stats) error {
+	states, err := stats.States()
+	if err != nil {
+		return err
+	}
+	locks, err := stats.Locks(0)
+	if err != nil {
+		return err
+	}
+	staleLocks, err := stats.Locks(staleLockAge)
+	if err != nil {
+		return err
+	}
+	identities, err := stats.Identities()
+	if err != nil {
+		return err
+	}
+	m.states.Set(float64(states))
+	m.locks.Set(float64(locks))
+	m.staleLocks.Set(float64(staleLocks))
+	m.identities.Set(float64(identities))
+	m.statsTime.SetToCurrentTime()
+	return nil
+}
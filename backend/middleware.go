@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+)
+
+// Middleware wraps a handler, e.g. to add cross-cutting behaviour to all routes
+type Middleware func(next http.Handler) http.Handler
+
+// RequestIDHeader carries the request ID, an incoming one is kept
+const RequestIDHeader = "X-Request-Id"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type contextKey int
+
+const requestInfoKey contextKey = iota
+
+// requestInfo per request state shared by the middleware and handlers
+type requestInfo struct {
+	id            string
+	authenticated bool
+	identity      *auth.Identity
+	authErr       error
+	// details of the action recorded in the audit log
+	ref     string
+	lockID  string
+	version string
+}
+
+// the request info of r, nil outside of the Handler
+func getRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// setRef records the ref resolved for the request
+func (info *requestInfo) setRef(ref string) {
+	if info != nil {
+		info.ref = ref
+	}
+}
+
+// setLockID records the lock ID of the request
+func (info *requestInfo) setLockID(id string) {
+	if info != nil && id != "" {
+		info.lockID = id
+	}
+}
+
+// setVersion records the state version written or read by the request
+func (info *requestInfo) setVersion(version string) {
+	if info != nil {
+		info.version = version
+	}
+}
+
+// RequestID returns the ID of the request, empty outside of the Handler
+func RequestID(r *http.Request) string {
+	if info := getRequestInfo(r); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// statusRecorder records the status written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher for streaming responses
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Recover turns panics of handlers into a 500 response
+func (c *Backend) Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				c.logger(r).Error("panic serving request", "method", r.Method, "path", r.URL.Path, "panic", recovered, "stack", string(debug.Stack()))
+				writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "", "internal error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequestID assigns every request an ID, returned in the X-Request-Id header
+func (c *Backend) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			random := make([]byte, 16)
+			_, _ = rand.Read(random)
+			id = hex.EncodeToString(random)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestInfoKey, &requestInfo{id: id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// LogRequests logs the operation, path, ref, status and latency of every request
+func (c *Backend) LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []any{"operation", r.Method, "path", r.URL.Path}
+		if info := getRequestInfo(r); info != nil && info.ref != "" {
+			attrs = append(attrs, "ref", info.ref)
+		}
+		attrs = append(attrs, "status", status, "latency", time.Since(start))
+		c.logger(r).Info("request", attrs...)
+	})
+}
+
+// ObserveRequests records request metrics per matched route
+func (c *Backend) ObserveRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		c.options.Metrics.ObserveRequest(r.Pattern, r.Method, status, time.Since(start))
+	})
+}
+
+// Authenticate authenticates every request once, handlers authorize the
+// identity. Failures are left to the handlers as some routes need no
+// authentication.
+func (c *Backend) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := getRequestInfo(r); info != nil && c.options.Authenticator != nil {
+			info.identity, info.authErr = c.options.Authenticator.Authenticate(r)
+			info.authenticated = true
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,139 @@
+package seal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrDuplicateShare the share was already submitted
+	ErrDuplicateShare = errors.New("share already submitted")
+	// ErrUnknownShare the share does not match any of the share hashes
+	ErrUnknownShare = errors.New("unknown key share")
+	// ErrKeyRejected the reconstructed key failed verification
+	ErrKeyRejected = errors.New("reconstructed key rejected")
+)
+
+// HashShare returns the hex SHA-256 of a key share, the sealer only accepts
+// shares with a known hash
+func HashShare(share []byte) string {
+	sum := sha256.Sum256(share)
+	return hex.EncodeToString(sum[:])
+}
+
+// Status seal status
+type Status struct {
+	Sealed    bool `json:"sealed"`
+	Threshold int  `json:"threshold"`
+	Progress  int  `json:"progress"`
+}
+
+// NewSealer creates a sealed key holder which needs threshold of the shares
+// with the given hashes to unseal. The threshold must be at least 2, as for
+// Split, and cannot exceed the number of distinct hashes.
+func NewSealer(threshold int, shareHashes []string) (*Sealer, error) {
+	hashes := make(map[string]bool, len(shareHashes))
+	for _, hash := range shareHashes {
+		hashes[hash] = true
+	}
+	if threshold < 2 {
+		return nil, errors.New("threshold must be at least 2")
+	}
+	if len(hashes) < threshold {
+		return nil, fmt.Errorf("threshold %d exceeds the %d share hashes", threshold, len(hashes))
+	}
+	return &Sealer{
+		threshold: threshold,
+		hashes:    hashes,
+	}, nil
+}
+
+// Sealer holds the encryption key once it is reconstructed from key shares
+type Sealer struct {
+	mu        sync.RWMutex
+	threshold int
+	hashes    map[string]bool
+	shares    map[string][]byte
+	key       []byte
+}
+
+// Key returns the encryption key, or nil while sealed. It is meant to be
+// used as the backend EncryptionKey provider.
+func (s *Sealer) Key() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.key
+}
+
+// Sealed reports if the key is not available
+func (s *Sealer) Sealed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.key == nil
+}
+
+// Status returns the seal status
+func (s *Sealer) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return Status{
+		Sealed:    s.key == nil,
+		Threshold: s.threshold,
+		Progress:  len(s.shares),
+	}
+}
+
+// Unseal submits a key share. The key is reconstructed once the threshold
+// is reached and only becomes available when verify accepts it, the
+// returned status reports if that happened. Unknown shares are rejected
+// without affecting the progress.
+func (s *Sealer) Unseal(share []byte, verify func(key []byte) error) (Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.key != nil {
+		return Status{Threshold: s.threshold}, nil
+	}
+	hash := HashShare(share)
+	if !s.hashes[hash] {
+		return Status{Sealed: true, Threshold: s.threshold, Progress: len(s.shares)}, ErrUnknownShare
+	}
+	if _, ok := s.shares[hash]; ok {
+		return Status{Sealed: true, Threshold: s.threshold, Progress: len(s.shares)}, ErrDuplicateShare
+	}
+	if s.shares == nil {
+		s.shares = map[string][]byte{}
+	}
+	s.shares[hash] = append([]byte(nil), share...)
+	if len(s.shares) < s.threshold {
+		return Status{Sealed: true, Threshold: s.threshold, Progress: len(s.shares)}, nil
+	}
+
+	shares := make([][]byte, 0, len(s.shares))
+	for _, share := range s.shares {
+		shares = append(shares, share)
+	}
+	s.shares = nil
+	key, err := Combine(shares)
+	if err != nil {
+		return Status{Sealed: true, Threshold: s.threshold}, err
+	}
+	if verify != nil {
+		if err := verify(key); err != nil {
+			return Status{Sealed: true, Threshold: s.threshold}, fmt.Errorf("%w: %w", ErrKeyRejected, err)
+		}
+	}
+	s.key = key
+	return Status{Threshold: s.threshold}, nil
+}
+
+// Seal discards the key and any submitted shares
+func (s *Sealer) Seal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = nil
+	s.shares = nil
+}
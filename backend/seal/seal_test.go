@@ -0,0 +1,25 @@
+package seal
+
+import (
+	"testing"
+)
+
+func TestNewSealerRejectsThreshold(t *testing.T) {
+	hashes := []string{HashShare([]byte("a")), HashShare([]byte("b")), HashShare([]byte("c"))}
+	for name, tt := range map[string]struct {
+		threshold int
+		hashes    []string
+	}{
+		"threshold of one":  {1, hashes},
+		"threshold of zero": {0, hashes},
+		"too few hashes":    {4, hashes},
+		"duplicate hashes":  {3, []string{hashes[0], hashes[0], hashes[1]}},
+	} {
+		if _, err := NewSealer(tt.threshold, tt.hashes); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := NewSealer(3, hashes); err != nil {
+		t.Fatalf("expected a threshold of all shares to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package seal
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Shares produced by Split carry their x coordinate as the last byte, the
+// remaining bytes are the polynomial values for each byte of the secret.
+
+// Split divides secret into parts shares of which threshold are needed to
+// reconstruct it using Shamir's secret sharing over GF(2^8)
+func Split(secret []byte, parts, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	if threshold < 2 {
+		return nil, errors.New("threshold must be at least 2")
+	}
+	if parts < threshold {
+		return nil, errors.New("parts cannot be less than threshold")
+	}
+	if parts > 255 {
+		return nil, errors.New("parts cannot exceed 255")
+	}
+
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = uint8(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for idx, b := range secret {
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, fmt.Errorf("generating coefficients: %w", err)
+		}
+		coefficients[0] = b
+		for i := range shares {
+			shares[i][idx] = evaluate(coefficients, uint8(i+1))
+		}
+	}
+	return shares, nil
+}
+
+// Combine reconstructs the secret from a threshold of shares. Combining
+// too few or unrelated shares yields a wrong secret, not an error.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are required")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("shares are too short")
+	}
+	xs := make([]byte, len(shares))
+	seen := make(map[byte]bool, len(shares))
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, errors.New("all shares must be the same length")
+		}
+		x := share[size-1]
+		if x == 0 || seen[x] {
+			return nil, errors.New("duplicate or invalid share")
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret := make([]byte, size-1)
+	ys := make([]byte, len(shares))
+	for idx := range secret {
+		for i, share := range shares {
+			ys[i] = share[idx]
+		}
+		secret[idx] = interpolate(xs, ys)
+	}
+	return secret, nil
+}
+
+// evaluate the polynomial at x using Horner's method
+func evaluate(coefficients []byte, x uint8) uint8 {
+	var result uint8
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = mult(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// interpolate evaluates the Lagrange polynomial through the points at x=0
+func interpolate(xs, ys []byte) uint8 {
+	var result uint8
+	for i := range xs {
+		basis := uint8(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			basis = mult(basis, div(xs[j], xs[i]^xs[j]))
+		}
+		result ^= mult(basis, ys[i])
+	}
+	return result
+}
+
+// mult multiplies in GF(2^8) with the AES reduction polynomial
+func mult(a, b uint8) uint8 {
+	var result uint8
+	for i := 0; i < 8; i++ {
+		result ^= a & -(b & 1)
+		b >>= 1
+		a = (a << 1) ^ (0x1b & -(a >> 7))
+	}
+	return result
+}
+
+// div divides in GF(2^8), b must not be zero
+func div(a, b uint8) uint8 {
+	// b^254 is the multiplicative inverse of b
+	inverse := b
+	for i := 0; i < 253; i++ {
+		inverse = mult(inverse, b)
+	}
+	return mult(a, inverse)
+}
@@ -0,0 +1,121 @@
+package seal
+
+import (
+	"bytes"
+	"testing"
+)
+
+// subsets returns the index subsets of n elements with size elements
+func subsets(n, size int) [][]int {
+	if size == 0 {
+		return [][]int{{}}
+	}
+	var result [][]int
+	for first := 0; first <= n-size; first++ {
+		for _, rest := range subsets(n-first-1, size-1) {
+			subset := []int{first}
+			for _, i := range rest {
+				subset = append(subset, first+1+i)
+			}
+			result = append(result, subset)
+		}
+	}
+	return result
+}
+
+func pick(shares [][]byte, subset []int) [][]byte {
+	picked := make([][]byte, 0, len(subset))
+	for _, i := range subset {
+		picked = append(picked, shares[i])
+	}
+	return picked
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("SecretKeyHereThisIsUsedForEncryption")
+	for _, tt := range []struct{ parts, threshold int }{{2, 2}, {3, 2}, {5, 3}, {6, 6}} {
+		shares, err := Split(secret, tt.parts, tt.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shares) != tt.parts {
+			t.Fatalf("expected %d shares, got %d", tt.parts, len(shares))
+		}
+		for size := tt.threshold; size <= tt.parts; size++ {
+			for _, subset := range subsets(tt.parts, size) {
+				combined, err := Combine(pick(shares, subset))
+				if err != nil {
+					t.Fatalf("%d of %d: combining %v: %v", tt.threshold, tt.parts, subset, err)
+				}
+				if !bytes.Equal(combined, secret) {
+					t.Fatalf("%d of %d: shares %v do not recover the secret", tt.threshold, tt.parts, subset)
+				}
+			}
+		}
+		if tt.threshold < 3 {
+			continue
+		}
+		for _, subset := range subsets(tt.parts, tt.threshold-1) {
+			combined, err := Combine(pick(shares, subset))
+			if err != nil {
+				t.Fatalf("%d of %d: combining %v: %v", tt.threshold, tt.parts, subset, err)
+			}
+			if bytes.Equal(combined, secret) {
+				t.Fatalf("%d of %d: shares %v below the threshold recover the secret", tt.threshold, tt.parts, subset)
+			}
+		}
+	}
+}
+
+func TestCombineRejectsShares(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := append([]byte(nil), shares[1]...)
+	zero[len(zero)-1] = 0
+	for name, invalid := range map[string][][]byte{
+		"single share":    {shares[0]},
+		"duplicate share": {shares[0], shares[0]},
+		"duplicate x":     {shares[0], append(append([]byte(nil), shares[1][:len(shares[1])-1]...), shares[0][len(shares[0])-1])},
+		"zero x":          {shares[0], zero},
+		"length mismatch": {shares[0], shares[1][1:]},
+	} {
+		if _, err := Combine(invalid); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSplitRejectsParameters(t *testing.T) {
+	for name, tt := range map[string]struct {
+		secret           []byte
+		parts, threshold int
+	}{
+		"empty secret":     {nil, 3, 2},
+		"threshold of one": {[]byte("secret"), 3, 1},
+		"parts below":      {[]byte("secret"), 2, 3},
+		"too many parts":   {[]byte("secret"), 256, 2},
+	} {
+		if _, err := Split(tt.secret, tt.parts, tt.threshold); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := mult(uint8(a), div(1, uint8(a))); got != 1 {
+			t.Fatalf("%d times its inverse is %d", a, got)
+		}
+		for _, b := range []uint8{1, 2, 0x53, 0xca, 0xff} {
+			if got := div(mult(uint8(a), b), b); got != uint8(a) {
+				t.Fatalf("%d * %d / %d is %d", a, b, b, got)
+			}
+		}
+	}
+	// the AES field example, 0x53 and 0xca are inverses
+	if got := mult(0x53, 0xca); got != 1 {
+		t.Fatalf("expected 0x53 * 0xca to be 1, got %#x", got)
+	}
+}
@@ -0,0 +1,226 @@
+package backend
+
+import (
+	"net/http"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// redactedValue replaces sensitive values in exported states
+const redactedValue = "(sensitive value)"
+
+const (
+	// protectedValueKey holds the encrypted value of an envelope
+	protectedValueKey = "tfstate_protected_value"
+	// protectedVersionKey marks a map as envelope, so user maps with only
+	// a protectedValueKey are left alone
+	protectedVersionKey = "tfstate_protected_version"
+	protectedVersion    = 1
+)
+
+// sensitiveValue wraps a value before encryption, the cipher rejects
+// payloads shorter than 17 bytes which short values would be
+type sensitiveValue struct {
+	Value interface{} `json:"sensitive_value"`
+}
+
+// walkSensitive replaces every value Terraform marked as sensitive in a v4
+// state, i.e. sensitive outputs and the sensitive_attributes of instances,
+// with the result of fn
+func walkSensitive(state map[string]interface{}, fn func(value interface{}) (interface{}, error)) error {
+	if outputs, ok := state["outputs"].(map[string]interface{}); ok {
+		for _, o := range outputs {
+			output, ok := o.(map[string]interface{})
+			if !ok || output["sensitive"] != true || output["value"] == nil {
+				continue
+			}
+			value, err := fn(output["value"])
+			if err != nil {
+				return err
+			}
+			output["value"] = value
+		}
+	}
+
+	resources, _ := state["resources"].([]interface{})
+	for _, r := range resources {
+		resource, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		instances, _ := resource["instances"].([]interface{})
+		for _, i := range instances {
+			instance, ok := i.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			paths, _ := instance["sensitive_attributes"].([]interface{})
+			for _, p := range paths {
+				steps, ok := p.([]interface{})
+				if !ok {
+					continue
+				}
+				attributes, err := applyPath(instance["attributes"], steps, fn)
+				if err != nil {
+					return err
+				}
+				instance["attributes"] = attributes
+			}
+		}
+	}
+	return nil
+}
+
+// applyPath applies fn to the value at the cty path steps within value
+func applyPath(value interface{}, steps []interface{}, fn func(value interface{}) (interface{}, error)) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if len(steps) == 0 {
+		if isProtected(value) {
+			return value, nil
+		}
+		return fn(value)
+	}
+	step, _ := steps[0].(map[string]interface{})
+
+	switch step["type"] {
+	case "get_attr":
+		name, _ := step["value"].(string)
+		container, ok := value.(map[string]interface{})
+		if !ok {
+			return value, nil
+		}
+		child, err := applyPath(container[name], steps[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		if child != nil {
+			container[name] = child
+		}
+	case "index":
+		key, _ := step["value"].(map[string]interface{})
+		switch container := value.(type) {
+		case map[string]interface{}:
+			name, ok := key["value"].(string)
+			if !ok {
+				return value, nil
+			}
+			child, err := applyPath(container[name], steps[1:], fn)
+			if err != nil {
+				return nil, err
+			}
+			if child != nil {
+				container[name] = child
+			}
+		case []interface{}:
+			index, ok := key["value"].(float64)
+			if !ok || index < 0 || int(index) >= len(container) {
+				return value, nil
+			}
+			child, err := applyPath(container[int(index)], steps[1:], fn)
+			if err != nil {
+				return nil, err
+			}
+			container[int(index)] = child
+		}
+	}
+	return value, nil
+}
+
+// walkProtected replaces every protected value envelope in value with the
+// result of fn
+func walkProtected(value interface{}, fn func(protected types.ProtectedValue) (interface{}, error)) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if isProtected(v) {
+			return fn(types.ProtectedValue{EncryptedData: v[protectedValueKey].(string)})
+		}
+		for key, child := range v {
+			replaced, err := walkProtected(child, fn)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = replaced
+		}
+	case []interface{}:
+		for i, child := range v {
+			replaced, err := walkProtected(child, fn)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = replaced
+		}
+	}
+	return value, nil
+}
+
+// isProtected determines if value is a protected value envelope
+func isProtected(value interface{}) bool {
+	m, ok := value.(map[string]interface{})
+	if !ok || len(m) != 2 {
+		return false
+	}
+	if _, ok := m[protectedValueKey].(string); !ok {
+		return false
+	}
+	version, ok := m[protectedVersionKey].(float64)
+	return ok && version == protectedVersion
+}
+
+// protects the sensitive values of the state by encrypting them separately
+func (c *Backend) protectSensitive(state map[string]interface{}) error {
+	return walkSensitive(state, func(value interface{}) (interface{}, error) {
+		encryptedData, err := c.encrypt(sensitiveValue{Value: value})
+		if err != nil {
+			return nil, err
+		}
+		var protected map[string]interface{}
+		if err := toInterface(types.ProtectedValue{EncryptedData: encryptedData, Version: protectedVersion}, &protected); err != nil {
+			return nil, err
+		}
+		return protected, nil
+	})
+}
+
+// restores the protected values of the state
+func (c *Backend) unprotectSensitive(state map[string]interface{}) error {
+	_, err := walkProtected(state, func(protected types.ProtectedValue) (interface{}, error) {
+		var value sensitiveValue
+		if err := c.decrypt(protected.EncryptedData, &value); err != nil {
+			return nil, err
+		}
+		return value.Value, nil
+	})
+	return err
+}
+
+// determines if identity may receive the sensitive values of ref through
+// the API, readers without lock access such as read-only tokens may not
+func (c *Backend) canReadSensitive(identity *auth.Identity, ref string) bool {
+	return identity == nil || c.canAccess(identity, auth.Lock, ref)
+}
+
+// restores the protected values of the state. With ProtectSensitive the API
+// routes redact them for identities without lock access, the terraform
+// protocol always returns the full state.
+func (c *Backend) revealSensitive(r *http.Request, identity *auth.Identity, ref string, state map[string]interface{}) error {
+	if c.options.ProtectSensitive && isAPIRequest(r) && !c.canReadSensitive(identity, ref) {
+		return redactSensitive(state)
+	}
+	return c.unprotectSensitive(state)
+}
+
+// redacts the sensitive values of the state, protected or not
+func redactSensitive(state map[string]interface{}) error {
+	redact := func(interface{}) (interface{}, error) {
+		return redactedValue, nil
+	}
+	if _, err := walkProtected(state, func(types.ProtectedValue) (interface{}, error) {
+		return redactedValue, nil
+	}); err != nil {
+		return err
+	}
+	return walkSensitive(state, redact)
+}
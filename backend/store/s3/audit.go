@@ -0,0 +1,184 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+var _ store.Audit = (*Store)(nil)
+
+// audit events are named by their zero padded sequence to list in order
+func (c *Store) auditPath(sequence uint64) string {
+	return filepath.Join("tfstate", "audit", fmt.Sprintf("%020d", sequence))
+}
+
+func (c *Store) auditFolder() string {
+	return filepath.Join("tfstate", "audit") + "/"
+}
+
+// the checkpoints are kept outside the audit folder listed for events
+func (c *Store) auditCheckpointsPath() string {
+	return filepath.Join("tfstate", "audit-checkpoints")
+}
+
+// AppendAuditEvent stores an audit event, existing events are never overwritten
+func (c *Store) AppendAuditEvent(event types.AuditEvent) error {
+	defer c.observe("AppendAuditEvent", time.Now())
+	ctx := context.Background()
+
+	jsonBody, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{}
+	opts.SetMatchETagExcept("*")
+	data := bytes.NewBuffer(jsonBody)
+	_, err = c.client.PutObject(ctx, c.bucket, c.auditPath(event.Sequence), data, int64(len(jsonBody)), opts)
+	if err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "PreconditionFailed" {
+			return store.ErrConflict
+		}
+		return err
+	}
+	return nil
+}
+
+// ListAuditEvents lists up to limit audit events after sequence, oldest first
+func (c *Store) ListAuditEvents(after uint64, limit int) ([]types.AuditEvent, error) {
+	defer c.observe("ListAuditEvents", time.Now())
+	var events []types.AuditEvent
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := minio.ListObjectsOptions{
+		Prefix:     c.auditFolder(),
+		StartAfter: c.auditPath(after),
+		Recursive:  true,
+	}
+	ch := c.client.ListObjects(ctx, c.bucket, opts)
+	for object := range ch {
+		if object.Err != nil {
+			return nil, c.listFailed("ListAuditEvents", opts.Prefix, object.Err)
+		}
+		event, err := c.getAuditEvent(ctx, object.Key)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *event)
+		if len(events) == limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+// LastAuditEvent gets the newest audit event after sequence
+func (c *Store) LastAuditEvent(after uint64) (*types.AuditEvent, error) {
+	defer c.observe("LastAuditEvent", time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var last string
+	opts := minio.ListObjectsOptions{
+		Prefix:     c.auditFolder(),
+		StartAfter: c.auditPath(after),
+		Recursive:  true,
+	}
+	ch := c.client.ListObjects(ctx, c.bucket, opts)
+	for object := range ch {
+		if object.Err != nil {
+			return nil, c.listFailed("LastAuditEvent", opts.Prefix, object.Err)
+		}
+		last = object.Key
+	}
+	if last == "" {
+		return nil, store.ErrNotFound
+	}
+	return c.getAuditEvent(ctx, last)
+}
+
+// GetAuditCheckpoints gets the audit checkpoints and their ETag
+func (c *Store) GetAuditCheckpoints() ([]types.AuditCheckpoint, string, error) {
+	defer c.observe("GetAuditCheckpoints", time.Now())
+	opts := minio.GetObjectOptions{}
+	ctx := context.Background()
+	checkpointsPath := c.auditCheckpointsPath()
+
+	// Check if object exists
+	_, err := c.client.StatObject(ctx, c.bucket, checkpointsPath, opts)
+	if err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "NoSuchKey" {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	object, err := c.client.GetObject(ctx, c.bucket, checkpointsPath, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer object.Close()
+
+	// the ETag of the object read, it may have changed since the stat
+	info, err := object.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+	var checkpoints []types.AuditCheckpoint
+	if err := json.NewDecoder(object).Decode(&checkpoints); err != nil {
+		return nil, "", err
+	}
+	return checkpoints, info.ETag, nil
+}
+
+// PutAuditCheckpoints puts the audit checkpoints if their ETag is still
+// version, or if there are none when version is empty
+func (c *Store) PutAuditCheckpoints(checkpoints []types.AuditCheckpoint, version string) error {
+	defer c.observe("PutAuditCheckpoints", time.Now())
+	ctx := context.Background()
+
+	jsonBody, err := json.Marshal(&checkpoints)
+	if err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{}
+	if version == "" {
+		opts.SetMatchETagExcept("*")
+	} else {
+		opts.SetMatchETag(version)
+	}
+	data := bytes.NewBuffer(jsonBody)
+	_, err = c.client.PutObject(ctx, c.bucket, c.auditCheckpointsPath(), data, int64(len(jsonBody)), opts)
+	if err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "PreconditionFailed" {
+			return store.ErrConflict
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Store) getAuditEvent(ctx context.Context, key string) (*types.AuditEvent, error) {
+	object, err := c.client.GetObject(ctx, c.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	var event types.AuditEvent
+	if err := json.NewDecoder(object).Decode(&event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
@@ -0,0 +1,72 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+var _ store.Canary = (*Store)(nil)
+
+func (c *Store) canaryPath() string {
+	return filepath.Join("tfstate", "canary")
+}
+
+// GetCanary gets the encryption key canary
+func (c *Store) GetCanary() (*types.EncryptedState, error) {
+	defer c.observe("GetCanary", time.Now())
+	opts := minio.GetObjectOptions{}
+	ctx := context.Background()
+	canaryPath := c.canaryPath()
+
+	// Check if object exists
+	_, err := c.client.StatObject(ctx, c.bucket, canaryPath, opts)
+	if err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "NoSuchKey" {
+			return nil, store.ErrNotFound
+		}
+		return nil, err
+	}
+	object, err := c.client.GetObject(ctx, c.bucket, canaryPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	var canary types.EncryptedState
+	if err := json.NewDecoder(object).Decode(&canary); err != nil {
+		return nil, err
+	}
+	return &canary, nil
+}
+
+// PutCanary puts the encryption key canary unless it exists
+func (c *Store) PutCanary(canary types.EncryptedState) error {
+	defer c.observe("PutCanary", time.Now())
+	ctx := context.Background()
+
+	jsonBody, err := json.Marshal(&canary)
+	if err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{}
+	opts.SetMatchETagExcept("*")
+	data := bytes.NewBuffer(jsonBody)
+	_, err = c.client.PutObject(ctx, c.bucket, c.canaryPath(), data, int64(len(jsonBody)), opts)
+	if err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "PreconditionFailed" {
+			return store.ErrConflict
+		}
+		return err
+	}
+	return nil
+}
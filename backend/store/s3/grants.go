@@ -0,0 +1,87 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+var _ store.Grants = (*Store)(nil)
+
+func (c *Store) grantPath(owner string) string {
+	return filepath.Join("tfstate", "grant", owner)
+}
+
+// GetGrants gets the grants of an owner and their ETag, no grants is not
+// an error
+func (c *Store) GetGrants(owner string) ([]types.Grant, string, error) {
+	defer c.observe("GetGrants", time.Now())
+	opts := minio.GetObjectOptions{}
+	ctx := context.Background()
+	grantPath := c.grantPath(owner)
+
+	// Check if object exists
+	_, err := c.client.StatObject(ctx, c.bucket, grantPath, opts)
+	if err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "NoSuchKey" {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	object, err := c.client.GetObject(ctx, c.bucket, grantPath, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer object.Close()
+
+	// the ETag of the object read, it may have changed since the stat
+	info, err := object.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+	var document types.GrantsDocument
+	if err := json.NewDecoder(object).Decode(&document); err != nil {
+		return nil, "", err
+	}
+	return document.Grants, info.ETag, nil
+}
+
+// PutGrants puts the grants of an owner if their ETag is still version, or
+// if there are none when version is empty
+func (c *Store) PutGrants(owner string, grants []types.Grant, version string) error {
+	defer c.observe("PutGrants", time.Now())
+	ctx := context.Background()
+
+	document := types.GrantsDocument{
+		Owner:  owner,
+		Grants: grants,
+	}
+	jsonBody, err := json.Marshal(&document)
+	if err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{}
+	if version == "" {
+		opts.SetMatchETagExcept("*")
+	} else {
+		opts.SetMatchETag(version)
+	}
+	data := bytes.NewBuffer(jsonBody)
+	_, err = c.client.PutObject(ctx, c.bucket, c.grantPath(owner), data, int64(len(jsonBody)), opts)
+	if err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "PreconditionFailed" {
+			return store.ErrConflict
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+)
+
+var _ store.Health = (*Store)(nil)
+
+// pingTimeout limits how long Ping waits for the store
+const pingTimeout = 5 * time.Second
+
+// Ping verifies the store is reachable and the bucket exists
+func (c *Store) Ping() error {
+	defer c.observe("Ping", time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	exists, err := c.client.BucketExists(ctx, c.bucket)
+	if err != nil {
+		return fmt.Errorf("bucket exists: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", c.bucket)
+	}
+	return nil
+}
@@ -4,14 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"time"
 
-	"github.com/minio/minio-go/v7"
 	"github.com/loafoe/terraform-backend-hsdp/backend/store"
 	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+	"github.com/minio/minio-go/v7"
 )
 
 // GetLock gets the lock
-func (c *Store) GetLock(ref string) (*types.Lock, error) {
+func (c *Store) GetLock(ref string) (*types.LockDocument, error) {
+	defer c.observe("GetLock", time.Now())
 	opts := minio.GetObjectOptions{}
 	ctx := context.Background()
 	lockPath := c.lockPath(ref)
@@ -35,18 +37,16 @@ func (c *Store) GetLock(ref string) (*types.Lock, error) {
 	if err := json.NewDecoder(object).Decode(&lock); err != nil {
 		return nil, err
 	}
-	return &lock.Lock, nil
+	return &lock, nil
 }
 
 // PutLock puts the lock
-func (c *Store) PutLock(ref string, lock types.Lock) error {
+func (c *Store) PutLock(ref string, document types.LockDocument) error {
+	defer c.observe("PutLock", time.Now())
 	lockPath := c.lockPath(ref)
 	ctx := context.Background()
 
-	document := types.LockDocument{
-		Ref:  ref,
-		Lock: lock,
-	}
+	document.Ref = ref
 	jsonBody, err := json.Marshal(&document)
 	if err != nil {
 		return err
@@ -61,6 +61,7 @@ func (c *Store) PutLock(ref string, lock types.Lock) error {
 
 // DeleteLock deletes a lock
 func (c *Store) DeleteLock(ref string) error {
+	defer c.observe("DeleteLock", time.Now())
 	lockPath := c.lockPath(ref)
 	ctx := context.Background()
 
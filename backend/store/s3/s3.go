@@ -2,11 +2,13 @@ package s3
 
 import (
 	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/cloudfoundry-community/gautocloud"
-	"github.com/minio/minio-go/v7"
-	"github.com/loafoe/terraform-backend-hsdp/backend/store"
 	"github.com/dip-software/gautocloud-connectors/hsdp"
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/minio/minio-go/v7"
 )
 
 var _ store.Store = (*Store)(nil)
@@ -15,6 +17,10 @@ var _ store.Store = (*Store)(nil)
 type Options struct {
 	Client *minio.Client
 	Bucket string
+	// Observe is called with the duration of every store operation
+	Observe func(operation string, duration time.Duration)
+	// Logger logs store operations at debug level
+	Logger *slog.Logger
 }
 
 // NewStore creates a new S3 backend
@@ -23,16 +29,39 @@ func NewStore(opts *Options) *Store {
 		opts = &Options{}
 	}
 	backend := Store{
-		client: opts.Client,
-		bucket: opts.Bucket,
+		client:   opts.Client,
+		bucket:   opts.Bucket,
+		observer: opts.Observe,
+		logger:   opts.Logger,
+	}
+	if backend.logger == nil {
+		backend.logger = slog.New(slog.DiscardHandler)
 	}
 	return &backend
 }
 
 // Store S3 store
 type Store struct {
-	client *minio.Client
-	bucket string
+	client   *minio.Client
+	bucket   string
+	observer func(operation string, duration time.Duration)
+	logger   *slog.Logger
+}
+
+// reports and logs the duration of the operation started at start
+func (c *Store) observe(operation string, start time.Time) {
+	latency := time.Since(start)
+	if c.observer != nil {
+		c.observer(operation, latency)
+	}
+	c.logger.Debug("store operation", "operation", operation, "latency", latency)
+}
+
+// logs a failed listing and returns its error, a partial listing is not
+// returned
+func (c *Store) listFailed(operation, prefix string, err error) error {
+	c.logger.Error("failed to list objects", "operation", operation, "prefix", prefix, "error", err)
+	return fmt.Errorf("list %s: %w", prefix, err)
 }
 
 // Init initializes the backend
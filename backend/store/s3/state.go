@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/minio/minio-go/v7"
 
@@ -29,12 +29,14 @@ func (c *Store) lockPath(ref string) string {
 	return filepath.Join("tfstate", "lock", ref)
 }
 
-// GetStates lists all the states (refs)
+// GetStates lists all the state refs starting with ref
 func (c *Store) GetStates(ref string) ([]string, error) {
+	defer c.observe("GetStates", time.Now())
 	var states []string
 
-	storePath := c.storePath(ref)
-	ctx := context.Background()
+	storePath := c.storePath(ref) + "/"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	opts := minio.ListObjectsOptions{
 		Prefix:    storePath,
 		Recursive: true,
@@ -42,12 +44,11 @@ func (c *Store) GetStates(ref string) ([]string, error) {
 	ch := c.client.ListObjects(ctx, c.bucket, opts)
 	for object := range ch {
 		if object.Err != nil {
-			fmt.Println(object.Err)
-			continue
+			return nil, c.listFailed("GetStates", opts.Prefix, object.Err)
 		}
 		parts := strings.Split(object.Key, "/")
-		if len(parts) > 3 { // "tfstate/store/{uuid}/..."
-			key := strings.Join(parts[3:], "/")
+		if len(parts) > 3 { // "tfstate/store/{namespace}/..."
+			key := strings.Join(parts[2:], "/")
 			states = append(states, key)
 		}
 	}
@@ -56,6 +57,7 @@ func (c *Store) GetStates(ref string) ([]string, error) {
 
 // GetState gets the state
 func (c *Store) GetState(ref string, version ...string) (map[string]interface{}, bool, error) {
+	defer c.observe("GetState", time.Now())
 	opts := minio.GetObjectOptions{}
 	storePath := c.storePath(ref)
 	ctx := context.Background()
@@ -88,6 +90,7 @@ func (c *Store) GetState(ref string, version ...string) (map[string]interface{},
 
 // PutState puts the state
 func (c *Store) PutState(ref string, state, metadata map[string]interface{}, encrypted bool, version ...string) error {
+	defer c.observe("PutState", time.Now())
 	storePath := c.storePath(ref)
 	ctx := context.Background()
 
@@ -116,6 +119,7 @@ func (c *Store) PutState(ref string, state, metadata map[string]interface{}, enc
 
 // DeleteState deletes a state
 func (c *Store) DeleteState(ref string) error {
+	defer c.observe("DeleteState", time.Now())
 	storePath := c.storePath(ref)
 	ctx := context.Background()
 
@@ -2,19 +2,20 @@ package s3
 
 import (
 	"context"
-	"fmt"
 	"strings"
 	"time"
 
-	"github.com/minio/minio-go/v7"
 	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/minio/minio-go/v7"
 )
 
 var _ store.Stats = (*Store)(nil)
 
 // Locks gets the lock
 func (c *Store) Locks(age int) (int, error) {
-	ctx := context.Background()
+	defer c.observe("Locks", time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	lockPath := c.lockPath("") // Base
 
@@ -29,8 +30,7 @@ func (c *Store) Locks(age int) (int, error) {
 	ch := c.client.ListObjects(ctx, c.bucket, opts)
 	for object := range ch {
 		if object.Err != nil {
-			fmt.Println(object.Err)
-			continue
+			return 0, c.listFailed("Locks", opts.Prefix, object.Err)
 		}
 		// Count only older locks
 		if age > 0 {
@@ -46,7 +46,9 @@ func (c *Store) Locks(age int) (int, error) {
 
 // States gets the lock
 func (c *Store) States() (int, error) {
-	ctx := context.Background()
+	defer c.observe("States", time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	storePath := c.storePath("") // Base
 
@@ -59,8 +61,7 @@ func (c *Store) States() (int, error) {
 	ch := c.client.ListObjects(ctx, c.bucket, opts)
 	for object := range ch {
 		if object.Err != nil {
-			fmt.Println(object.Err)
-			continue
+			return 0, c.listFailed("States", opts.Prefix, object.Err)
 		}
 		count = count + 1
 	}
@@ -69,7 +70,9 @@ func (c *Store) States() (int, error) {
 
 // Identities gets the lock
 func (c *Store) Identities() (int, error) {
-	ctx := context.Background()
+	defer c.observe("Identities", time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	storePath := c.storePath("") // Base
 
@@ -83,8 +86,7 @@ func (c *Store) Identities() (int, error) {
 	var ids []string
 	for object := range ch {
 		if object.Err != nil {
-			fmt.Println(object.Err)
-			continue
+			return 0, c.listFailed("Identities", opts.Prefix, object.Err)
 		}
 		parts := strings.Split(object.Key, "/")
 		if len(parts) > 2 {
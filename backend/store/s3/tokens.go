@@ -0,0 +1,98 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+var _ store.Tokens = (*Store)(nil)
+
+func (c *Store) tokenPath(id string) string {
+	return filepath.Join("tfstate", "token", id)
+}
+
+// GetToken gets a token
+func (c *Store) GetToken(id string) (*types.Token, error) {
+	defer c.observe("GetToken", time.Now())
+	opts := minio.GetObjectOptions{}
+	ctx := context.Background()
+	tokenPath := c.tokenPath(id)
+
+	// Check if object exists
+	_, err := c.client.StatObject(ctx, c.bucket, tokenPath, opts)
+	if err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "NoSuchKey" {
+			return nil, store.ErrNotFound
+		}
+		return nil, err
+	}
+	object, err := c.client.GetObject(ctx, c.bucket, tokenPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	var token types.Token
+	if err := json.NewDecoder(object).Decode(&token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// PutToken puts a token
+func (c *Store) PutToken(token types.Token) error {
+	defer c.observe("PutToken", time.Now())
+	ctx := context.Background()
+
+	jsonBody, err := json.Marshal(&token)
+	if err != nil {
+		return err
+	}
+	data := bytes.NewBuffer(jsonBody)
+	_, err = c.client.PutObject(ctx, c.bucket, c.tokenPath(token.ID), data, int64(len(jsonBody)), minio.PutObjectOptions{})
+	return err
+}
+
+// DeleteToken deletes a token
+func (c *Store) DeleteToken(id string) error {
+	defer c.observe("DeleteToken", time.Now())
+	ctx := context.Background()
+
+	return c.client.RemoveObject(ctx, c.bucket, c.tokenPath(id), minio.RemoveObjectOptions{})
+}
+
+// ListTokens lists all tokens
+func (c *Store) ListTokens() ([]types.Token, error) {
+	defer c.observe("ListTokens", time.Now())
+	var tokens []types.Token
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := minio.ListObjectsOptions{
+		Prefix:    c.tokenPath("") + "/",
+		Recursive: true,
+	}
+	ch := c.client.ListObjects(ctx, c.bucket, opts)
+	for object := range ch {
+		if object.Err != nil {
+			return nil, c.listFailed("ListTokens", opts.Prefix, object.Err)
+		}
+		_, id := path.Split(object.Key)
+		token, err := c.GetToken(id)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, nil
+}
@@ -0,0 +1,181 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+var _ store.Mover = (*Store)(nil)
+var _ store.Redirects = (*Store)(nil)
+
+func (c *Store) redirectPath(ref string) string {
+	return filepath.Join("tfstate", "redirect", ref)
+}
+
+func (c *Store) copyObject(ctx context.Context, from, to string) error {
+	_, err := c.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: c.bucket, Object: to},
+		minio.CopySrcOptions{Bucket: c.bucket, Object: from})
+	return err
+}
+
+// CopyState copies the state of ref and its versions to target, the
+// versions of nested refs are not copied
+func (c *Store) CopyState(ref, target string) error {
+	defer c.observe("CopyState", time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := c.copyObject(ctx, c.storePath(ref), c.storePath(target)); err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "NoSuchKey" {
+			return store.ErrNotFound
+		}
+		return err
+	}
+
+	// the versions of nested refs share the prefix
+	opts := minio.ListObjectsOptions{
+		Prefix:    c.versionFolder(ref) + "/",
+		Recursive: false,
+	}
+	for object := range c.client.ListObjects(ctx, c.bucket, opts) {
+		if object.Err != nil {
+			return c.listFailed("CopyState", opts.Prefix, object.Err)
+		}
+		_, version := path.Split(object.Key)
+		if version == "" { // nested ref
+			continue
+		}
+		if err := c.copyObject(ctx, object.Key, c.versionPath(target, version)); err != nil {
+			return fmt.Errorf("copy version %s: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// DeleteVersions deletes all versions of ref, keeping those of nested refs
+func (c *Store) DeleteVersions(ref string) error {
+	defer c.observe("DeleteVersions", time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := minio.ListObjectsOptions{
+		Prefix:    c.versionFolder(ref) + "/",
+		Recursive: false,
+	}
+	for object := range c.client.ListObjects(ctx, c.bucket, opts) {
+		if object.Err != nil {
+			return c.listFailed("DeleteVersions", opts.Prefix, object.Err)
+		}
+		if _, version := path.Split(object.Key); version == "" { // nested ref
+			continue
+		}
+		if err := c.client.RemoveObject(ctx, c.bucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplaceLock puts the lock if the lock read still has the ID current, the
+// put is conditional on the ETag of the lock read
+func (c *Store) ReplaceLock(ref string, document types.LockDocument, current string) error {
+	defer c.observe("ReplaceLock", time.Now())
+	lockPath := c.lockPath(ref)
+	ctx := context.Background()
+
+	opts := minio.PutObjectOptions{}
+	if current == "" {
+		opts.SetMatchETagExcept("*")
+	} else {
+		object, err := c.client.GetObject(ctx, c.bucket, lockPath, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+		info, err := object.Stat()
+		if err != nil {
+			if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+				return store.ErrConflict
+			}
+			return err
+		}
+		var lock types.LockDocument
+		if err := json.NewDecoder(object).Decode(&lock); err != nil {
+			return err
+		}
+		if lock.Lock.ID != current {
+			return store.ErrConflict
+		}
+		opts.SetMatchETag(info.ETag)
+	}
+
+	document.Ref = ref
+	jsonBody, err := json.Marshal(&document)
+	if err != nil {
+		return err
+	}
+	data := bytes.NewBuffer(jsonBody)
+	_, err = c.client.PutObject(ctx, c.bucket, lockPath, data, int64(len(jsonBody)), opts)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+			return store.ErrConflict
+		}
+		return err
+	}
+	return nil
+}
+
+// GetRedirect gets the redirect of a moved ref
+func (c *Store) GetRedirect(ref string) (*types.Redirect, error) {
+	defer c.observe("GetRedirect", time.Now())
+	opts := minio.GetObjectOptions{}
+	ctx := context.Background()
+	redirectPath := c.redirectPath(ref)
+
+	// Check if object exists
+	_, err := c.client.StatObject(ctx, c.bucket, redirectPath, opts)
+	if err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "NoSuchKey" {
+			return nil, store.ErrNotFound
+		}
+		return nil, err
+	}
+	object, err := c.client.GetObject(ctx, c.bucket, redirectPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	var redirect types.Redirect
+	if err := json.NewDecoder(object).Decode(&redirect); err != nil {
+		return nil, err
+	}
+	return &redirect, nil
+}
+
+// PutRedirect puts the redirect of a moved ref
+func (c *Store) PutRedirect(redirect types.Redirect) error {
+	defer c.observe("PutRedirect", time.Now())
+	ctx := context.Background()
+
+	jsonBody, err := json.Marshal(&redirect)
+	if err != nil {
+		return err
+	}
+	data := bytes.NewBuffer(jsonBody)
+	_, err = c.client.PutObject(ctx, c.bucket, c.redirectPath(redirect.Ref), data, int64(len(jsonBody)), minio.PutObjectOptions{})
+	return err
+}
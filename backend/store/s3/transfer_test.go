@@ -0,0 +1,185 @@
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// fakeS3 serves the object operations of the store from a flat key space,
+// so refs share key prefixes as they do in S3
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+type listResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	Delimiter      string
+	IsTruncated    bool
+	Contents       []listObject
+	CommonPrefixes []commonPrefix
+}
+
+type listObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		data, ok := f.objects[strings.TrimPrefix(strings.TrimPrefix(source, "/"), f.bucket+"/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`))
+			return
+		}
+		f.objects[key] = data
+		_, _ = w.Write([]byte(`<CopyObjectResult><LastModified>2026-01-01T00:00:00.000Z</LastModified><ETag>"etag"</ETag></CopyObjectResult>`))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, delimiter string) {
+	result := listResult{Name: f.bucket, Prefix: prefix, Delimiter: delimiter}
+	prefixes := map[string]bool{}
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			common := prefix + rest[:i+1]
+			if !prefixes[common] {
+				prefixes[common] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: common})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, listObject{
+			Key:          key,
+			LastModified: "2026-01-01T00:00:00.000Z",
+			ETag:         `"etag"`,
+			Size:         len(f.objects[key]),
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// keys lists the keys starting with prefix
+func (f *fakeS3) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newFakeStore(t *testing.T) (*Store, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{bucket: "tfstate", objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStore(&Options{Client: client, Bucket: fake.bucket}), fake
+}
+
+func TestTransferNestedRefs(t *testing.T) {
+	store, fake := newFakeStore(t)
+	for _, key := range []string{
+		"tfstate/store/alice/a",
+		"tfstate/store/alice/a/b",
+		"tfstate/version/alice/a/20260101000000",
+		"tfstate/version/alice/a/20260102000000",
+		"tfstate/version/alice/a/b/20260103000000",
+		// an unrelated state nested under the target
+		"tfstate/version/bob/a/c/20260104000000",
+	} {
+		fake.objects[key] = []byte("{}")
+	}
+
+	// a namespace transfer moves the parent before its children
+	for _, ref := range []string{"a", "a/b"} {
+		if err := store.CopyState("alice/"+ref, "bob/"+ref); err != nil {
+			t.Fatalf("copy %s: %v", ref, err)
+		}
+		if err := store.DeleteVersions("alice/" + ref); err != nil {
+			t.Fatalf("delete versions of %s: %v", ref, err)
+		}
+	}
+	for ref, expected := range map[string][]string{
+		"alice/a":   {},
+		"alice/a/b": {},
+		"bob/a":     {"20260101000000", "20260102000000"},
+		"bob/a/b":   {"20260103000000"},
+		"bob/a/c":   {"20260104000000"},
+	} {
+		versions, err := store.List(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if versions == nil {
+			versions = []string{}
+		}
+		if !reflect.DeepEqual(versions, expected) {
+			t.Errorf("%s: expected versions %v, got %v", ref, expected, versions)
+		}
+	}
+
+	// rolling back a failed transfer keeps the states nested under the target
+	if err := store.DeleteVersions("bob/a"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := fake.keys("tfstate/version/bob/"); !reflect.DeepEqual(keys, []string{
+		"tfstate/version/bob/a/b/20260103000000",
+		"tfstate/version/bob/a/c/20260104000000",
+	}) {
+		t.Fatalf("expected only the versions of bob/a to be deleted, got %v", keys)
+	}
+}
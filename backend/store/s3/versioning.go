@@ -4,35 +4,74 @@ import (
 	"context"
 	"fmt"
 	"path"
+	"sort"
+	"time"
 
 	"github.com/minio/minio-go/v7"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
 )
 
+// List lists the versions of ref, oldest first
 func (c *Store) List(ref string) ([]string, error) {
+	defer c.observe("List", time.Now())
 	var versions []string
-	versionFolder := c.versionFolder(ref)
-	ctx := context.Background()
+	versionFolder := c.versionFolder(ref) + "/"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	opts := minio.ListObjectsOptions{
 		Prefix:    versionFolder,
-		Recursive: true,
+		Recursive: false,
 	}
 	ch := c.client.ListObjects(ctx, c.bucket, opts)
 	for object := range ch {
 		if object.Err != nil {
-			fmt.Println(object.Err)
-			continue
+			return nil, c.listFailed("List", opts.Prefix, object.Err)
 		}
 		_, key := path.Split(object.Key)
+		if key == "" { // nested ref
+			continue
+		}
 		versions = append(versions, key)
 	}
+	sort.Strings(versions)
 	return versions, nil
 }
 
-func (c *Store) Keep(last int) error {
-	return fmt.Errorf("implement me")
+// Keep removes all but the last versions of ref
+func (c *Store) Keep(ref string, last int) error {
+	defer c.observe("Keep", time.Now())
+	if last < 1 {
+		return fmt.Errorf("must keep at least one version")
+	}
+	versions, err := c.List(ref)
+	if err != nil {
+		return err
+	}
+	if len(versions) <= last {
+		return nil
+	}
+	ctx := context.Background()
+	for _, version := range versions[:len(versions)-last] {
+		if err := c.client.RemoveObject(ctx, c.bucket, c.versionPath(ref, version), minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Restore makes version the current state of ref
 func (c *Store) Restore(ref, version string) error {
-	return fmt.Errorf("implement me")
+	defer c.observe("Restore", time.Now())
+	ctx := context.Background()
+
+	if err := c.copyObject(ctx, c.versionPath(ref, version), c.storePath(ref)); err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "NoSuchKey" {
+			return store.ErrNotFound
+		}
+		return err
+	}
+	return nil
 }
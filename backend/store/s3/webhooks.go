@@ -0,0 +1,86 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+var _ store.Webhooks = (*Store)(nil)
+
+func (c *Store) deliveryPath(id string) string {
+	return filepath.Join("tfstate", "webhooks", id)
+}
+
+// PutDelivery puts a webhook delivery
+func (c *Store) PutDelivery(delivery types.WebhookDelivery) error {
+	defer c.observe("PutDelivery", time.Now())
+	ctx := context.Background()
+
+	jsonBody, err := json.Marshal(&delivery)
+	if err != nil {
+		return err
+	}
+	data := bytes.NewBuffer(jsonBody)
+	_, err = c.client.PutObject(ctx, c.bucket, c.deliveryPath(delivery.ID), data, int64(len(jsonBody)), minio.PutObjectOptions{})
+	return err
+}
+
+// DeleteDelivery deletes a webhook delivery
+func (c *Store) DeleteDelivery(id string) error {
+	defer c.observe("DeleteDelivery", time.Now())
+	ctx := context.Background()
+
+	return c.client.RemoveObject(ctx, c.bucket, c.deliveryPath(id), minio.RemoveObjectOptions{})
+}
+
+// ListDeliveries lists the queued webhook deliveries
+func (c *Store) ListDeliveries() ([]types.WebhookDelivery, error) {
+	defer c.observe("ListDeliveries", time.Now())
+	var deliveries []types.WebhookDelivery
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := minio.ListObjectsOptions{
+		Prefix:    c.deliveryPath("") + "/",
+		Recursive: true,
+	}
+	ch := c.client.ListObjects(ctx, c.bucket, opts)
+	for object := range ch {
+		if object.Err != nil {
+			return nil, c.listFailed("ListDeliveries", opts.Prefix, object.Err)
+		}
+		delivery, err := c.getDelivery(ctx, object.Key)
+		if err != nil {
+			errResponse := minio.ToErrorResponse(err)
+			if errResponse.Code == "NoSuchKey" {
+				// delivered by another instance
+				continue
+			}
+			return nil, err
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	return deliveries, nil
+}
+
+func (c *Store) getDelivery(ctx context.Context, key string) (*types.WebhookDelivery, error) {
+	object, err := c.client.GetObject(ctx, c.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	var delivery types.WebhookDelivery
+	if err := json.NewDecoder(object).Decode(&delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
@@ -9,6 +9,9 @@ import (
 // ErrNotFound item not found
 var ErrNotFound = errors.New("resource not found")
 
+// ErrConflict item already exists
+var ErrConflict = errors.New("resource already exists")
+
 // Stats store interface
 type Stats interface {
 	Locks(age int) (int, error)
@@ -21,18 +24,90 @@ type Store interface {
 	Init() error
 
 	// state
-	GetStates(ref string) (states []string, err error)
+	GetStates(ref string) (refs []string, err error)
 	GetState(ref string, version ...string) (state map[string]interface{}, encrypted bool, err error)
 	PutState(ref string, state, metadata map[string]interface{}, encrypted bool, version ...string) error
 	DeleteState(ref string) error
 
 	// lock
-	GetLock(ref string) (lock *types.Lock, err error)
-	PutLock(ref string, lock types.Lock) error
+	GetLock(ref string) (lock *types.LockDocument, err error)
+	PutLock(ref string, lock types.LockDocument) error
 	DeleteLock(ref string) error
 
 	// versioning
 	List(ref string) ([]string, error)
 	Restore(ref, version string) error
-	Keep(last int) error
+	Keep(ref string, last int) error
+}
+
+// Canary store interface
+type Canary interface {
+	GetCanary() (canary *types.EncryptedState, err error)
+	// PutCanary stores the canary, ErrConflict when it exists
+	PutCanary(canary types.EncryptedState) error
+}
+
+// Tokens store interface
+type Tokens interface {
+	GetToken(id string) (token *types.Token, err error)
+	PutToken(token types.Token) error
+	DeleteToken(id string) error
+	ListTokens() (tokens []types.Token, err error)
+}
+
+// Grants store interface
+type Grants interface {
+	// GetGrants returns the grants of owner and the version of the grants
+	// document, empty when the owner has none
+	GetGrants(owner string) (grants []types.Grant, version string, err error)
+	// PutGrants replaces the grants of owner when the document is still at
+	// version, ErrConflict otherwise
+	PutGrants(owner string, grants []types.Grant, version string) error
+}
+
+// Mover store interface
+type Mover interface {
+	// CopyState copies the state of ref and its versions to target
+	CopyState(ref, target string) error
+	DeleteVersions(ref string) error
+	// ReplaceLock puts the lock of ref if the current lock has the ID
+	// current, or if ref is unlocked when current is empty, ErrConflict
+	// otherwise
+	ReplaceLock(ref string, lock types.LockDocument, current string) error
+}
+
+// Redirects store interface
+type Redirects interface {
+	GetRedirect(ref string) (redirect *types.Redirect, err error)
+	PutRedirect(redirect types.Redirect) error
+}
+
+// Health store interface
+type Health interface {
+	// Ping verifies the store is reachable and its bucket exists
+	Ping() error
+}
+
+// Audit store interface, events are never overwritten or deleted
+type Audit interface {
+	// AppendAuditEvent stores event, ErrConflict when its sequence exists
+	AppendAuditEvent(event types.AuditEvent) error
+	// ListAuditEvents lists up to limit events after sequence, oldest first
+	ListAuditEvents(after uint64, limit int) ([]types.AuditEvent, error)
+	// LastAuditEvent gets the newest event after sequence, listing only the
+	// events after it, ErrNotFound without newer events
+	LastAuditEvent(after uint64) (*types.AuditEvent, error)
+	// GetAuditCheckpoints returns the checkpoints, oldest first, and the
+	// version of the checkpoints document, empty when there are none
+	GetAuditCheckpoints() (checkpoints []types.AuditCheckpoint, version string, err error)
+	// PutAuditCheckpoints replaces the checkpoints when the document is still
+	// at version, ErrConflict otherwise
+	PutAuditCheckpoints(checkpoints []types.AuditCheckpoint, version string) error
+}
+
+// Webhooks store interface, the persistent queue of webhook deliveries
+type Webhooks interface {
+	PutDelivery(delivery types.WebhookDelivery) error
+	DeleteDelivery(id string) error
+	ListDeliveries() (deliveries []types.WebhookDelivery, err error)
 }
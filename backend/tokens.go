@@ -0,0 +1,148 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// tokenResponse a token without its hash, Secret is only set on creation
+type tokenResponse struct {
+	types.Token
+	Secret string `json:"token,omitempty"`
+}
+
+// authenticates the request
+func (c *Backend) authenticate(r *http.Request) (*auth.Identity, error) {
+	if c.options.Authenticator == nil {
+		return nil, fmt.Errorf("authentication is not configured")
+	}
+	if info := getRequestInfo(r); info != nil && info.authenticated {
+		return info.identity, info.authErr
+	}
+	return c.options.Authenticator.Authenticate(r)
+}
+
+// authenticates a token management request
+func (c *Backend) tokenOwner(w http.ResponseWriter, r *http.Request) (*auth.Identity, store.Tokens, bool) {
+	tokenStore, ok := c.store.(store.Tokens)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "the store does not support tokens")
+		return nil, nil, false
+	}
+	identity, ok := c.principal(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	return identity, tokenStore, true
+}
+
+// HandleListTokens lists the tokens of the caller
+func (c *Backend) HandleListTokens(w http.ResponseWriter, r *http.Request) {
+	identity, tokenStore, ok := c.tokenOwner(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := tokenStore.ListTokens()
+	if err != nil {
+		c.logger(r).Error("failed to list tokens", "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to list tokens")
+		return
+	}
+	owned := []tokenResponse{}
+	for _, token := range tokens {
+		if token.Owner != identity.Subject {
+			continue
+		}
+		token.Hash = ""
+		owned = append(owned, tokenResponse{Token: token})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(owned)
+}
+
+// HandleCreateToken mints a token for the caller
+func (c *Backend) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
+	identity, tokenStore, ok := c.tokenOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var tokenRequest struct {
+		Description string   `json:"description"`
+		Scope       string   `json:"scope"`
+		RefPrefixes []string `json:"ref_prefixes"`
+		ExpiresIn   string   `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&tokenRequest); err != nil {
+		c.logger(r).Error("error decoding token request body", "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "", "invalid token request body")
+		return
+	}
+	ttl := c.options.MaxTokenTTL
+	if tokenRequest.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(tokenRequest.ExpiresIn)
+		if err != nil || expiresIn <= 0 || expiresIn > c.options.MaxTokenTTL {
+			c.logger(r).Error("invalid token expiry", "expires_in", tokenRequest.ExpiresIn, "error", err)
+			writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "", "invalid token expiry")
+			return
+		}
+		ttl = expiresIn
+	}
+
+	secret, token, err := auth.NewToken(identity, tokenRequest.Description, tokenRequest.Scope, tokenRequest.RefPrefixes, ttl)
+	if err != nil {
+		c.logger(r).Error("failed to create token", "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "", err.Error())
+		return
+	}
+	if err := tokenStore.PutToken(*token); err != nil {
+		c.logger(r).Error("failed to store token", "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to store the token")
+		return
+	}
+	c.logger(r).Info("created token", "token_id", token.ID, "scope", token.Scope)
+
+	token.Hash = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(tokenResponse{Token: *token, Secret: secret})
+}
+
+// HandleRevokeToken revokes a token of the caller
+func (c *Backend) HandleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	identity, tokenStore, ok := c.tokenOwner(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if !auth.ValidTokenID(id) {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "token not found")
+		return
+	}
+	token, err := tokenStore.GetToken(id)
+	if err == store.ErrNotFound || (err == nil && token.Owner != identity.Subject) {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "token not found")
+		return
+	}
+	if err == nil {
+		err = tokenStore.DeleteToken(id)
+	}
+	if err != nil {
+		c.logger(r).Error("failed to revoke token", "token_id", id, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to revoke the token")
+		return
+	}
+	c.logger(r).Info("revoked token", "token_id", id)
+
+	w.WriteHeader(http.StatusOK)
+}
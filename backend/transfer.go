@@ -0,0 +1,348 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// maxRedirects limits how many redirects of moved refs are followed
+const maxRedirects = 5
+
+var (
+	errTargetExists = errors.New("target state already exists")
+	errTargetLocked = errors.New("target state is locked")
+	errStateLocked  = errors.New("state is locked")
+)
+
+// follows the redirects of moved refs that did not expire yet
+func (c *Backend) followRedirect(ref string) (string, error) {
+	redirects, ok := c.store.(store.Redirects)
+	if !ok {
+		return ref, nil
+	}
+	for i := 0; i < maxRedirects; i++ {
+		redirect, err := redirects.GetRedirect(ref)
+		if err == store.ErrNotFound {
+			return ref, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if time.Now().After(redirect.Expires) {
+			return ref, nil
+		}
+		c.options.Logger.Debug("redirecting moved ref", "ref", ref, "target", redirect.Target)
+		ref = redirect.Target
+	}
+	return ref, nil
+}
+
+// transferResult the outcome of moving one state
+type transferResult struct {
+	Ref    string `json:"ref"`
+	Target string `json:"target"`
+	Error  string `json:"error,omitempty"`
+}
+
+// moves the state of ref with its versions and lock to target and leaves
+// a redirect. The source and target are locked while the state is copied,
+// so the target cannot be created or locked in the meantime.
+func (c *Backend) transferState(identity *auth.Identity, ref, target string, moveLock bool) error {
+	mover := c.store.(store.Mover)
+	redirects := c.store.(store.Redirects)
+
+	if _, _, err := c.store.GetState(ref); err != nil {
+		return err
+	}
+	lock, err := c.getLock(ref)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	if lock != nil && !moveLock {
+		return errStateLocked
+	}
+
+	// hold a transfer lock on the target and the source, replacing a lock
+	// being moved
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	transferLock := types.Lock{
+		ID:        hex.EncodeToString(id),
+		Operation: "transfer",
+		Info:      "transfer from " + ref,
+		Who:       identity.Name,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+	}
+	document, err := c.lockDocument(transferLock)
+	if err != nil {
+		return err
+	}
+	// fails when the target is locked
+	if err := mover.ReplaceLock(target, document, ""); err != nil {
+		if err == store.ErrConflict {
+			return errTargetLocked
+		}
+		return err
+	}
+	if _, _, err := c.store.GetState(target); err != store.ErrNotFound {
+		_ = c.store.DeleteLock(target)
+		if err == nil {
+			return errTargetExists
+		}
+		return err
+	}
+
+	transferLock.Info = "transfer to " + target
+	if document, err = c.lockDocument(transferLock); err != nil {
+		_ = c.store.DeleteLock(target)
+		return err
+	}
+	current := ""
+	if lock != nil {
+		current = lock.ID
+	}
+	// fails when the state was locked or its lock changed since it was read
+	if err := mover.ReplaceLock(ref, document, current); err != nil {
+		_ = c.store.DeleteLock(target)
+		if err == store.ErrConflict {
+			return errStateLocked
+		}
+		return err
+	}
+	// restores the source on failure
+	rollback := func(cause error) error {
+		_ = c.store.DeleteState(target)
+		_ = mover.DeleteVersions(target)
+		_ = c.store.DeleteLock(target)
+		if lock != nil {
+			_ = c.putLock(ref, *lock)
+		} else {
+			_ = c.store.DeleteLock(ref)
+		}
+		return cause
+	}
+	if err := mover.CopyState(ref, target); err != nil {
+		return rollback(err)
+	}
+
+	// verify the copy before removing the source
+	state, encrypted, err := c.store.GetState(ref)
+	if err != nil {
+		return rollback(err)
+	}
+	copied, copiedEncrypted, err := c.store.GetState(target)
+	if err != nil {
+		return rollback(err)
+	}
+	if encrypted != copiedEncrypted || !reflect.DeepEqual(state, copied) {
+		return rollback(fmt.Errorf("copied state does not match source"))
+	}
+
+	// the moved lock replaces the transfer lock of the target
+	if lock != nil {
+		if err := c.putLock(target, *lock); err != nil {
+			return rollback(err)
+		}
+	}
+
+	now := time.Now().UTC()
+	if err := redirects.PutRedirect(types.Redirect{
+		Ref:     ref,
+		Target:  target,
+		Created: now,
+		Expires: now.Add(c.options.RedirectGracePeriod),
+	}); err != nil {
+		return rollback(err)
+	}
+	if lock == nil {
+		if err := c.store.DeleteLock(target); err != nil {
+			return err
+		}
+	}
+
+	if err := c.store.DeleteState(ref); err != nil {
+		return err
+	}
+	if err := mover.DeleteVersions(ref); err != nil {
+		return err
+	}
+	return c.store.DeleteLock(ref)
+}
+
+// authorizes the source of a transfer, backend administrators move the
+// states of any owner with the source_owner parameter
+func (c *Backend) transferSource(r *http.Request) (*auth.Identity, string, error) {
+	owner := r.URL.Query().Get("source_owner")
+	if owner == "" || c.options.Authenticator == nil {
+		return c.authorize(r, auth.Admin)
+	}
+	identity, err := c.authenticate(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if !c.isAdmin(identity) {
+		return nil, "", fmt.Errorf("%w: transferring the states of %s needs a backend administrator", auth.ErrForbidden, owner)
+	}
+	if err := auth.ValidateOwner(owner); err != nil {
+		return nil, "", err
+	}
+	path := requestPath(r)
+	if err := validateStatePath(path); err != nil {
+		return nil, "", err
+	}
+	if !identity.Scope.Allows(auth.Admin, path) {
+		return nil, "", fmt.Errorf("%w: %s access to %s is outside the scope of %s", auth.ErrForbidden, auth.Admin, path, identity.Name)
+	}
+	ref, err := c.options.RefResolver(&auth.Identity{Subject: owner}, path)
+	if err != nil {
+		return nil, "", err
+	}
+	getRequestInfo(r).setRef(ref)
+	return identity, ref, nil
+}
+
+// HandleTransferState moves a state, or all states of a namespace with
+// namespace set, to another identity or team namespace
+func (c *Backend) HandleTransferState(w http.ResponseWriter, r *http.Request) {
+	if c.isSealed(w, r) {
+		return
+	}
+	identity, ref, err := c.transferSource(r)
+	if err != nil {
+		c.logger(r).Error("failed to get ref in HandleTransferState", "error", err)
+		writeAuthError(w, r, err)
+		return
+	}
+	if identity == nil {
+		writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "", "transfers need authentication")
+		return
+	}
+
+	_, isMover := c.store.(store.Mover)
+	_, hasRedirects := c.store.(store.Redirects)
+	if !isMover || !hasRedirects {
+		writeError(w, r, http.StatusNotImplemented, ErrCodeNotImplemented, ref, "the store does not support transfers")
+		return
+	}
+
+	var transferRequest struct {
+		Target      string `json:"target"`
+		TargetOwner string `json:"target_owner"`
+		Namespace   bool   `json:"namespace"`
+		MoveLock    bool   `json:"move_lock"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&transferRequest); err != nil {
+		c.logger(r).Error("error decoding transfer request body", "ref", ref, "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, ref, "invalid transfer request body")
+		return
+	}
+
+	if err := validateStatePath(transferRequest.Target); err != nil {
+		c.logger(r).Error("invalid transfer target", "target", transferRequest.Target, "error", err)
+		writeAuthError(w, r, err)
+		return
+	}
+
+	// resolve the target, another identity must have granted write access
+	// unless a backend administrator transfers
+	targetNamespace := identity
+	if owner := transferRequest.TargetOwner; owner != "" && owner != identity.Subject {
+		if err := auth.ValidateOwner(owner); err != nil {
+			c.logger(r).Error("invalid transfer target owner", "owner", owner, "error", err)
+			writeAuthError(w, r, err)
+			return
+		}
+		granted := c.isAdmin(identity)
+		if !granted {
+			granted, err = c.granted(identity, owner, transferRequest.Target, auth.Write)
+		}
+		if err != nil || !granted {
+			c.logger(r).Error("write access to transfer target is not granted", "target", transferRequest.Target, "owner", owner, "error", err)
+			writeError(w, r, http.StatusForbidden, ErrCodeForbidden, ref, "write access to the transfer target is not granted")
+			return
+		}
+		targetNamespace = &auth.Identity{Subject: owner}
+	}
+	target, err := c.options.RefResolver(targetNamespace, transferRequest.Target)
+	if err != nil {
+		c.logger(r).Error("failed to resolve transfer target", "target", transferRequest.Target, "error", err)
+		writeError(w, r, http.StatusForbidden, ErrCodeForbidden, ref, err.Error())
+		return
+	}
+	if targetNamespace == identity {
+		if err := c.allowed(identity, auth.Write, target); err != nil {
+			c.logger(r).Error("failed to authorize transfer target", "target", target, "error", err)
+			writeAuthError(w, r, err)
+			return
+		}
+	}
+
+	if err := c.Init(); err != nil {
+		c.logger(r).Error("failed to initialize terraform state backend", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to initialize the backend")
+		return
+	}
+
+	if !c.canWrite(w, r, ref) {
+		return
+	}
+
+	c.logger(r).Info("transferring terraform state", "ref", ref, "target", target)
+
+	if !transferRequest.Namespace {
+		err := c.transferState(identity, ref, target, transferRequest.MoveLock)
+		switch err {
+		case nil:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(w).Encode(transferResult{Ref: ref, Target: target})
+		case store.ErrNotFound:
+			writeError(w, r, http.StatusNotFound, ErrCodeNotFound, ref, "state not found")
+		case errTargetExists:
+			writeError(w, r, http.StatusConflict, ErrCodeConflict, ref, err.Error())
+		case errStateLocked, errTargetLocked:
+			writeError(w, r, http.StatusLocked, ErrCodeStateLocked, ref, err.Error())
+		default:
+			c.logger(r).Error("failed to transfer terraform state", "ref", ref, "target", target, "error", err)
+			writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to transfer the state")
+		}
+		return
+	}
+
+	refs, err := c.store.GetStates(ref)
+	if err != nil {
+		c.logger(r).Error("failed to retrieve list of states", "ref", ref, "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, ref, "failed to list states")
+		return
+	}
+	results := []transferResult{}
+	for _, stateRef := range refs {
+		result := transferResult{
+			Ref:    stateRef,
+			Target: filepath.Join(target, strings.TrimPrefix(stateRef, ref+"/")),
+		}
+		if err := c.transferState(identity, result.Ref, result.Target, transferRequest.MoveLock); err != nil {
+			c.logger(r).Error("failed to transfer terraform state", "ref", result.Ref, "target", result.Target, "error", err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(results)
+}
@@ -1,5 +1,9 @@
 package types
 
+import (
+	"time"
+)
+
 // EncryptedState encrypted state
 type EncryptedState struct {
 	EncryptedData string `json:"encrypted_data"`
@@ -13,10 +17,19 @@ type StateDocument struct {
 	Metadata  map[string]interface{} `json:"metadata"`
 }
 
-// LockDocument a lock with reference
+// EncryptedMetadata encrypted state metadata with plaintext index fields
+type EncryptedMetadata struct {
+	Index         map[string]interface{} `json:"index"`
+	EncryptedData string                 `json:"encrypted_data"`
+}
+
+// LockDocument a lock with reference. When encrypted, Lock only holds
+// the plaintext index fields and the full lock is in EncryptedLock.
 type LockDocument struct {
-	Ref  string `json:"ref"`
-	Lock Lock   `json:"lock"`
+	Ref           string `json:"ref"`
+	Lock          Lock   `json:"lock"`
+	Encrypted     bool   `json:"encrypted,omitempty"`
+	EncryptedLock string `json:"encrypted_lock,omitempty"`
 }
 
 // Lock a lock on state
@@ -29,3 +42,117 @@ type Lock struct {
 	Who       string
 	Version   string
 }
+
+// ProtectedValue a separately encrypted sensitive value in a state, the
+// version marks the map as envelope
+type ProtectedValue struct {
+	EncryptedData string `json:"tfstate_protected_value"`
+	Version       int    `json:"tfstate_protected_version"`
+}
+
+// Token a backend-issued API token. Only the hash of its secret is stored.
+type Token struct {
+	ID          string    `json:"id"`
+	Owner       string    `json:"owner"`
+	OwnerName   string    `json:"owner_name"`
+	Description string    `json:"description,omitempty"`
+	Hash        string    `json:"hash,omitempty"`
+	Scope       string    `json:"scope"`
+	RefPrefixes []string  `json:"ref_prefixes,omitempty"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Grant gives a grantee permissions on a state path, or on all paths
+// starting with Path when Prefix is set, in the namespace of the owner
+type Grant struct {
+	Path        string   `json:"path"`
+	Prefix      bool     `json:"prefix,omitempty"`
+	Grantee     string   `json:"grantee"`
+	Group       bool     `json:"group,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+// GrantsDocument the grants of an owner
+type GrantsDocument struct {
+	Owner  string  `json:"owner"`
+	Grants []Grant `json:"grants"`
+}
+
+// Redirect points a moved ref to its new location until it expires
+type Redirect struct {
+	Ref     string    `json:"ref"`
+	Target  string    `json:"target"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// AuditEvent a handler action in the audit log. Subject identifies the
+// caller, Identity is its display name. Hash covers the event including
+// PrevHash, the hash of its predecessor.
+type AuditEvent struct {
+	Sequence  uint64    `json:"sequence"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Identity  string    `json:"identity,omitempty"`
+	Action    string    `json:"action"`
+	Ref       string    `json:"ref,omitempty"`
+	LockID    string    `json:"lock_id,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	SourceIP  string    `json:"source_ip,omitempty"`
+	Status    int       `json:"status"`
+	Result    string    `json:"result"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+// AuditCheckpoint the hash of an audit event at a sequence, queries start
+// verifying the hash chain at the last checkpoint before their time range
+type AuditCheckpoint struct {
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Hash     string    `json:"hash"`
+}
+
+// types of state events
+const (
+	EventStateUpdated  = "state_updated"
+	EventStateDeleted  = "state_deleted"
+	EventStateRestored = "state_restored"
+	EventLockAcquired  = "lock_acquired"
+	EventLockReleased  = "lock_released"
+	EventLockHeld      = "lock_held"
+	EventForceUnlocked = "force_unlocked"
+)
+
+// Event a change of a state
+type Event struct {
+	ID       string         `json:"id"`
+	Type     string         `json:"type"`
+	Time     time.Time      `json:"time"`
+	Ref      string         `json:"ref"`
+	Identity string         `json:"identity,omitempty"`
+	Serial   int64          `json:"serial,omitempty"`
+	Version  string         `json:"version,omitempty"`
+	Lock     *Lock          `json:"lock,omitempty"`
+	Changes  *ChangeSummary `json:"changes,omitempty"`
+}
+
+// ChangeSummary the addresses of the resources added, changed and
+// removed by a state change
+type ChangeSummary struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+// WebhookDelivery a queued delivery of an event to a webhook
+type WebhookDelivery struct {
+	ID          string    `json:"id"`
+	Webhook     string    `json:"webhook"`
+	Event       Event     `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
@@ -0,0 +1,84 @@
+package backend
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/seal"
+)
+
+// determines if the backend is sealed, responds when it is
+func (c *Backend) isSealed(w http.ResponseWriter, r *http.Request) bool {
+	if c.options.Sealer == nil || !c.options.Sealer.Sealed() {
+		return false
+	}
+	writeError(w, r, http.StatusServiceUnavailable, ErrCodeSealed, "", "the backend is sealed")
+	return true
+}
+
+// HandleSealStatus reports the seal status
+func (c *Backend) HandleSealStatus(w http.ResponseWriter, r *http.Request) {
+	if c.options.Sealer == nil {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "sealing is not enabled")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(c.options.Sealer.Status())
+}
+
+// HandleUnseal accepts a key share and unseals the backend once enough
+// shares are submitted and the reconstructed key matches the canary. The key
+// is only used by the backend once it is verified.
+func (c *Backend) HandleUnseal(w http.ResponseWriter, r *http.Request) {
+	if c.options.Sealer == nil {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "", "sealing is not enabled")
+		return
+	}
+
+	var unsealRequest struct {
+		Share string `json:"share"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&unsealRequest); err != nil {
+		c.logger(r).Error("error decoding unseal request body", "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "", "invalid unseal request body")
+		return
+	}
+	share, err := base64.StdEncoding.DecodeString(unsealRequest.Share)
+	if err != nil || len(share) < 2 {
+		c.logger(r).Error("invalid key share in unseal request", "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "", "invalid key share")
+		return
+	}
+
+	if err := c.store.Init(); err != nil {
+		c.logger(r).Error("failed to initialize terraform state backend", "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to initialize the backend")
+		return
+	}
+
+	status, err := c.options.Sealer.Unseal(share, c.verifyCanary)
+	switch {
+	case errors.Is(err, ErrKeyMismatch):
+		c.logger(r).Error("reconstructed key rejected", "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "", "the reconstructed key does not match the encryption key canary")
+		return
+	case errors.Is(err, seal.ErrKeyRejected):
+		c.logger(r).Error("failed to verify the reconstructed key", "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeStoreUnavailable, "", "failed to verify the reconstructed key")
+		return
+	case err != nil:
+		c.logger(r).Warn("failed to submit key share", "error", err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "", err.Error())
+		return
+	}
+	if !status.Sealed {
+		c.logger(r).Info("backend unsealed")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,81 @@
+package webhook
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// resourceInstances maps the addresses of the resource instances of a
+// Terraform state to their attributes
+func resourceInstances(state map[string]interface{}) map[string]interface{} {
+	instances := map[string]interface{}{}
+	resources, _ := state["resources"].([]interface{})
+	for _, r := range resources {
+		resource, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		address := fmt.Sprintf("%v.%v", resource["type"], resource["name"])
+		if resource["mode"] == "data" {
+			address = "data." + address
+		}
+		if module, ok := resource["module"].(string); ok && module != "" {
+			address = module + "." + address
+		}
+		resourceInstances, _ := resource["instances"].([]interface{})
+		for _, i := range resourceInstances {
+			instance, ok := i.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			instanceAddress := address
+			switch key := instance["index_key"].(type) {
+			case string:
+				instanceAddress = fmt.Sprintf("%s[%q]", address, key)
+			case float64:
+				instanceAddress = fmt.Sprintf("%s[%d]", address, int(key))
+			}
+			instances[instanceAddress] = instance["attributes"]
+		}
+	}
+	return instances
+}
+
+// Summarize compares the resource instances of two Terraform states, a nil
+// previous state has no resources
+func Summarize(previous, current map[string]interface{}) *types.ChangeSummary {
+	summary := &types.ChangeSummary{
+		Added:   []string{},
+		Changed: []string{},
+		Removed: []string{},
+	}
+	before := resourceInstances(previous)
+	after := resourceInstances(current)
+	for address, attributes := range after {
+		previousAttributes, ok := before[address]
+		switch {
+		case !ok:
+			summary.Added = append(summary.Added, address)
+		case !reflect.DeepEqual(previousAttributes, attributes):
+			summary.Changed = append(summary.Changed, address)
+		}
+	}
+	for address := range before {
+		if _, ok := after[address]; !ok {
+			summary.Removed = append(summary.Removed, address)
+		}
+	}
+	sort.Strings(summary.Added)
+	sort.Strings(summary.Changed)
+	sort.Strings(summary.Removed)
+	return summary
+}
+
+// Serial returns the serial of a Terraform state
+func Serial(state map[string]interface{}) int64 {
+	serial, _ := state["serial"].(float64)
+	return int64(serial)
+}
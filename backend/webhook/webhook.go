@@ -0,0 +1,351 @@
+// Package webhook notifies webhooks of state events through a persistent
+// delivery queue
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the body, keyed with the
+	// secret of the webhook, as sha256=<hex>
+	SignatureHeader = "X-Tfstate-Signature"
+	// EventHeader carries the event type
+	EventHeader = "X-Tfstate-Event"
+	// DeliveryHeader carries the delivery ID, repeated on retries
+	DeliveryHeader = "X-Tfstate-Delivery"
+
+	deliveryTimeout = 10 * time.Second
+)
+
+// DefaultEvents are sent to webhooks without events, lock_acquired and
+// lock_released are only sent when listed
+var DefaultEvents = []string{
+	types.EventStateUpdated,
+	types.EventStateDeleted,
+	types.EventStateRestored,
+	types.EventLockHeld,
+	types.EventForceUnlocked,
+}
+
+// Webhook receives the events of refs starting with one of its prefixes
+type Webhook struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret signs every delivery, it is required
+	Secret string `json:"secret"`
+	// Events are the event types sent, DefaultEvents when empty
+	Events []string `json:"events,omitempty"`
+	// RefPrefixes limit the refs, matching whole segments, all refs when
+	// empty
+	RefPrefixes []string `json:"ref_prefixes,omitempty"`
+}
+
+// matches determines if the webhook receives eventType events of ref
+func (w Webhook) matches(eventType, ref string) bool {
+	events := w.Events
+	if len(events) == 0 {
+		events = DefaultEvents
+	}
+	found := false
+	for _, event := range events {
+		found = found || event == eventType
+	}
+	if !found {
+		return false
+	}
+	if len(w.RefPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range w.RefPrefixes {
+		if auth.HasPathPrefix(ref, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Config webhooks and their delivery settings
+type Config struct {
+	Webhooks []Webhook `json:"webhooks"`
+	// LockThreshold is how long a lock is held before lock_held is sent
+	LockThreshold Duration `json:"lock_threshold,omitempty"`
+	// MaxAttempts before a delivery is dropped
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Backoff before the first retry, doubling up to MaxBackoff
+	Backoff    Duration `json:"backoff,omitempty"`
+	MaxBackoff Duration `json:"max_backoff,omitempty"`
+}
+
+// Duration a time.Duration in JSON as string, e.g. "1h"
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads a JSON webhooks file
+func LoadConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	names := map[string]bool{}
+	for _, webhook := range config.Webhooks {
+		if webhook.Name == "" || webhook.URL == "" {
+			return nil, fmt.Errorf("%s: webhooks need a name and url", filename)
+		}
+		if webhook.Secret == "" {
+			return nil, fmt.Errorf("%s: webhook %s needs a secret", filename, webhook.Name)
+		}
+		if names[webhook.Name] {
+			return nil, fmt.Errorf("%s: duplicate webhook: %s", filename, webhook.Name)
+		}
+		names[webhook.Name] = true
+	}
+	if config.LockThreshold == 0 {
+		config.LockThreshold = Duration(time.Hour)
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 10
+	}
+	if config.Backoff == 0 {
+		config.Backoff = Duration(30 * time.Second)
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = Duration(time.Hour)
+	}
+	return &config, nil
+}
+
+// Sign returns the signature of body for the SignatureHeader
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewID returns a random event or delivery ID
+func NewID() string {
+	random := make([]byte, 16)
+	_, _ = rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+// Dispatcher queues events for the matching webhooks in the store and
+// delivers them, retrying with exponential backoff. With several instances
+// a delivery may be sent more than once, receivers deduplicate on the
+// DeliveryHeader.
+type Dispatcher struct {
+	config *Config
+	store  store.Webhooks
+	client *http.Client
+	logger *slog.Logger
+	wake   chan struct{}
+}
+
+// NewDispatcher creates a dispatcher for the webhooks of config
+func NewDispatcher(config *Config, store store.Webhooks, logger *slog.Logger) *Dispatcher {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	return &Dispatcher{
+		config: config,
+		store:  store,
+		client: &http.Client{Timeout: deliveryTimeout},
+		logger: logger,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Wants determines if a webhook receives eventType events of ref, e.g. to
+// skip summarizing changes nobody receives
+func (d *Dispatcher) Wants(eventType, ref string) bool {
+	if d == nil {
+		return false
+	}
+	for _, webhook := range d.config.Webhooks {
+		if webhook.matches(eventType, ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// LockThreshold is how long a lock is held before lock_held is sent
+func (d *Dispatcher) LockThreshold() time.Duration {
+	if d == nil {
+		return 0
+	}
+	return time.Duration(d.config.LockThreshold)
+}
+
+// Notify queues the event for every matching webhook
+func (d *Dispatcher) Notify(event types.Event) error {
+	if d == nil {
+		return nil
+	}
+	queued := false
+	for _, webhook := range d.config.Webhooks {
+		if !webhook.matches(event.Type, event.Ref) {
+			continue
+		}
+		delivery := types.WebhookDelivery{
+			ID:          NewID(),
+			Webhook:     webhook.Name,
+			Event:       event,
+			NextAttempt: time.Now(),
+		}
+		if err := d.store.PutDelivery(delivery); err != nil {
+			return fmt.Errorf("queue delivery to %s: %w", webhook.Name, err)
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) webhook(name string) (Webhook, bool) {
+	for _, webhook := range d.config.Webhooks {
+		if webhook.Name == name {
+			return webhook, true
+		}
+	}
+	return Webhook{}, false
+}
+
+// backoff before the attempt following attempts failed ones
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := time.Duration(d.config.Backoff)
+	for i := 1; i < attempts && backoff < time.Duration(d.config.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if backoff > time.Duration(d.config.MaxBackoff) {
+		backoff = time.Duration(d.config.MaxBackoff)
+	}
+	return backoff
+}
+
+// send posts the signed event to the webhook
+func (d *Dispatcher) send(webhook Webhook, delivery types.WebhookDelivery) error {
+	body, err := json.Marshal(&delivery.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "terraform-backend-hsdp")
+	req.Header.Set(EventHeader, delivery.Event.Type)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// deliver sends the queued deliveries that are due
+func (d *Dispatcher) deliver() error {
+	deliveries, err := d.store.ListDeliveries()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, delivery := range deliveries {
+		if delivery.NextAttempt.After(now) {
+			continue
+		}
+		logger := d.logger.With("webhook", delivery.Webhook, "delivery", delivery.ID, "event", delivery.Event.Type, "ref", delivery.Event.Ref)
+		webhook, ok := d.webhook(delivery.Webhook)
+		if !ok {
+			logger.Warn("dropping delivery to removed webhook")
+			_ = d.store.DeleteDelivery(delivery.ID)
+			continue
+		}
+		err := d.send(webhook, delivery)
+		if err == nil {
+			logger.Debug("delivered webhook event")
+			if err := d.store.DeleteDelivery(delivery.ID); err != nil {
+				logger.Error("failed to delete delivery", "error", err)
+			}
+			continue
+		}
+		delivery.Attempts++
+		if delivery.Attempts >= d.config.MaxAttempts {
+			logger.Error("dropping delivery after failed attempts", "attempts", delivery.Attempts, "error", err)
+			_ = d.store.DeleteDelivery(delivery.ID)
+			continue
+		}
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = now.Add(d.backoff(delivery.Attempts))
+		logger.Warn("webhook delivery failed", "attempts", delivery.Attempts, "next_attempt", delivery.NextAttempt, "error", err)
+		if err := d.store.PutDelivery(delivery); err != nil {
+			logger.Error("failed to requeue delivery", "error", err)
+		}
+	}
+	return nil
+}
+
+// Run delivers queued events as they are notified and retries failed
+// deliveries every interval, it does not return
+func (d *Dispatcher) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.deliver(); err != nil {
+			d.logger.Error("failed to list webhook deliveries", "error", err)
+		}
+		select {
+		case <-d.wake:
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+)
+
+// memoryQueue keeps deliveries in memory
+type memoryQueue struct {
+	mu         sync.Mutex
+	deliveries map[string]types.WebhookDelivery
+}
+
+func newMemoryQueue() *memoryQueue {
+	return &memoryQueue{deliveries: map[string]types.WebhookDelivery{}}
+}
+
+func (m *memoryQueue) PutDelivery(delivery types.WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (m *memoryQueue) DeleteDelivery(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.deliveries, id)
+	return nil
+}
+
+func (m *memoryQueue) ListDeliveries() ([]types.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deliveries := make([]types.WebhookDelivery, 0, len(m.deliveries))
+	for _, delivery := range m.deliveries {
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// only returns the single queued delivery
+func (m *memoryQueue) only(t *testing.T) types.WebhookDelivery {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.deliveries) != 1 {
+		t.Fatalf("expected one queued delivery, got %d", len(m.deliveries))
+	}
+	for _, delivery := range m.deliveries {
+		return delivery
+	}
+	return types.WebhookDelivery{}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"type":"state_updated"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	if signature := Sign("secret", body); signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("unexpected signature %s", signature)
+	}
+	if Sign("other", body) == Sign("secret", body) {
+		t.Fatal("expected the signature to depend on the secret")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		filename := filepath.Join(dir, "webhooks.json")
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	if _, err := LoadConfig(write(`{"webhooks": [{"name": "ci", "url": "https://hooks.example.com"}]}`)); err == nil || !strings.Contains(err.Error(), "needs a secret") {
+		t.Fatalf("expected a webhook without secret to be rejected, got %v", err)
+	}
+	config, err := LoadConfig(write(`{"webhooks": [{"name": "ci", "url": "https://hooks.example.com", "secret": "s"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxAttempts != 10 || time.Duration(config.Backoff) != 30*time.Second || time.Duration(config.MaxBackoff) != time.Hour {
+		t.Fatalf("expected the default delivery settings, got %+v", config)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	webhook := Webhook{RefPrefixes: []string{"team/network"}}
+	for ref, expected := range map[string]bool{
+		"team/network":             true,
+		"team/network/prod":        true,
+		"team/network-legacy/prod": false,
+		"team":                     false,
+	} {
+		if matched := webhook.matches(types.EventStateUpdated, ref); matched != expected {
+			t.Errorf("%s: expected %v, got %v", ref, expected, matched)
+		}
+	}
+	if webhook.matches(types.EventLockAcquired, "team/network") {
+		t.Error("expected lock_acquired to be sent only when listed")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	dispatcher := NewDispatcher(&Config{
+		Backoff:    Duration(30 * time.Second),
+		MaxBackoff: Duration(2 * time.Minute),
+	}, newMemoryQueue(), nil)
+	for attempts, expected := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		4:  2 * time.Minute,
+		64: 2 * time.Minute,
+	} {
+		if backoff := dispatcher.backoff(attempts); backoff != expected {
+			t.Errorf("attempt %d: expected %s, got %s", attempts, expected, backoff)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failing  = true
+		received []*http.Request
+		bodies   [][]byte
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	queue := newMemoryQueue()
+	dispatcher := NewDispatcher(&Config{
+		Webhooks:    []Webhook{{Name: "ci", URL: receiver.URL, Secret: "secret"}},
+		MaxAttempts: 3,
+		Backoff:     Duration(time.Minute),
+		MaxBackoff:  Duration(time.Hour),
+	}, queue, nil)
+
+	if err := dispatcher.Notify(types.Event{ID: "1", Type: types.EventStateUpdated, Ref: "alice/prod"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed delivery is requeued with a backoff
+	if err := dispatcher.deliver(); err != nil {
+		t.Fatal(err)
+	}
+	delivery := queue.only(t)
+	if delivery.Attempts != 1 || delivery.LastError == "" || time.Until(delivery.NextAttempt) < 50*time.Second {
+		t.Fatalf("expected the delivery to be retried in a minute, got %+v", delivery)
+	}
+	// not due yet
+	if err := dispatcher.deliver(); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("expected no attempt before the backoff, got %d", len(received))
+	}
+
+	// a due delivery is sent signed and removed
+	delivery.NextAttempt = time.Now()
+	_ = queue.PutDelivery(delivery)
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if err := dispatcher.deliver(); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue.deliveries) != 0 {
+		t.Fatalf("expected the delivery to be removed, got %v", queue.deliveries)
+	}
+	last := received[len(received)-1]
+	if last.Header.Get(SignatureHeader) != Sign("secret", bodies[len(bodies)-1]) ||
+		last.Header.Get(DeliveryHeader) != delivery.ID ||
+		last.Header.Get(EventHeader) != types.EventStateUpdated {
+		t.Fatalf("expected a signed delivery, got %v", last.Header)
+	}
+
+	// dropped after MaxAttempts
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if err := dispatcher.Notify(types.Event{ID: "2", Type: types.EventStateDeleted, Ref: "alice/prod"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		for id, delivery := range queue.deliveries {
+			delivery.NextAttempt = time.Now()
+			queue.deliveries[id] = delivery
+		}
+		if err := dispatcher.deliver(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(queue.deliveries) != 0 {
+		t.Fatalf("expected the delivery to be dropped after 3 attempts, got %v", queue.deliveries)
+	}
+}
@@ -0,0 +1,79 @@
+package backend
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/store"
+	"github.com/loafoe/terraform-backend-hsdp/backend/types"
+	"github.com/loafoe/terraform-backend-hsdp/backend/webhook"
+)
+
+// readState gets the decrypted state of ref, or of a version of it
+func (c *Backend) readState(ref string, version ...string) (map[string]interface{}, error) {
+	state, encrypted, err := c.store.GetState(ref, version...)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		if state, err = c.decryptState(state); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.unprotectSensitive(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// summarizeChanges compares the current state of ref with state when a
+// webhook receives eventType events, nil otherwise
+func (c *Backend) summarizeChanges(r *http.Request, eventType, ref string, state map[string]interface{}) *types.ChangeSummary {
+	if !c.options.Webhooks.Wants(eventType, ref) {
+		return nil
+	}
+	previous, err := c.readState(ref)
+	if err != nil && err != store.ErrNotFound {
+		c.logger(r).Warn("failed to read the previous state for the change summary", "ref", ref, "error", err)
+		return nil
+	}
+	return webhook.Summarize(previous, state)
+}
+
+// watchLock sends lock_held when the lock is still held after the lock
+// threshold of the webhooks. The timer keeps the identity and the request
+// logger rather than the request. It only lives in the instance that
+// granted the lock, so the event is lost when that instance restarts
+// before the threshold.
+func (c *Backend) watchLock(r *http.Request, ref string, lock types.Lock) {
+	if !c.options.Webhooks.Wants(types.EventLockHeld, ref) {
+		return
+	}
+	event := types.Event{
+		Type: types.EventLockHeld,
+		Ref:  ref,
+		Lock: &lock,
+	}
+	if info := getRequestInfo(r); info != nil && info.identity != nil {
+		event.Identity = info.identity.Name
+	}
+	logger := c.logger(r)
+	time.AfterFunc(c.options.Webhooks.LockThreshold(), func() {
+		held, err := c.getLock(ref)
+		if err != nil || held.ID != lock.ID {
+			return
+		}
+		c.notify(logger, event)
+	})
+}
+
+// determines if identity may release the lock of another process on ref,
+// as terraform force-unlock does, which needs admin access through its
+// namespace, a team or a grant
+func (c *Backend) canForceUnlock(identity *auth.Identity, ref string) bool {
+	if identity == nil {
+		return true
+	}
+	return c.canAccess(identity, auth.Admin, ref)
+}
@@ -1,196 +1,537 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"path/filepath"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
 
-	"github.com/dip-software/go-dip-api/console"
-
 	"github.com/cloudfoundry-community/gautocloud"
-        "github.com/golang-jwt/jwt"
 	"github.com/dip-software/gautocloud-connectors/hsdp"
 
 	"github.com/loafoe/terraform-backend-hsdp/backend"
+	"github.com/loafoe/terraform-backend-hsdp/backend/audit"
+	"github.com/loafoe/terraform-backend-hsdp/backend/auth"
+	"github.com/loafoe/terraform-backend-hsdp/backend/metrics"
+	"github.com/loafoe/terraform-backend-hsdp/backend/seal"
 	"github.com/loafoe/terraform-backend-hsdp/backend/store/s3"
+	"github.com/loafoe/terraform-backend-hsdp/backend/webhook"
 )
 
 func main() {
 	// Config
 	viper.SetEnvPrefix("tfstate")
 	viper.SetDefault("key", "")
+	viper.SetDefault("listen_address", ":8080")
+	viper.SetDefault("shutdown_timeout", "8s")
+	viper.SetDefault("tls_cert_file", "")
+	viper.SetDefault("tls_key_file", "")
+	viper.SetDefault("tls_client_ca_file", "")
+	viper.SetDefault("tls_client_auth", "request")
 	viper.SetDefault("regions", "us-east,eu-west")
 	viper.SetDefault("allow_list", "")
+	viper.SetDefault("auth_providers", "token,hsdp")
+	viper.SetDefault("max_token_ttl", "2160h")
+	viper.SetDefault("redirect_grace_period", "720h")
+	viper.SetDefault("admins", "")
+	viper.SetDefault("forwarded_for", false)
+	viper.SetDefault("lockout_threshold", 5)
+	viper.SetDefault("lockout_addresses", false)
+	viper.SetDefault("lockout_backoff", "1m")
+	viper.SetDefault("lockout_max_backoff", "1h")
+	viper.SetDefault("auth_cache_ttl", "5m")
+	viper.SetDefault("auth_cache_negative_ttl", "30s")
+	viper.SetDefault("auth_cache_size", 1000)
+	viper.SetDefault("htpasswd_file", "")
+	viper.SetDefault("mtls_identity", "cn")
+	viper.SetDefault("oidc_issuer", "")
+	viper.SetDefault("oidc_audience", "")
+	viper.SetDefault("oidc_groups_claim", "groups")
+	viper.SetDefault("policy_file", "")
+	viper.SetDefault("group_sources", "")
+	viper.SetDefault("groups_file", "")
+	viper.SetDefault("hsdp_roles_region", "")
+	viper.SetDefault("hsdp_roles_username", "")
+	viper.SetDefault("hsdp_roles_password", "")
+	viper.SetDefault("read_only_on_key_mismatch", false)
+	viper.SetDefault("encryption_policy", "")
+	viper.SetDefault("encrypt_locks", false)
+	viper.SetDefault("encrypt_metadata", false)
+	viper.SetDefault("metadata_index_fields", "")
+	viper.SetDefault("protect_sensitive", false)
+	viper.SetDefault("metrics", true)
+	viper.SetDefault("stats_interval", "5m")
+	viper.SetDefault("webhooks_file", "")
+	viper.SetDefault("webhooks_interval", "30s")
+	viper.SetDefault("audit", false)
+	viper.SetDefault("audit_sinks", "")
+	viper.SetDefault("audit_buffer_size", 1000)
+	viper.SetDefault("audit_file", "audit.log")
+	viper.SetDefault("audit_file_max_size_mb", 100)
+	viper.SetDefault("audit_file_max_backups", 5)
+	viper.SetDefault("audit_syslog_network", "tcp")
+	viper.SetDefault("audit_syslog_address", "")
+	viper.SetDefault("audit_syslog_ca_file", "")
+	viper.SetDefault("sealed", false)
+	viper.SetDefault("unseal_threshold", 3)
+	viper.SetDefault("unseal_share_hashes", "")
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("log_format", "json")
 	viper.AutomaticEnv()
 
+	logger, err := newLogger(viper.GetString("log_level"), viper.GetString("log_format"))
+	if err != nil {
+		log.Printf("logger: %v\n", err)
+		return
+	}
+	slog.SetDefault(logger)
+
 	encryptionKey := viper.GetString("key")
 	hsdpRegions := strings.Split(viper.GetString("regions"), ",")
 	allowList := viper.GetString("allow_list")
 
-	if encryptionKey == "" {
-		log.Printf("encryption key cannot be blank\n")
+	if len(os.Args) > 1 && os.Args[1] == "split-key" {
+		if err := splitKey(encryptionKey, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var sealer *seal.Sealer
+	var keyProvider interface{} = []byte(encryptionKey)
+	if viper.GetBool("sealed") {
+		sealer, err = seal.NewSealer(viper.GetInt("unseal_threshold"), splitList(viper.GetString("unseal_share_hashes")))
+		if err != nil {
+			logger.Error("sealed start-up", "error", err)
+			return
+		}
+		keyProvider = sealer.Key
+	} else if encryptionKey == "" {
+		logger.Error("encryption key cannot be blank")
+		return
+	}
+
+	encryptionPolicy, err := backend.ParseEncryptionPolicy(viper.GetString("encryption_policy"))
+	if err != nil {
+		logger.Error("encryption policy", "error", err)
 		return
 	}
 
 	// S3 bucket
 	var svc *hsdp.S3MinioClient
-	err := gautocloud.Inject(&svc)
+	err = gautocloud.Inject(&svc)
 	if err != nil {
-		log.Printf("gautocloud: %v\n", err)
+		logger.Error("gautocloud", "error", err)
 		return
 	}
 
+	var backendMetrics *metrics.Metrics
+	if viper.GetBool("metrics") {
+		backendMetrics = metrics.New()
+	}
+
 	// create a store
 	store := s3.NewStore(&s3.Options{
-		Client: svc.Client,
-		Bucket: svc.Bucket,
+		Client:  svc.Client,
+		Bucket:  svc.Bucket,
+		Observe: backendMetrics.ObserveStore,
+		Logger:  logger,
 	})
 
+	// only trusted behind a proxy setting the header, such as the CF router
+	forwardedFor := viper.GetBool("forwarded_for")
+
+	var throttle *auth.Throttle
+	if threshold := viper.GetInt("lockout_threshold"); threshold > 0 {
+		throttle = auth.NewThrottle(threshold,
+			viper.GetDuration("lockout_backoff"),
+			viper.GetDuration("lockout_max_backoff"))
+		throttle.Addresses = viper.GetBool("lockout_addresses")
+		throttle.ForwardedFor = forwardedFor
+	}
+
+	readinessChecks := map[string]func() error{}
+	authenticator, err := newAuthenticator(store, throttle, hsdpRegions, allowList, readinessChecks)
+	if err != nil {
+		logger.Error("authentication", "error", err)
+		return
+	}
+
+	groupSource, err := newGroupSource()
+	if err != nil {
+		logger.Error("groups", "error", err)
+		return
+	}
+	refResolver := auth.NamespaceRef
+	var policy *auth.Policy
+	if policyFile := viper.GetString("policy_file"); policyFile != "" {
+		if policy, err = auth.LoadPolicy(policyFile); err != nil {
+			logger.Error("policy", "error", err)
+			return
+		}
+		policy.Groups = groupSource
+	}
+	if groupSource != nil {
+		refResolver = auth.TeamRef(groupSource, auth.NamespaceRef)
+	}
+
+	var dispatcher *webhook.Dispatcher
+	if webhooksFile := viper.GetString("webhooks_file"); webhooksFile != "" {
+		config, err := webhook.LoadConfig(webhooksFile)
+		if err != nil {
+			logger.Error("webhooks", "error", err)
+			return
+		}
+		dispatcher = webhook.NewDispatcher(config, store, logger)
+	}
+
+	auditSinks, err := newAuditSinks()
+	if err != nil {
+		logger.Error("audit sinks", "error", err)
+		return
+	}
+
 	// create a backend
 	tfbackend := backend.NewBackend(store, &backend.Options{
-		EncryptionKey: []byte(encryptionKey),
-		Logger: func(level, message string, err error) {
-			if err != nil {
-				log.Printf("%s: %s - %v", level, message, err)
-			} else {
-				log.Printf("%s: %s", level, message)
-			}
-		},
+		EncryptionKey: keyProvider,
+		Logger:        logger,
 		GetMetadataFunc: func(state map[string]interface{}) map[string]interface{} {
 			// fmt.Println(state)
 			return map[string]interface{}{
 				"test": "metadata",
 			}
 		},
-		GetRefFunc: refFunc(hsdpRegions, allowList),
+		Authenticator:         authenticator,
+		RefResolver:           refResolver,
+		Throttle:              throttle,
+		ForwardedFor:          forwardedFor,
+		Webhooks:              dispatcher,
+		Audit:                 viper.GetBool("audit"),
+		AuditSinks:            auditSinks,
+		AuditBufferSize:       viper.GetInt("audit_buffer_size"),
+		Metrics:               backendMetrics,
+		Admins:                splitList(viper.GetString("admins")),
+		Groups:                groupSource,
+		Policy:                policy,
+		GetEncryptFunc:        encryptionPolicy.GetEncryptFunc(),
+		ReadOnlyOnKeyMismatch: viper.GetBool("read_only_on_key_mismatch"),
+		EncryptLocks:          viper.GetBool("encrypt_locks"),
+		EncryptMetadata:       viper.GetBool("encrypt_metadata"),
+		MetadataIndexFields:   splitList(viper.GetString("metadata_index_fields")),
+		ProtectSensitive:      viper.GetBool("protect_sensitive"),
+		MaxTokenTTL:           viper.GetDuration("max_token_ttl"),
+		RedirectGracePeriod:   viper.GetDuration("redirect_grace_period"),
+		Sealer:                sealer,
+		ReadinessChecks:       readinessChecks,
 	})
 	if err := tfbackend.Init(); err != nil {
-		log.Fatal(err)
+		logger.Error("failed to initialize backend", "error", err)
+		os.Exit(1)
 	}
 
-	// state
-	http.HandleFunc("/states", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			tfbackend.HandleListStates(w, r)
-		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+	if backendMetrics != nil {
+		if throttle != nil {
+			backendMetrics.RegisterThrottle(throttle)
 		}
-	})
+		go backendMetrics.CollectStats(store, viper.GetDuration("stats_interval"), logger)
+	}
 
-	// version
-	http.HandleFunc("/versions", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			tfbackend.HandleListVersions(w, r)
-		case http.MethodDelete:
-			tfbackend.HandleKeepVersions(w, r)
-		case "RETRIEVE":
-			tfbackend.HandleRetrieveVersion(w, r)
-		case http.MethodPut:
-			tfbackend.HandleRestoreVersion(w, r)
-		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+	if dispatcher != nil {
+		go dispatcher.Run(viper.GetDuration("webhooks_interval"))
+	}
+
+	address := viper.GetString("listen_address")
+	certFile := viper.GetString("tls_cert_file")
+	keyFile := viper.GetString("tls_key_file")
+	// request contexts end on shutdown, which closes the event streams
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:        address,
+		Handler:     tfbackend.Handler(),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	server.RegisterOnShutdown(cancelRequests)
+	if certFile != "" {
+		tlsConfig, err := newTLSConfig()
+		if err != nil {
+			logger.Error("tls", "error", err)
+			return
 		}
-	})
+		server.TLSConfig = tlsConfig
+	}
 
-	// add handlers
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "LOCK":
-			tfbackend.HandleLockState(w, r)
-		case "UNLOCK":
-			tfbackend.HandleUnlockState(w, r)
-		case http.MethodGet:
-			tfbackend.HandleGetState(w, r)
-		case http.MethodPost:
-			tfbackend.HandleUpdateState(w, r)
-		case http.MethodDelete:
-			tfbackend.HandleDeleteState(w, r)
-		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+	// Cloud Foundry sends SIGTERM before it stops an instance
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	serverErr := make(chan error, 1)
+	go func() {
+		if certFile == "" {
+			logger.Info("starting server", "address", address)
+			serverErr <- server.ListenAndServe()
+			return
 		}
-	})
+		logger.Info("starting TLS server", "address", address)
+		serverErr <- server.ListenAndServeTLS(certFile, keyFile)
+	}()
 
-	log.Println("Starting server on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	select {
+	case err := <-serverErr:
+		logger.Error("server stopped", "error", err)
+		if err := tfbackend.Close(); err != nil {
+			logger.Error("failed to close backend", "error", err)
+		}
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	logger.Info("shutting down", "timeout", viper.GetDuration("shutdown_timeout"))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown_timeout"))
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to finish requests", "error", err)
+	}
+	// append the queued audit events and flush the audit sinks
+	if err := tfbackend.Close(); err != nil {
+		logger.Error("failed to close backend", "error", err)
+	}
+	logger.Info("server stopped")
 }
 
-func refFunc(regions []string, allowList string) func(*http.Request) (string, error) {
-	var allowed []string
-	clients := make(map[string]*console.Client, len(regions))
+// newLogger creates the redacting JSON or text logger of the given level
+func newLogger(level, format string) (*slog.Logger, error) {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+	return slog.New(backend.NewRedactHandler(handler)), nil
+}
 
-	for _, region := range regions {
-		client, err := console.NewClient(nil, &console.Config{
-			Region: region,
-		})
-		if err == nil {
-			clients[region] = client
-		}
+// newTLSConfig configures client certificate verification against the
+// configured CA bundle
+func newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
 	}
-	if allowList != "" {
-		allowed = strings.Split(allowList, ",")
+	caFile := viper.GetString("tls_client_ca_file")
+	if caFile == "" {
+		return tlsConfig, nil
 	}
-	return func(r *http.Request) (string, error) {
-		// Authenticate
-		username, password, ok := r.BasicAuth()
-		if !ok {
-			return "", fmt.Errorf("missing authentication")
-		}
-		if len(allowed) > 0 {
-			approved := false
-			for _, u := range allowed {
-				if username == u {
-					approved = true
-					break
+	bundle, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("%s: no certificates found", caFile)
+	}
+	tlsConfig.ClientCAs = pool
+	switch clientAuth := viper.GetString("tls_client_auth"); clientAuth {
+	case "request":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth: %s", clientAuth)
+	}
+	return tlsConfig, nil
+}
+
+// newAuditSinks creates the configured audit event sinks
+func newAuditSinks() ([]audit.Sink, error) {
+	var sinks []audit.Sink
+	for _, name := range splitList(viper.GetString("audit_sinks")) {
+		switch name {
+		case "stdout":
+			sinks = append(sinks, audit.NewWriter(os.Stdout))
+		case "file":
+			file, err := audit.NewFile(
+				viper.GetString("audit_file"),
+				viper.GetInt64("audit_file_max_size_mb")*1024*1024,
+				viper.GetInt("audit_file_max_backups"))
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, file)
+		case "syslog":
+			tlsConfig := &tls.Config{
+				MinVersion: tls.VersionTLS12,
+			}
+			if caFile := viper.GetString("audit_syslog_ca_file"); caFile != "" {
+				bundle, err := os.ReadFile(caFile)
+				if err != nil {
+					return nil, err
 				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(bundle) {
+					return nil, fmt.Errorf("%s: no certificates found", caFile)
+				}
+				tlsConfig.RootCAs = pool
 			}
-			if !approved {
-				return "", fmt.Errorf("not authorized to use this backend")
+			syslog, err := audit.NewSyslog(
+				viper.GetString("audit_syslog_network"),
+				viper.GetString("audit_syslog_address"),
+				tlsConfig)
+			if err != nil {
+				return nil, err
 			}
+			sinks = append(sinks, syslog)
+		default:
+			return nil, fmt.Errorf("unknown sink: %s", name)
+		}
+	}
+	return sinks, nil
+}
+
+// splitList splits a comma separated list, dropping empty elements
+func splitList(list string) []string {
+	var elements []string
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
 		}
-		checkRegion := r.URL.Query().Get("region")
-		authenticated := false
+	}
+	return elements
+}
 
-		var client *console.Client
-		for region, rc := range clients {
-			if checkRegion != "" && region != checkRegion {
-				continue
+// splitKey prints the Shamir key shares of the encryption key, and their
+// hashes for TFSTATE_UNSEAL_SHARE_HASHES to stderr
+func splitKey(encryptionKey string, args []string) error {
+	fs := flag.NewFlagSet("split-key", flag.ExitOnError)
+	shares := fs.Int("shares", 5, "number of key shares to generate")
+	threshold := fs.Int("threshold", 3, "number of key shares required to unseal")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if encryptionKey == "" {
+		return fmt.Errorf("encryption key cannot be blank")
+	}
+	parts, err := seal.Split([]byte(encryptionKey), *shares, *threshold)
+	if err != nil {
+		return err
+	}
+	hashes := make([]string, 0, len(parts))
+	for _, part := range parts {
+		fmt.Println(base64.StdEncoding.EncodeToString(part))
+		hashes = append(hashes, seal.HashShare(part))
+	}
+	fmt.Fprintf(os.Stderr, "TFSTATE_UNSEAL_SHARE_HASHES=%s\n", strings.Join(hashes, ","))
+	return nil
+}
+
+// newAuthenticator chains the configured authentication providers and adds
+// their readiness checks to checks
+func newAuthenticator(store *s3.Store, throttle *auth.Throttle, regions []string, allowList string, checks map[string]func() error) (auth.Authenticator, error) {
+	var chain auth.Chain
+	for _, provider := range splitList(viper.GetString("auth_providers")) {
+		switch provider {
+		case "token":
+			chain = append(chain, &auth.Tokens{Store: store})
+		case "hsdp":
+			hsdpAuth := auth.NewHSDP(regions)
+			hsdpAuth.Cache = auth.NewCredentialCache(
+				viper.GetDuration("auth_cache_ttl"),
+				viper.GetDuration("auth_cache_negative_ttl"),
+				viper.GetInt("auth_cache_size"))
+			checks["hsdp"] = func() error {
+				if len(hsdpAuth.Regions()) == 0 {
+					return fmt.Errorf("no HSDP region clients for regions: %v", regions)
+				}
+				return nil
+			}
+			chain = append(chain, hsdpAuth)
+		case "htpasswd":
+			htpasswd, err := auth.LoadHtpasswd(viper.GetString("htpasswd_file"))
+			if err != nil {
+				return nil, fmt.Errorf("htpasswd: %w", err)
 			}
-			c, err := rc.WithLogin(username, password)
-			if err == nil && c != nil {
-				client = c
-				authenticated = true
-				break
+			chain = append(chain, htpasswd)
+		case "oidc":
+			oidc, err := auth.NewOIDC(
+				viper.GetString("oidc_issuer"),
+				viper.GetString("oidc_audience"),
+				viper.GetString("oidc_groups_claim"))
+			if err != nil {
+				return nil, err
 			}
-			if c != nil {
-				c.Close()
+			chain = append(chain, oidc)
+		case "mtls":
+			clientCert, err := auth.NewClientCert(viper.GetString("mtls_identity"))
+			if err != nil {
+				return nil, err
 			}
+			chain = append(chain, clientCert)
+		default:
+			return nil, fmt.Errorf("unknown provider: %s", provider)
 		}
-		if !authenticated || client == nil {
-			return "", fmt.Errorf("authorization failed")
-		}
-		defer client.Close()
-		token, _ := jwt.Parse(client.IDToken(), func(token *jwt.Token) (interface{}, error) {
-			return nil, nil
-		})
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || claims["sub"] == "" {
-			return "", fmt.Errorf("invalid claims")
-		}
-		userUUID := claims["sub"].(string)
-		path := r.URL.Path
-		if path == "/versions" || path == "/states" {
-			path = "/"
-		}
-		queryRef := r.URL.Query().Get("ref")
-		if queryRef != "" {
-			path = queryRef
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no providers configured")
+	}
+	var authenticator auth.Authenticator = chain
+	if throttle != nil {
+		throttle.Authenticator = chain
+		authenticator = throttle
+	}
+	if allowList != "" {
+		return &auth.AllowList{
+			Authenticator: authenticator,
+			Subjects:      splitList(allowList),
+		}, nil
+	}
+	return authenticator, nil
+}
+
+// newGroupSource combines the configured team group sources
+func newGroupSource() (auth.GroupSource, error) {
+	var sources auth.MultiGroups
+	for _, source := range splitList(viper.GetString("group_sources")) {
+		switch source {
+		case "claims":
+			sources = append(sources, auth.ClaimGroups{})
+		case "static":
+			groups, err := auth.LoadStaticGroups(viper.GetString("groups_file"))
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, groups)
+		case "hsdp":
+			lister, err := auth.NewCFRoles(
+				viper.GetString("hsdp_roles_region"),
+				viper.GetString("hsdp_roles_username"),
+				viper.GetString("hsdp_roles_password"))
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, &auth.HSDPRoles{Lister: lister, TTL: 5 * time.Minute})
+		default:
+			return nil, fmt.Errorf("unknown group source: %s", source)
 		}
-		return filepath.Join(userUUID, path), nil
 	}
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	return sources, nil
 }